@@ -1,28 +1,23 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	"log"
 	"os"
 	"runtime"
 	"strconv"
+	"time"
 
 	"net/http"
 	_ "net/http/pprof"
 
 	"github.com/PongponZ/demo-profiling-and-optimization-go/basic-setup/internal/handler"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/basic-setup/internal/jobstatus"
 	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
 	"github.com/gofiber/fiber/v2"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/streadway/amqp"
-	"github.com/xyproto/randomstring"
 )
 
-type Job struct {
-	Name string `json:"name"`
-}
-
 func main() {
 	runtime.SetBlockProfileRate(1)
 	runtime.SetMutexProfileFraction(1)
@@ -45,8 +40,87 @@ func main() {
 	rmq := libs.NewRabbitMQClient(rabbitMQURL, 1000)
 	defer rmq.Close()
 
-	rmq.QueueDeclare(rabbitMQQueue)
-
+	topologyFile := getEnv("TOPOLOGY_FILE", "topology.json")
+	topology, err := libs.LoadTopology(topologyFile)
+	if err != nil {
+		log.Fatalf("failed to load topology: %v", err)
+	}
+	if _, ok := topology.Queue(rabbitMQQueue); !ok {
+		log.Fatalf("queue %s is missing from %s", rabbitMQQueue, topologyFile)
+	}
+	if err := rmq.ApplyTopologyContext(context.Background(), topology); err != nil {
+		log.Fatalf("failed to apply topology: %v", err)
+	}
+
+	publishChannels, err := strconv.Atoi(getEnv("PUBLISH_CHANNELS", "4"))
+	if err != nil {
+		log.Fatalf("failed to parse PUBLISH_CHANNELS: %v", err)
+	}
+
+	publisher, err := rmq.NewConfirmPublisherContext(context.Background(), "basic-setup", publishChannels)
+	if err != nil {
+		log.Fatalf("failed to open publisher: %v", err)
+	}
+	defer publisher.Close()
+
+	statusExchangeName := getEnv("STATUS_EXCHANGE", "pokemon_jobs.status")
+	statusExchange, ok := topology.Exchange(statusExchangeName)
+	if !ok {
+		log.Fatalf("exchange %s is missing from %s", statusExchangeName, topologyFile)
+	}
+	statusTTL, err := time.ParseDuration(getEnv("STATUS_TTL", "1h"))
+	if err != nil {
+		log.Fatalf("failed to parse STATUS_TTL: %v", err)
+	}
+
+	// replies to /generate and job events come back on queues only this
+	// process reads, declared through a topology so they are redeclared
+	// after a reconnect
+	instance := libs.NewMessageID()[:8]
+	replyQueue := "basic-setup.replies." + instance
+	statusQueue := "basic-setup.status." + instance
+	instanceTopology := libs.Topology{
+		Exchanges: []libs.ExchangeSpec{statusExchange},
+		Queues: []libs.QueueSpec{
+			{Name: replyQueue, Exclusive: true, AutoDelete: true},
+			{Name: statusQueue, Exclusive: true, AutoDelete: true},
+		},
+		Bindings: []libs.BindingSpec{{Queue: statusQueue, Exchange: statusExchange.Name}},
+	}
+	if err := rmq.ApplyTopologyContext(context.Background(), instanceTopology); err != nil {
+		log.Fatalf("failed to declare instance queues: %v", err)
+	}
+
+	replies, err := libs.NewReplies(context.Background(), rmq, replyQueue)
+	if err != nil {
+		log.Fatalf("failed to consume replies: %v", err)
+	}
+	defer replies.Close(context.Background())
+
+	jobs := jobstatus.NewStore(statusTTL)
+	go jobs.Run(context.Background(), time.Minute)
+	events, err := rmq.ConsumeContext(context.Background(), statusQueue, statusQueue+".consumer", libs.ConsumeOptions{AutoAck: true})
+	if err != nil {
+		log.Fatalf("failed to consume job events: %v", err)
+	}
+	go jobs.Consume(events)
+
+	publishMax, err := strconv.Atoi(getEnv("PUBLISH_MAX", "10000"))
+	if err != nil {
+		log.Fatalf("failed to parse PUBLISH_MAX: %v", err)
+	}
+	publishBatchSize, err := strconv.Atoi(getEnv("PUBLISH_BATCH_SIZE", "500"))
+	if err != nil {
+		log.Fatalf("failed to parse PUBLISH_BATCH_SIZE: %v", err)
+	}
+
+	publishHandler := handler.NewPublishHandler(publisher, rabbitMQQueue, jobs, handler.PublishConfig{
+		MaxJobs:   publishMax,
+		BatchSize: publishBatchSize,
+	})
+	generateHandler := handler.NewGenerateHandler(publisher, replies, rabbitMQQueue, jobs)
+	jobsHandler := handler.NewJobsHandler(jobs)
+	replayHandler := handler.NewReplayHandler(rmq, "pokemon_generated")
 	handler := handler.NewLeakHandler()
 
 	app := fiber.New()
@@ -60,36 +134,20 @@ func main() {
 	app.Get("/alloc", handler.Alloc)      // Route that causes heavy allocations
 	app.Get("/cpu", handler.CPUIntensive) // Route that causes high CPU usage
 
-	app.Get("/publish/:number", func(c *fiber.Ctx) error {
-		number := c.Params("number")
-		numberInt, err := strconv.Atoi(number)
-		if err != nil {
-			return c.SendString("invalid number")
-		}
-
-		for range numberInt {
-			j := Job{
-				Name: randomstring.HumanFriendlyString(7),
-			}
-
-			data, err := json.Marshal(j)
-			if err != nil {
-				return c.SendString("error marshalling job")
-			}
-
-			rmq.Channel().Publish(
-				"",
-				rabbitMQQueue,
-				false,
-				false,
-				amqp.Publishing{
-					ContentType: "application/json",
-					Body:        data,
-				})
-		}
-
-		return c.SendString(fmt.Sprintf("published %d messages", numberInt))
-	})
+	app.Get("/publish/:number", publishHandler.Publish)
+	app.Get("/generate/:name", generateHandler.Generate) // ?timeout=10s&priority=0
+	app.Post("/breed", generateHandler.Breed)            // ?timeout=10s
+	app.Get("/generated", replayHandler.Replay)          // ?offset=first&limit=10
+	app.Get("/jobs", jobsHandler.List)                   // ?status=running&correlation_id=&limit=100
+	app.Get("/jobs/:id", jobsHandler.Get)
+	app.Post("/jobs", publishHandler.Submit)
 
 	app.Listen(":3010")
 }
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
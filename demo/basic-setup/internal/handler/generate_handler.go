@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/basic-setup/internal/jobstatus"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxGenerateTimeout bounds how long a request may hold a connection open.
+const maxGenerateTimeout = time.Minute
+
+// GenerateHandler publishes a single job and waits for the super-worker to
+// reply with the generated or bred pokemon.
+type GenerateHandler struct {
+	publisher libs.Publisher
+	replies   *libs.Replies
+	queue     string
+	jobs      *jobstatus.Store
+}
+
+func NewGenerateHandler(publisher libs.Publisher, replies *libs.Replies, queue string, jobs *jobstatus.Store) *GenerateHandler {
+	return &GenerateHandler{
+		publisher: publisher,
+		replies:   replies,
+		queue:     queue,
+		jobs:      jobs,
+	}
+}
+
+// Generate publishes a job for :name and returns the generated pokemon. It
+// answers 504 once ?timeout= (default 10s) passed without a result, which is
+// also the job's deadline, and 422 when the worker gave up on the job.
+func (h *GenerateHandler) Generate(c *fiber.Ctx) error {
+	timeout, err := parseTimeout(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	priority, err := strconv.ParseUint(c.Query("priority", "0"), 10, 8)
+	if err != nil || priority > jobMaxPriority {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("priority must be between 0 and %d", jobMaxPriority))
+	}
+
+	return h.request(c, Job{
+		Name:     c.Params("name"),
+		Priority: uint8(priority),
+	}, timeout)
+}
+
+// Breed publishes a breed job and returns the offspring, answering like
+// Generate. The body is the job without its type, e.g.
+// {"name":"pichu","parents":[{...},{...}],"seed":1,"breeding":{"crossover":"uniform","mutation_rate":0.01}},
+// where the parents are pokemon as returned by /generate.
+func (h *GenerateHandler) Breed(c *fiber.Ctx) error {
+	timeout, err := parseTimeout(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	var job Job
+	dec := json.NewDecoder(bytes.NewReader(c.Body()))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&job); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("body must be a breed job: %v", err))
+	}
+	if job.ID != "" || job.CorrelationID != "" || job.ReplyTo != "" || !job.Deadline.IsZero() {
+		return c.Status(fiber.StatusBadRequest).SendString("id, correlation_id, reply_to and deadline are set by the server")
+	}
+	job.Type = JobTypeBreed
+	if err := job.Validate(); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	return h.request(c, job, timeout)
+}
+
+func parseTimeout(c *fiber.Ctx) (time.Duration, error) {
+	timeout, err := time.ParseDuration(c.Query("timeout", "10s"))
+	if err != nil || timeout <= 0 || timeout > maxGenerateTimeout {
+		return 0, fmt.Errorf("timeout must be a duration up to %v", maxGenerateTimeout)
+	}
+	return timeout, nil
+}
+
+// request publishes job with a new id and correlation id and waits up to
+// timeout for its result.
+func (h *GenerateHandler) request(c *fiber.Ctx, job Job, timeout time.Duration) error {
+	job.ID = libs.NewMessageID()
+	job.CorrelationID = libs.NewMessageID()
+	job.ReplyTo = h.replies.Queue()
+	job.Deadline = time.Now().Add(timeout)
+
+	msg, err := job.Publishing()
+	if err != nil {
+		return c.SendString("error marshalling job")
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context(), timeout)
+	defer cancel()
+
+	// register before publishing so a fast reply is not dropped
+	pending := h.replies.Expect(job.CorrelationID)
+	defer pending.Cancel()
+
+	if err := h.publisher.PublishContext(ctx, "", h.queue, true, msg); err != nil {
+		return c.Status(fiber.StatusBadGateway).SendString(fmt.Sprintf("publish job %s: %v", job.ID, err))
+	}
+	h.jobs.Published(job.ID, job.CorrelationID, job.Name)
+
+	reply, err := pending.Wait(ctx)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return c.Status(fiber.StatusGatewayTimeout).SendString(fmt.Sprintf("job %s: no result within %v", job.ID, timeout))
+	case err != nil:
+		return c.Status(fiber.StatusBadGateway).SendString(fmt.Sprintf("job %s: %v", job.ID, err))
+	case reply.Type == libs.ReplyTypeError:
+		return c.Status(fiber.StatusUnprocessableEntity).SendString(fmt.Sprintf("job %s failed: %v", job.ID, reply.Headers[libs.HeaderFailureReason]))
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	c.Set("X-Job-Id", job.ID)
+	return c.Send(reply.Body)
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/basic-setup/internal/jobstatus"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/gofiber/fiber/v2"
+	"github.com/streadway/amqp"
+)
+
+// newGenerateApp serves /generate against an in-memory broker whose jobs
+// are answered by respond, standing in for the super-worker.
+func newGenerateApp(t *testing.T, respond func(job Job) (amqp.Publishing, bool)) *fiber.App {
+	t.Helper()
+
+	ctx := context.Background()
+	broker := libs.NewMemoryBroker(0)
+	t.Cleanup(broker.Close)
+	for _, q := range []string{"jobs", "replies"} {
+		if _, err := broker.QueueDeclareContext(ctx, q); err != nil {
+			t.Fatalf("declare %s: %v", q, err)
+		}
+	}
+
+	replies, err := libs.NewReplies(ctx, broker, "replies")
+	if err != nil {
+		t.Fatalf("replies: %v", err)
+	}
+
+	jobs, err := broker.ConsumeContext(ctx, "jobs", "worker", libs.ConsumeOptions{AutoAck: true})
+	if err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	go func() {
+		for d := range jobs {
+			var job Job
+			json.Unmarshal(d.Body, &job)
+			reply, ok := respond(job)
+			if !ok {
+				continue
+			}
+			reply.CorrelationId = d.CorrelationId
+			broker.PublishContext(ctx, "", d.ReplyTo, false, reply)
+		}
+	}()
+
+	h := NewGenerateHandler(broker, replies, "jobs", jobstatus.NewStore(time.Minute))
+	app := fiber.New()
+	app.Get("/generate/:name", h.Generate)
+	app.Post("/breed", h.Breed)
+	return app
+}
+
+func TestGenerateHandlerReturnsTheResult(t *testing.T) {
+	app := newGenerateApp(t, func(job Job) (amqp.Publishing, bool) {
+		return amqp.Publishing{Type: libs.ReplyTypeResult, Body: []byte(`{"name":"` + job.Name + `"}`)}, true
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/generate/pika", nil))
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != fiber.StatusOK || string(body) != `{"name":"pika"}` {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestGenerateHandlerReportsFailures(t *testing.T) {
+	app := newGenerateApp(t, func(job Job) (amqp.Publishing, bool) {
+		if job.Name == "lost" {
+			return amqp.Publishing{}, false
+		}
+		return amqp.Publishing{
+			Type:    libs.ReplyTypeError,
+			Headers: amqp.Table{libs.HeaderFailureReason: "boom"},
+		}, true
+	})
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/generate/pika", fiber.StatusUnprocessableEntity},
+		{"/generate/lost?timeout=50ms", fiber.StatusGatewayTimeout},
+		{"/generate/pika?timeout=soon", fiber.StatusBadRequest},
+		{"/generate/pika?priority=10", fiber.StatusBadRequest},
+	} {
+		resp, err := app.Test(httptest.NewRequest("GET", tc.path, nil))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.path, err)
+		}
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.path, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+func TestGenerateHandlerBreeds(t *testing.T) {
+	app := newGenerateApp(t, func(job Job) (amqp.Publishing, bool) {
+		if job.Type != JobTypeBreed || len(job.Parents) != 2 || job.Breeding.Crossover != "uniform" {
+			return amqp.Publishing{Type: libs.ReplyTypeError}, true
+		}
+		return amqp.Publishing{Type: libs.ReplyTypeResult, Body: []byte(`{"name":"` + job.Name + `"}`)}, true
+	})
+
+	post := func(body string) (int, string) {
+		req := httptest.NewRequest("POST", "/breed", strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	status, body := post(`{"name":"pichu","parents":[{"name":"pikachu","dna":"ATCG"},{"name":"eevee","dna":"GGCA"}],"breeding":{"crossover":"uniform"}}`)
+	if status != fiber.StatusOK || body != `{"name":"pichu"}` {
+		t.Fatalf("status %d: %s", status, body)
+	}
+
+	for _, body := range []string{
+		`{"name":"pichu","parents":[{"dna":"ATCG"}]}`,
+		`{"name":"pichu","parents":[{"dna":"ATCG"},{"dna":"AXCG"}]}`,
+		`{"name":"pichu","parents":[{"dna":"ATCG"},{"dna":"ATCG"}],"breeding":{"mutation_rate":2}}`,
+		`{"name":"pichu","parents":[{"dna":"ATCG"},{"dna":"ATCG"}],"breeding":{"crossover":"two_point"}}`,
+		`{"name":"pichu","parents":[{"dna":"ATCG"},{"dna":"ATCG"}],"reply_to":"elsewhere"}`,
+		`[]`,
+	} {
+		if status, resp := post(body); status != fiber.StatusBadRequest {
+			t.Errorf("%s: status %d (%s), want %d", body, status, resp, fiber.StatusBadRequest)
+		}
+	}
+}
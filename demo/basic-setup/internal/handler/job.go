@@ -0,0 +1,360 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Job types the super-worker understands.
+const (
+	JobTypeGenerate = "generate"
+	// JobTypeBreed breeds the two Parents of the job.
+	JobTypeBreed = "breed"
+	// JobTypeEvolve generates a pokemon and evolves it into every form of
+	// its Evolution.
+	JobTypeEvolve = "evolve"
+	// JobTypeBattle fights a series of battles between the two Fighters of
+	// the job.
+	JobTypeBattle = "battle"
+	// JobTypeTournament plays a tournament between the Entrants of its
+	// Tournament, each match a battle job of its own.
+	JobTypeTournament = "tournament"
+)
+
+// Job mirrors the job the super-worker consumes.
+type Job struct {
+	ID            string `json:"id,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// Type is JobTypeGenerate when empty.
+	Type     string `json:"type,omitempty"`
+	Name     string `json:"name"`
+	ReplyTo  string `json:"reply_to,omitempty"`
+	Priority uint8  `json:"priority,omitempty"`
+	// Seed makes the generated pokemon reproducible. Without one every run
+	// differs.
+	Seed    *int64     `json:"seed,omitempty"`
+	Options JobOptions `json:"options,omitzero"`
+	// Parents are the pokemon a JobTypeBreed job breeds, as the worker
+	// returned them.
+	Parents  []json.RawMessage `json:"parents,omitempty"`
+	Breeding BreedOptions      `json:"breeding,omitzero"`
+	// Evolution names the forms of a JobTypeEvolve job, one per stage.
+	Evolution Evolution `json:"evolution,omitzero"`
+	// Fighters are the pokemon a JobTypeBattle job battles, as the worker
+	// returned them. Battle also tunes every match of a tournament.
+	Fighters   []json.RawMessage `json:"fighters,omitempty"`
+	Battle     BattleOptions     `json:"battle,omitzero"`
+	Tournament Tournament        `json:"tournament,omitzero"`
+	Deadline   time.Time         `json:"deadline,omitzero"`
+}
+
+// Tournament lists the entrants of a JobTypeTournament job, as the worker
+// returned them.
+type Tournament struct {
+	// Format is "round_robin" (the default) or "bracket", whose entrants
+	// are seeded in the order they are listed.
+	Format   string            `json:"format,omitempty"`
+	Entrants []json.RawMessage `json:"entrants"`
+}
+
+// BattleOptions tune the battles of a JobTypeBattle job. Zero values keep
+// the worker's defaults.
+type BattleOptions struct {
+	// Rounds is the number of battles fought, 1 by default.
+	Rounds int `json:"rounds,omitempty"`
+	// MaxTurns is the number of turns a battle lasts at most, 100 by
+	// default.
+	MaxTurns int `json:"max_turns,omitempty"`
+}
+
+// Evolution tunes every stage of a JobTypeEvolve job. Zero values keep the
+// worker's defaults.
+type Evolution struct {
+	Names []string `json:"names"`
+	// Levels is how many levels each stage gains, 16 by default.
+	Levels int `json:"levels,omitempty"`
+	// MutationRate is the chance of every base to mutate per stage, 0.002
+	// by default.
+	MutationRate float64 `json:"mutation_rate,omitempty"`
+	AbilityLimit int     `json:"ability_limit,omitempty"`
+}
+
+// BreedOptions tune how the offspring of a JobTypeBreed job is bred.
+type BreedOptions struct {
+	// Crossover is "single_point" (the default) or "uniform".
+	Crossover    string  `json:"crossover,omitempty"`
+	MutationRate float64 `json:"mutation_rate,omitempty"`
+}
+
+// parent is the part of a pokemon a breed job needs.
+type parent struct {
+	DNA string `json:"dna"`
+}
+
+// JobOptions tune how a pokemon is generated. Zero values keep the worker's
+// defaults.
+type JobOptions struct {
+	// DNALength is the number of bases in the DNA, 10000 by default.
+	DNALength int `json:"dna_length,omitempty"`
+	// AbilityLimit is how many abilities each ability lookup returns.
+	AbilityLimit int `json:"ability_limit,omitempty"`
+}
+
+// jobMaxPriority matches the x-max-priority of the job queue.
+const jobMaxPriority = 9
+
+// Limits of a submitted job.
+const (
+	maxJobIDLength     = 64
+	maxJobNameLength   = 64
+	maxJobDNALength    = 100000
+	maxJobAbilityLimit = 100
+	// maxJobStages matches the number of times the worker evolves a
+	// pokemon.
+	maxJobStages = 3
+	// maxJobRounds matches the most battles the worker fights for one job.
+	maxJobRounds   = 10000
+	maxJobMaxTurns = 1000
+	// maxJobEntrants matches the largest tournament the worker plays.
+	maxJobEntrants = 64
+)
+
+// Validate checks a job submitted through the API.
+func (j Job) Validate() error {
+	var errs []error
+	if len(j.ID) > maxJobIDLength {
+		errs = append(errs, fmt.Errorf("id is longer than %d characters", maxJobIDLength))
+	}
+	if j.Name == "" || len(j.Name) > maxJobNameLength {
+		errs = append(errs, fmt.Errorf("name must have 1 to %d characters", maxJobNameLength))
+	}
+	if j.Priority > jobMaxPriority {
+		errs = append(errs, fmt.Errorf("priority must be between 0 and %d", jobMaxPriority))
+	}
+	if j.Options.DNALength < 0 || j.Options.DNALength > maxJobDNALength {
+		errs = append(errs, fmt.Errorf("options.dna_length must be between 0 and %d", maxJobDNALength))
+	}
+	if j.Options.AbilityLimit < 0 || j.Options.AbilityLimit > maxJobAbilityLimit {
+		errs = append(errs, fmt.Errorf("options.ability_limit must be between 0 and %d", maxJobAbilityLimit))
+	}
+	switch j.Type {
+	case "", JobTypeGenerate, JobTypeBreed, JobTypeEvolve, JobTypeBattle, JobTypeTournament:
+	default:
+		errs = append(errs, fmt.Errorf("unknown type %q", j.Type))
+	}
+	switch {
+	case j.Type == JobTypeBreed:
+		if err := j.validateBreed(); err != nil {
+			errs = append(errs, err)
+		}
+	case len(j.Parents) > 0 || j.Breeding != (BreedOptions{}):
+		errs = append(errs, errors.New("parents and breeding are only for breed jobs"))
+	}
+	switch {
+	case j.Type == JobTypeEvolve:
+		if err := j.validateEvolve(); err != nil {
+			errs = append(errs, err)
+		}
+	case !j.Evolution.isZero():
+		errs = append(errs, errors.New("evolution is only for evolve jobs"))
+	}
+	switch {
+	case j.Type == JobTypeBattle:
+		if err := j.validateBattle(); err != nil {
+			errs = append(errs, err)
+		}
+	case len(j.Fighters) > 0:
+		errs = append(errs, errors.New("fighters are only for battle jobs"))
+	}
+	switch {
+	case j.Type == JobTypeTournament:
+		if err := j.validateTournament(); err != nil {
+			errs = append(errs, err)
+		}
+	case j.Tournament.Format != "" || len(j.Tournament.Entrants) > 0:
+		errs = append(errs, errors.New("tournament is only for tournament jobs"))
+	case j.Type != JobTypeBattle && j.Battle != (BattleOptions{}):
+		errs = append(errs, errors.New("battle is only for battle and tournament jobs"))
+	}
+	if !j.Deadline.IsZero() && !j.Deadline.After(time.Now()) {
+		errs = append(errs, errors.New("deadline has already passed"))
+	}
+	return errors.Join(errs...)
+}
+
+func (j Job) validateBreed() error {
+	var errs []error
+	if len(j.Parents) != 2 {
+		errs = append(errs, fmt.Errorf("breed needs 2 parents, got %d", len(j.Parents)))
+	}
+	for i, raw := range j.Parents {
+		var p parent
+		if err := json.Unmarshal(raw, &p); err != nil {
+			errs = append(errs, fmt.Errorf("parent %d: %w", i+1, err))
+			continue
+		}
+		if p.DNA == "" || strings.Trim(p.DNA, "ATCG") != "" {
+			errs = append(errs, fmt.Errorf("parent %d: dna must be a sequence of A, T, C and G", i+1))
+		}
+	}
+	switch j.Breeding.Crossover {
+	case "", "single_point", "uniform":
+	default:
+		errs = append(errs, fmt.Errorf("unknown crossover %q", j.Breeding.Crossover))
+	}
+	if j.Breeding.MutationRate < 0 || j.Breeding.MutationRate > 1 {
+		errs = append(errs, errors.New("breeding.mutation_rate must be between 0 and 1"))
+	}
+	return errors.Join(errs...)
+}
+
+func (j Job) validateEvolve() error {
+	var errs []error
+	e := j.Evolution
+	if len(e.Names) == 0 || len(e.Names) > maxJobStages {
+		errs = append(errs, fmt.Errorf("evolution.names must have 1 to %d names", maxJobStages))
+	}
+	for _, name := range e.Names {
+		if name == "" || len(name) > maxJobNameLength {
+			errs = append(errs, fmt.Errorf("evolution.names must have 1 to %d characters each", maxJobNameLength))
+			break
+		}
+	}
+	if e.Levels < 0 || e.Levels > 100 {
+		errs = append(errs, errors.New("evolution.levels must be between 0 and 100"))
+	}
+	if e.MutationRate < 0 || e.MutationRate > 1 {
+		errs = append(errs, errors.New("evolution.mutation_rate must be between 0 and 1"))
+	}
+	if e.AbilityLimit < 0 || e.AbilityLimit > maxJobAbilityLimit {
+		errs = append(errs, fmt.Errorf("evolution.ability_limit must be between 0 and %d", maxJobAbilityLimit))
+	}
+	return errors.Join(errs...)
+}
+
+// fighter is the part of a pokemon a battle job needs.
+type fighter struct {
+	Name  string         `json:"name"`
+	Types []string       `json:"types"`
+	DNA   string         `json:"dna"`
+	Stats map[string]int `json:"stats"`
+}
+
+// fighterStatCaps are the largest stats the DNA of a pokemon gives, the
+// caps of the worker's genetics package. The worker fights with stats in
+// this range only.
+var fighterStatCaps = []struct {
+	name string
+	cap  int
+}{
+	{"base_lv", 100},
+	{"hp", 255},
+	{"attack", 255},
+	{"defense", 255},
+	{"special_attack", 255},
+	{"special_defense", 255},
+	{"speed", 255},
+}
+
+func (j Job) validateBattle() error {
+	var errs []error
+	if len(j.Fighters) != 2 {
+		errs = append(errs, fmt.Errorf("battle needs 2 fighters, got %d", len(j.Fighters)))
+	}
+	for i, raw := range j.Fighters {
+		if err := validateFighter(raw); err != nil {
+			errs = append(errs, fmt.Errorf("fighter %d: %w", i+1, err))
+		}
+	}
+	if err := j.validateBattleOptions(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func validateFighter(raw json.RawMessage) error {
+	var f fighter
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return err
+	}
+	var errs []error
+	if f.Name == "" {
+		errs = append(errs, errors.New("has no name"))
+	}
+	// the worker derives the types of older pokemon from their DNA
+	if len(f.Types) == 0 && (f.DNA == "" || strings.Trim(f.DNA, "ATCG") != "") {
+		errs = append(errs, errors.New("needs types or a dna of A, T, C and G"))
+	}
+	for _, stat := range fighterStatCaps {
+		if v := f.Stats[stat.name]; v < 0 || v > stat.cap {
+			errs = append(errs, fmt.Errorf("stats.%s must be between 0 and %d", stat.name, stat.cap))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (j Job) validateBattleOptions() error {
+	var errs []error
+	if j.Battle.Rounds < 0 || j.Battle.Rounds > maxJobRounds {
+		errs = append(errs, fmt.Errorf("battle.rounds must be between 0 and %d", maxJobRounds))
+	}
+	if j.Battle.MaxTurns < 0 || j.Battle.MaxTurns > maxJobMaxTurns {
+		errs = append(errs, fmt.Errorf("battle.max_turns must be between 0 and %d", maxJobMaxTurns))
+	}
+	return errors.Join(errs...)
+}
+
+func (j Job) validateTournament() error {
+	var errs []error
+	t := j.Tournament
+	if len(t.Entrants) < 2 || len(t.Entrants) > maxJobEntrants {
+		errs = append(errs, fmt.Errorf("tournament.entrants must have 2 to %d pokemon", maxJobEntrants))
+	}
+	for i, raw := range t.Entrants {
+		if err := validateFighter(raw); err != nil {
+			errs = append(errs, fmt.Errorf("entrant %d: %w", i+1, err))
+		}
+	}
+	switch t.Format {
+	case "", "round_robin", "bracket":
+	default:
+		errs = append(errs, fmt.Errorf("unknown tournament format %q", t.Format))
+	}
+	if err := j.validateBattleOptions(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (e Evolution) isZero() bool {
+	return len(e.Names) == 0 && e.Levels == 0 && e.MutationRate == 0 && e.AbilityLimit == 0
+}
+
+// Publishing maps the job onto the AMQP message: its ID becomes the message
+// id, its priority the message priority and its deadline a per-message TTL.
+func (j Job) Publishing() (amqp.Publishing, error) {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+
+	msg := amqp.Publishing{
+		ContentType:   "application/json",
+		DeliveryMode:  amqp.Persistent,
+		MessageId:     j.ID,
+		CorrelationId: j.CorrelationID,
+		ReplyTo:       j.ReplyTo,
+		Priority:      j.Priority,
+		Body:          data,
+	}
+	if !j.Deadline.IsZero() {
+		msg.Expiration = strconv.FormatInt(max(time.Until(j.Deadline).Milliseconds(), 0), 10)
+	}
+	return msg, nil
+}
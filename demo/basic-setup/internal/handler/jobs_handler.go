@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"strconv"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/basic-setup/internal/jobstatus"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/gofiber/fiber/v2"
+)
+
+// JobsHandler serves the state of the jobs tracked from their lifecycle
+// events.
+type JobsHandler struct {
+	jobs *jobstatus.Store
+}
+
+func NewJobsHandler(jobs *jobstatus.Store) *JobsHandler {
+	return &JobsHandler{jobs: jobs}
+}
+
+// Get returns the job :id, or 404 if it is unknown or expired.
+func (h *JobsHandler) Get(c *fiber.Ctx) error {
+	job, ok := h.jobs.Get(c.Params("id"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("job not found")
+	}
+	return c.JSON(job)
+}
+
+// List returns up to ?limit= jobs (default 100), most recently updated
+// first, optionally filtered by ?status= and ?correlation_id=.
+func (h *JobsHandler) List(c *fiber.Ctx) error {
+	var filter jobstatus.Filter
+	if v := c.Query("status"); v != "" {
+		status, err := libs.ParseJobStatus(v)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		filter.Status = status
+	}
+	filter.CorrelationID = c.Query("correlation_id")
+
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit <= 0 {
+		return c.Status(fiber.StatusBadRequest).SendString("invalid limit")
+	}
+	filter.Limit = limit
+
+	return c.JSON(h.jobs.List(filter))
+}
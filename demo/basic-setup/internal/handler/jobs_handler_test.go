@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/basic-setup/internal/jobstatus"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestJobsHandler(t *testing.T) {
+	jobs := jobstatus.NewStore(time.Minute)
+	jobs.Published("job-1", "req-1", "pika")
+	jobs.Published("job-2", "req-1", "chu")
+	jobs.Record(libs.JobEvent{JobID: "job-2", Status: libs.JobFailed, Attempt: 1, Error: "boom"})
+
+	h := NewJobsHandler(jobs)
+	app := fiber.New()
+	app.Get("/jobs", h.List)
+	app.Get("/jobs/:id", h.Get)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/jobs/job-2", nil))
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	var job jobstatus.Job
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if job.Status != libs.JobFailed || job.Error != "boom" || job.Name != "chu" {
+		t.Fatalf("job = %+v", job)
+	}
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/jobs?status=pending&correlation_id=req-1", nil))
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	var list []jobstatus.Job
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(list) != 1 || list[0].ID != "job-1" {
+		t.Fatalf("pending jobs = %+v", list)
+	}
+
+	for path, status := range map[string]int{
+		"/jobs/missing":     fiber.StatusNotFound,
+		"/jobs?status=lost": fiber.StatusBadRequest,
+		"/jobs?limit=0":     fiber.StatusBadRequest,
+	} {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if resp.StatusCode != status {
+			t.Errorf("%s: status %d, want %d", path, resp.StatusCode, status)
+		}
+	}
+}
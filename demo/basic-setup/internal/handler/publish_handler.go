@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/basic-setup/internal/jobstatus"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/gofiber/fiber/v2"
+	"github.com/xyproto/randomstring"
+)
+
+// PublishConfig bounds what a single publish request may do.
+type PublishConfig struct {
+	// MaxJobs is the most jobs one request may publish.
+	MaxJobs int
+	// BatchSize is how many jobs are published before waiting for their
+	// confirms, which bounds the unconfirmed messages in flight.
+	BatchSize int
+}
+
+type PublishHandler struct {
+	publisher libs.AsyncPublisher
+	queue     string
+	jobs      *jobstatus.Store
+	config    PublishConfig
+}
+
+func NewPublishHandler(publisher libs.AsyncPublisher, queue string, jobs *jobstatus.Store, config PublishConfig) *PublishHandler {
+	if config.MaxJobs <= 0 {
+		config.MaxJobs = 10000
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 500
+	}
+
+	return &PublishHandler{
+		publisher: publisher,
+		queue:     queue,
+		jobs:      jobs,
+		config:    config,
+	}
+}
+
+// maxReportErrors caps the distinct errors listed in a publishReport.
+const maxReportErrors = 5
+
+type publishReport struct {
+	CorrelationID string        `json:"correlation_id"`
+	Requested     int           `json:"requested"`
+	Accepted      int           `json:"accepted"`
+	Failed        int           `json:"failed"`
+	Elapsed       libs.Duration `json:"elapsed"`
+	Errors        []string      `json:"errors,omitempty"`
+	// Done is false on the progress lines of a streamed report.
+	Done bool `json:"done"`
+}
+
+func (r *publishReport) addError(err error) {
+	msg := err.Error()
+	if len(r.Errors) < maxReportErrors && !slices.Contains(r.Errors, msg) {
+		r.Errors = append(r.Errors, msg)
+	}
+}
+
+// Publish publishes :number jobs with random names in batches and reports
+// how many the broker confirmed as JSON, with status 502 if any job was not.
+// ?priority= (0-9) and ?deadline= (a duration such as 30s) apply to every
+// job; the jobs share one correlation id. With ?progress=true the response
+// is streamed as one JSON report per line after every batch, the last one
+// with done set. Confirmed jobs are tracked as pending.
+func (h *PublishHandler) Publish(c *fiber.Ctx) error {
+	number, err := strconv.Atoi(c.Params("number"))
+	if err != nil || number <= 0 || number > h.config.MaxJobs {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("number must be between 1 and %d", h.config.MaxJobs))
+	}
+
+	priority, err := strconv.ParseUint(c.Query("priority", "0"), 10, 8)
+	if err != nil || priority > jobMaxPriority {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("priority must be between 0 and %d", jobMaxPriority))
+	}
+
+	var deadline time.Time
+	if v := c.Query("deadline"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return c.Status(fiber.StatusBadRequest).SendString("invalid deadline")
+		}
+		deadline = time.Now().Add(d)
+	}
+
+	correlationID := libs.NewMessageID()
+	next := func(int) Job {
+		return Job{
+			ID:            libs.NewMessageID(),
+			CorrelationID: correlationID,
+			Name:          randomstring.HumanFriendlyString(7),
+			Priority:      uint8(priority),
+			Deadline:      deadline,
+		}
+	}
+
+	if c.QueryBool("progress") {
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+		// the writer runs after the handler returned, so it cannot use the
+		// request context; a client that went away fails the next flush
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			enc := json.NewEncoder(w)
+			write := func(r publishReport) bool {
+				return enc.Encode(r) == nil && w.Flush() == nil
+			}
+			write(h.publish(context.Background(), correlationID, number, next, write))
+		})
+		return nil
+	}
+
+	report := h.publish(c.Context(), correlationID, number, next, nil)
+	if report.Failed > 0 {
+		c.Status(fiber.StatusBadGateway)
+	}
+	return c.JSON(report)
+}
+
+type submitReport struct {
+	publishReport
+	// JobIDs lists the ids of the submitted jobs in request order.
+	JobIDs []string `json:"job_ids"`
+}
+
+// Submit enqueues the jobs of a JSON array body, such as
+// [{"name":"pikachu","priority":5,"seed":42,"options":{"dna_length":500}}],
+// so tools can submit deterministic workloads. Every job is validated before
+// any is published; jobs without an id get one and all share a new
+// correlation id. The response is the report of Publish plus the job ids.
+func (h *PublishHandler) Submit(c *fiber.Ctx) error {
+	var jobs []Job
+	dec := json.NewDecoder(bytes.NewReader(c.Body()))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&jobs); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("body must be a JSON array of jobs: %v", err))
+	}
+	if len(jobs) == 0 || len(jobs) > h.config.MaxJobs {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("submit between 1 and %d jobs", h.config.MaxJobs))
+	}
+
+	correlationID := libs.NewMessageID()
+	ids := make([]string, len(jobs))
+	seen := make(map[string]bool, len(jobs))
+	var errs []error
+	for i := range jobs {
+		j := &jobs[i]
+		if err := j.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("job %d: %w", i, err))
+		}
+		if j.CorrelationID != "" || j.ReplyTo != "" {
+			errs = append(errs, fmt.Errorf("job %d: correlation_id and reply_to are set by the server", i))
+		}
+		if j.ID == "" {
+			j.ID = libs.NewMessageID()
+		}
+		if seen[j.ID] {
+			errs = append(errs, fmt.Errorf("job %d: duplicate id %q", i, j.ID))
+		}
+		seen[j.ID] = true
+		j.CorrelationID = correlationID
+		ids[i] = j.ID
+	}
+	if err := errors.Join(errs...); err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	report := h.publish(c.Context(), correlationID, len(jobs), func(i int) Job { return jobs[i] }, nil)
+	if report.Failed > 0 {
+		c.Status(fiber.StatusBadGateway)
+	}
+	return c.JSON(submitReport{publishReport: report, JobIDs: ids})
+}
+
+// publish publishes the jobs next returns for 0 to number-1, BatchSize at a
+// time, and waits for the confirms of a batch before starting the next.
+// progress, if set, is called after every batch but the last and stops the
+// run by returning false. A publish that fails outright, such as on a closed
+// connection, also stops the run; the jobs not published count as failed.
+func (h *PublishHandler) publish(ctx context.Context, correlationID string, number int, next func(i int) Job, progress func(publishReport) bool) publishReport {
+	start := time.Now()
+	report := publishReport{CorrelationID: correlationID, Requested: number}
+
+	batch := make([]Job, 0, h.config.BatchSize)
+	confirms := make([]*libs.Confirmation, 0, h.config.BatchSize)
+	for published := 0; published < number; {
+		batch, confirms = batch[:0], confirms[:0]
+
+		var err error
+		for ; published < number && len(batch) < h.config.BatchSize; published++ {
+			j := next(published)
+			var conf *libs.Confirmation
+			if conf, err = h.publishAsync(ctx, j); err != nil {
+				break
+			}
+			batch = append(batch, j)
+			confirms = append(confirms, conf)
+		}
+
+		for i, conf := range confirms {
+			if err := conf.Wait(ctx); err != nil {
+				report.addError(err)
+				continue
+			}
+			report.Accepted++
+			h.jobs.Published(batch[i].ID, batch[i].CorrelationID, batch[i].Name)
+		}
+		if err != nil {
+			report.addError(err)
+			break
+		}
+
+		if progress != nil && published < number {
+			report.Failed = published - report.Accepted
+			report.Elapsed = libs.Duration(time.Since(start))
+			if !progress(report) {
+				break
+			}
+		}
+	}
+
+	report.Failed = number - report.Accepted
+	report.Elapsed = libs.Duration(time.Since(start))
+	report.Done = true
+	return report
+}
+
+func (h *PublishHandler) publishAsync(ctx context.Context, j Job) (*libs.Confirmation, error) {
+	msg, err := j.Publishing()
+	if err != nil {
+		return nil, fmt.Errorf("marshal job: %w", err)
+	}
+	return h.publisher.PublishAsync(ctx, "", h.queue, true, msg)
+}
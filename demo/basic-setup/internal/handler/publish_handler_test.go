@@ -0,0 +1,216 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/basic-setup/internal/jobstatus"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/gofiber/fiber/v2"
+	"github.com/streadway/amqp"
+)
+
+func TestPublishHandlerPublishesJobs(t *testing.T) {
+	broker := libs.NewMemoryBroker(0)
+	defer broker.Close()
+	if _, err := broker.QueueDeclareContext(context.Background(), "jobs"); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+
+	jobs := jobstatus.NewStore(time.Minute)
+	app := fiber.New()
+	app.Get("/publish/:number", NewPublishHandler(broker, "jobs", jobs, PublishConfig{}).Publish)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/publish/3", nil))
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+
+	var report publishReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	if report.Requested != 3 || report.Accepted != 3 || report.Failed != 0 || !report.Done {
+		t.Fatalf("report = %+v", report)
+	}
+
+	if n := broker.Len("jobs"); n != 3 {
+		t.Fatalf("queue has %d jobs, want 3", n)
+	}
+	d, _ := broker.Get("jobs")
+	var job Job
+	if err := json.Unmarshal(d.Body, &job); err != nil || job.Name == "" {
+		t.Fatalf("published an invalid job %q: %v", d.Body, err)
+	}
+	if tracked, ok := jobs.Get(job.ID); !ok || tracked.Status != libs.JobPending {
+		t.Errorf("published job tracked as %+v", tracked)
+	}
+	if n := len(jobs.List(jobstatus.Filter{Status: libs.JobPending})); n != 3 {
+		t.Errorf("%d pending jobs tracked, want 3", n)
+	}
+}
+
+func TestPublishHandlerMapsPriorityAndDeadline(t *testing.T) {
+	broker := libs.NewMemoryBroker(0)
+	defer broker.Close()
+	if _, err := broker.QueueDeclareContext(context.Background(), "jobs"); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+
+	app := fiber.New()
+	app.Get("/publish/:number", NewPublishHandler(broker, "jobs", jobstatus.NewStore(time.Minute), PublishConfig{}).Publish)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/publish/2?priority=7&deadline=1m", nil))
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	var correlationIDs []string
+	for range 2 {
+		d, _ := broker.Get("jobs")
+		var job Job
+		if err := json.Unmarshal(d.Body, &job); err != nil {
+			t.Fatalf("decode job: %v", err)
+		}
+		if d.Priority != 7 || job.Priority != 7 {
+			t.Errorf("priority = %d (message) / %d (job), want 7", d.Priority, job.Priority)
+		}
+		if d.MessageId == "" || d.MessageId != job.ID {
+			t.Errorf("message id %q does not match job id %q", d.MessageId, job.ID)
+		}
+		if d.Expiration == "" || job.Deadline.IsZero() {
+			t.Errorf("deadline not set: expiration %q, deadline %v", d.Expiration, job.Deadline)
+		}
+		correlationIDs = append(correlationIDs, d.CorrelationId)
+	}
+	if correlationIDs[0] == "" || correlationIDs[0] != correlationIDs[1] {
+		t.Errorf("jobs of one request have correlation ids %v", correlationIDs)
+	}
+
+	for _, query := range []string{"priority=10", "deadline=-1s", "deadline=soon"} {
+		resp, err := app.Test(httptest.NewRequest("GET", "/publish/1?"+query, nil))
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", query, resp.StatusCode, fiber.StatusBadRequest)
+		}
+	}
+}
+
+func TestPublishHandlerReportsUnroutableJobs(t *testing.T) {
+	broker := libs.NewMemoryBroker(0)
+	defer broker.Close()
+
+	app := fiber.New()
+	app.Get("/publish/:number", NewPublishHandler(broker, "missing", jobstatus.NewStore(time.Minute), PublishConfig{}).Publish)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/publish/2", nil))
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusBadGateway {
+		t.Fatalf("status %d, want %d", resp.StatusCode, fiber.StatusBadGateway)
+	}
+}
+
+// flakyPublisher fails every publish after the first ok ones.
+type flakyPublisher struct {
+	*libs.MemoryBroker
+	ok        int64
+	published atomic.Int64
+}
+
+func (p *flakyPublisher) PublishAsync(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) (*libs.Confirmation, error) {
+	if p.published.Add(1) > p.ok {
+		return nil, errors.New("connection lost")
+	}
+	return p.MemoryBroker.PublishAsync(ctx, exchange, key, mandatory, msg)
+}
+
+func TestPublishHandlerReportsPartialFailures(t *testing.T) {
+	broker := libs.NewMemoryBroker(0)
+	defer broker.Close()
+	if _, err := broker.QueueDeclareContext(context.Background(), "jobs"); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+
+	publisher := &flakyPublisher{MemoryBroker: broker, ok: 3}
+	app := fiber.New()
+	app.Get("/publish/:number", NewPublishHandler(publisher, "jobs", jobstatus.NewStore(time.Minute), PublishConfig{BatchSize: 2}).Publish)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/publish/5", nil))
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusBadGateway {
+		t.Fatalf("status %d, want %d", resp.StatusCode, fiber.StatusBadGateway)
+	}
+
+	var report publishReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	if report.Accepted != 3 || report.Failed != 2 || len(report.Errors) != 1 {
+		t.Fatalf("report = %+v, want 3 accepted and 2 failed", report)
+	}
+	if n := broker.Len("jobs"); n != 3 {
+		t.Fatalf("queue has %d jobs, want 3", n)
+	}
+}
+
+func TestPublishHandlerStreamsProgress(t *testing.T) {
+	broker := libs.NewMemoryBroker(0)
+	defer broker.Close()
+	if _, err := broker.QueueDeclareContext(context.Background(), "jobs"); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+
+	app := fiber.New()
+	app.Get("/publish/:number", NewPublishHandler(broker, "jobs", jobstatus.NewStore(time.Minute), PublishConfig{MaxJobs: 10, BatchSize: 2}).Publish)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/publish/5?progress=true", nil))
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+
+	var accepted []int
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		var report publishReport
+		if err := json.Unmarshal([]byte(line), &report); err != nil {
+			t.Fatalf("decode %q: %v", line, err)
+		}
+		if report.Done != (len(accepted) == 2) {
+			t.Errorf("line %d has done = %v", len(accepted), report.Done)
+		}
+		accepted = append(accepted, report.Accepted)
+	}
+	if len(accepted) != 3 || accepted[0] != 2 || accepted[1] != 4 || accepted[2] != 5 {
+		t.Fatalf("accepted counts %v, want [2 4 5]", accepted)
+	}
+
+	for _, number := range []string{"0", "11", "many"} {
+		resp, err := app.Test(httptest.NewRequest("GET", "/publish/"+number, nil))
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("/publish/%s: status %d, want %d", number, resp.StatusCode, fiber.StatusBadRequest)
+		}
+	}
+}
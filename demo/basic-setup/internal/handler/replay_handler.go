@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/gofiber/fiber/v2"
+)
+
+// ReplayHandler reads generated pokemon back from a stream, starting at any
+// offset, without removing them for other readers.
+type ReplayHandler struct {
+	consumer libs.Consumer
+	stream   string
+}
+
+func NewReplayHandler(consumer libs.Consumer, stream string) *ReplayHandler {
+	return &ReplayHandler{
+		consumer: consumer,
+		stream:   stream,
+	}
+}
+
+type replayedMessage struct {
+	Offset  int64           `json:"offset"`
+	Message json.RawMessage `json:"message"`
+}
+
+// Limits of a replay request.
+const (
+	maxReplayLimit = 1000
+	maxReplayWait  = 30 * time.Second
+)
+
+// Replay returns up to ?limit= messages (default 10, at most 1000) starting
+// at ?offset= (default "first", see libs.ParseStreamOffset). It waits at most
+// ?wait= (default 1s, at most 30s) for messages that have not been published
+// yet.
+func (h *ReplayHandler) Replay(c *fiber.Ctx) error {
+	offset, err := libs.ParseStreamOffset(c.Query("offset", "first"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	limit, err := strconv.Atoi(c.Query("limit", "10"))
+	if err != nil || limit <= 0 || limit > maxReplayLimit {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("limit must be between 1 and %d", maxReplayLimit))
+	}
+	wait, err := time.ParseDuration(c.Query("wait", "1s"))
+	if err != nil || wait < 0 || wait > maxReplayWait {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("wait must be a duration between 0 and %s", maxReplayWait))
+	}
+
+	ctx := c.Context()
+	tag := fmt.Sprintf("replay-%d", time.Now().UnixNano())
+	msgs, err := h.consumer.ConsumeContext(ctx, h.stream, tag, libs.ConsumeOptions{StreamOffset: offset})
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).SendString(err.Error())
+	}
+	defer h.consumer.CancelContext(ctx, tag)
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	// grows with what the stream returns, not with what the caller asked for
+	replayed := []replayedMessage{}
+	for len(replayed) < limit {
+		select {
+		case m, ok := <-msgs:
+			if !ok {
+				return c.JSON(replayed)
+			}
+			// acks only release the consumer's prefetch, the stream keeps
+			// the message for the next reader
+			m.Ack(false)
+			offset, _ := libs.StreamOffsetOf(m)
+			replayed = append(replayed, replayedMessage{Offset: offset, Message: m.Body})
+		case <-timeout.C:
+			return c.JSON(replayed)
+		}
+	}
+
+	return c.JSON(replayed)
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/gofiber/fiber/v2"
+	"github.com/streadway/amqp"
+)
+
+func TestReplayHandlerReturnsUpToLimit(t *testing.T) {
+	broker := libs.NewMemoryBroker(0)
+	defer broker.Close()
+
+	ctx := context.Background()
+	if _, err := broker.QueueDeclareContext(ctx, "generated"); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+	for i := range 3 {
+		msg := amqp.Publishing{
+			Headers: amqp.Table{libs.HeaderStreamOffset: int64(i)},
+			Body:    []byte(`{"name":"pika"}`),
+		}
+		if err := broker.PublishContext(ctx, "", "generated", true, msg); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	app := fiber.New()
+	app.Get("/generated", NewReplayHandler(broker, "generated").Replay)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/generated?offset=first&limit=2&wait=100ms", nil))
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	var got []replayedMessage
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got) != 2 || got[0].Offset != 0 || got[1].Offset != 1 {
+		t.Fatalf("got %+v, want offsets 0 and 1", got)
+	}
+
+	for _, query := range []string{
+		"offset=sometime",
+		"limit=0",
+		"limit=1001",
+		"limit=9223372036854775807",
+		"wait=-1s",
+		"wait=31s",
+	} {
+		resp, err = app.Test(httptest.NewRequest("GET", "/generated?"+query, nil))
+		if err != nil {
+			t.Fatalf("%s: request: %v", query, err)
+		}
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", query, resp.StatusCode, fiber.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/basic-setup/internal/jobstatus"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/gofiber/fiber/v2"
+)
+
+func newSubmitApp(t *testing.T) (*fiber.App, *libs.MemoryBroker) {
+	t.Helper()
+
+	broker := libs.NewMemoryBroker(0)
+	t.Cleanup(broker.Close)
+	if _, err := broker.QueueDeclareContext(context.Background(), "jobs"); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+
+	app := fiber.New()
+	app.Post("/jobs", NewPublishHandler(broker, "jobs", jobstatus.NewStore(time.Minute), PublishConfig{MaxJobs: 3}).Submit)
+	return app, broker
+}
+
+func postJobs(t *testing.T, app *fiber.App, body string) (int, []byte) {
+	t.Helper()
+
+	req := httptest.NewRequest("POST", "/jobs", strings.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, data
+}
+
+func TestSubmitEnqueuesExplicitJobs(t *testing.T) {
+	app, broker := newSubmitApp(t)
+
+	status, body := postJobs(t, app, `[
+		{"name": "pikachu", "priority": 5, "seed": 42, "options": {"dna_length": 500, "ability_limit": 2}},
+		{"id": "my-job", "name": "eevee"},
+		{"type": "evolve", "name": "charmander", "evolution": {"names": ["charmeleon", "charizard"], "levels": 20}}
+	]`)
+	if status != fiber.StatusOK {
+		t.Fatalf("status %d: %s", status, body)
+	}
+
+	var report submitReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	if report.Accepted != 3 || len(report.JobIDs) != 3 || report.JobIDs[1] != "my-job" {
+		t.Fatalf("report = %+v", report)
+	}
+
+	d, _ := broker.Get("jobs")
+	var job Job
+	if err := json.Unmarshal(d.Body, &job); err != nil {
+		t.Fatalf("decode job: %v", err)
+	}
+	if job.ID != report.JobIDs[0] || job.Name != "pikachu" || d.Priority != 5 {
+		t.Errorf("first job published as %+v with priority %d", job, d.Priority)
+	}
+	if job.Seed == nil || *job.Seed != 42 || job.Options != (JobOptions{DNALength: 500, AbilityLimit: 2}) {
+		t.Errorf("seed and options lost: %+v", job)
+	}
+	if job.CorrelationID != report.CorrelationID {
+		t.Errorf("job correlation id %q, report %q", job.CorrelationID, report.CorrelationID)
+	}
+
+	status, body = postJobs(t, app, `[
+		{"type": "battle", "name": "match", "battle": {"rounds": 100}, "fighters": [{"name": "pikachu", "types": ["electric"], "stats": {"base_lv": 100, "attack": 255}}, {"name": "eevee", "dna": "ATCGATCG"}]},
+		{"type": "tournament", "name": "cup", "battle": {"rounds": 10}, "tournament": {"format": "bracket", "entrants": [{"name": "pikachu", "types": ["electric"]}, {"name": "eevee", "dna": "ATCGATCG"}, {"name": "onix", "types": ["rock", "ground"]}]}}
+	]`)
+	if status != fiber.StatusOK {
+		t.Fatalf("battle job: status %d: %s", status, body)
+	}
+}
+
+func TestSubmitRejectsInvalidJobs(t *testing.T) {
+	app, broker := newSubmitApp(t)
+
+	for _, body := range []string{
+		`[]`,
+		`{"name": "pikachu"}`,
+		`[{"name": ""}]`,
+		`[{"name": "pikachu", "priority": 10}]`,
+		`[{"name": "pikachu", "options": {"dna_length": -1}}]`,
+		`[{"name": "pikachu", "colour": "yellow"}]`,
+		`[{"name": "pikachu", "reply_to": "elsewhere"}]`,
+		`[{"name": "pikachu", "deadline": "2001-01-01T00:00:00Z"}]`,
+		`[{"id": "a", "name": "pikachu"}, {"id": "a", "name": "eevee"}]`,
+		`[{"name": "a"}, {"name": "b"}, {"name": "c"}, {"name": "d"}]`,
+		`[{"type": "evolve", "name": "charmander"}]`,
+		`[{"type": "evolve", "name": "charmander", "evolution": {"names": ["a", "b", "c", "d"]}}]`,
+		`[{"type": "evolve", "name": "charmander", "evolution": {"names": ["charmeleon"], "mutation_rate": 2}}]`,
+		`[{"name": "charmander", "evolution": {"names": ["charmeleon"]}}]`,
+		`[{"type": "battle", "name": "match", "fighters": [{"name": "pikachu", "types": ["electric"]}]}]`,
+		`[{"type": "battle", "name": "match", "fighters": [{"name": "pikachu"}, {"name": "eevee", "types": ["normal"]}]}]`,
+		`[{"type": "battle", "name": "match", "fighters": [{"name": "pikachu", "types": ["electric"]}, {"name": "eevee", "dna": "ATCG"}], "battle": {"rounds": 10001}}]`,
+		`[{"type": "battle", "name": "match", "fighters": [{"name": "pikachu", "types": ["electric"], "stats": {"defense": 9223372036854775558}}, {"name": "eevee", "types": ["normal"]}]}]`,
+		`[{"type": "battle", "name": "match", "fighters": [{"name": "pikachu", "types": ["electric"], "stats": {"attack": 256}}, {"name": "eevee", "types": ["normal"]}]}]`,
+		`[{"name": "pikachu", "battle": {"rounds": 3}}]`,
+		`[{"type": "tournament", "name": "cup", "tournament": {"entrants": [{"name": "pikachu", "types": ["electric"]}]}}]`,
+		`[{"type": "tournament", "name": "cup", "tournament": {"format": "league", "entrants": [{"name": "pikachu", "types": ["electric"]}, {"name": "eevee", "types": ["normal"]}]}}]`,
+		`[{"type": "tournament", "name": "cup", "tournament": {"entrants": [{"name": "pikachu", "types": ["electric"]}, {"types": ["normal"]}]}}]`,
+		`[{"type": "tournament", "name": "cup", "tournament": {"entrants": [{"name": "pikachu", "types": ["electric"]}, {"name": "eevee", "types": ["normal"], "stats": {"hp": -1}}]}}]`,
+		`[{"type": "battle", "name": "match", "fighters": [{"name": "pikachu", "types": ["electric"]}, {"name": "eevee", "types": ["normal"]}], "tournament": {"format": "bracket"}}]`,
+	} {
+		if status, resp := postJobs(t, app, body); status != fiber.StatusBadRequest {
+			t.Errorf("%s: status %d (%s), want %d", body, status, resp, fiber.StatusBadRequest)
+		}
+	}
+	if n := broker.Len("jobs"); n != 0 {
+		t.Fatalf("%d invalid jobs were published", n)
+	}
+}
@@ -0,0 +1,194 @@
+package jobstatus
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/streadway/amqp"
+)
+
+// Job is the last known state of a job.
+type Job struct {
+	ID            string         `json:"id"`
+	CorrelationID string         `json:"correlation_id,omitempty"`
+	Name          string         `json:"name,omitempty"`
+	Status        libs.JobStatus `json:"status"`
+	Attempts      int            `json:"attempts"`
+	Error         string         `json:"error,omitempty"`
+	// Duration is how long the last attempt ran.
+	Duration    libs.Duration `json:"duration,omitempty"`
+	PublishedAt time.Time     `json:"published_at,omitzero"`
+	StartedAt   time.Time     `json:"started_at,omitzero"`
+	FinishedAt  time.Time     `json:"finished_at,omitzero"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+}
+
+// Filter selects jobs in List. Zero fields match every job.
+type Filter struct {
+	Status        libs.JobStatus
+	CorrelationID string
+	// Limit caps the number of jobs returned.
+	Limit int
+}
+
+func (f Filter) match(j *Job) bool {
+	return (f.Status == "" || j.Status == f.Status) &&
+		(f.CorrelationID == "" || j.CorrelationID == f.CorrelationID)
+}
+
+// Store keeps the state of jobs in memory. Jobs are forgotten once they were
+// not updated for the TTL, whether they finished or not.
+type Store struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu   sync.RWMutex
+	jobs map[string]*Job
+}
+
+func NewStore(ttl time.Duration) *Store {
+	return &Store{
+		ttl:  ttl,
+		now:  time.Now,
+		jobs: map[string]*Job{},
+	}
+}
+
+// Published records a job as pending. Events that arrived first are kept.
+func (s *Store) Published(id, correlationID, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	j := s.job(id)
+	j.CorrelationID = cmp.Or(j.CorrelationID, correlationID)
+	j.Name = name
+	j.PublishedAt = now
+	if j.Status == "" {
+		j.Status = libs.JobPending
+	}
+	j.UpdatedAt = now
+}
+
+// Record applies a lifecycle event. Events reach the store over different
+// channels and may arrive out of order, so an event older than the state it
+// would replace is ignored.
+func (s *Store) Record(e libs.JobEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j := s.job(e.JobID)
+	if e.Attempt < j.Attempts || (e.Attempt == j.Attempts && rank(e.Status) < rank(j.Status)) {
+		return
+	}
+
+	j.CorrelationID = cmp.Or(j.CorrelationID, e.CorrelationID)
+	j.Status = e.Status
+	j.Attempts = e.Attempt
+	j.Error = e.Error
+	j.Duration = e.Duration
+	if e.Status == libs.JobRunning {
+		j.StartedAt = e.At
+	}
+	if e.Status.Terminal() {
+		j.FinishedAt = e.At
+	}
+	j.UpdatedAt = s.now()
+}
+
+// rank orders the statuses of a single attempt.
+func rank(status libs.JobStatus) int {
+	return slices.Index(libs.JobStatuses, status)
+}
+
+func (s *Store) job(id string) *Job {
+	j, ok := s.jobs[id]
+	if !ok || s.expired(j) {
+		j = &Job{ID: id}
+		s.jobs[id] = j
+	}
+	return j
+}
+
+func (s *Store) expired(j *Job) bool {
+	return s.now().Sub(j.UpdatedAt) > s.ttl
+}
+
+func (s *Store) Get(id string) (Job, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	j, ok := s.jobs[id]
+	if !ok || s.expired(j) {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+// List returns the jobs matching f, most recently updated first.
+func (s *Store) List(f Filter) []Job {
+	s.mu.RLock()
+	jobs := []Job{}
+	for _, j := range s.jobs {
+		if f.match(j) && !s.expired(j) {
+			jobs = append(jobs, *j)
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(jobs, func(a, b Job) int {
+		return cmp.Or(b.UpdatedAt.Compare(a.UpdatedAt), cmp.Compare(a.ID, b.ID))
+	})
+	if f.Limit > 0 && len(jobs) > f.Limit {
+		jobs = jobs[:f.Limit]
+	}
+	return jobs
+}
+
+// Evict forgets the jobs past their TTL and returns how many there were.
+func (s *Store) Evict() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for id, j := range s.jobs {
+		if s.expired(j) {
+			delete(s.jobs, id)
+			n++
+		}
+	}
+	return n
+}
+
+// Run evicts expired jobs every interval until ctx is done.
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Evict()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Consume records the events of msgs until the channel is closed. Consume
+// msgs with AutoAck, events are not worth redelivering.
+func (s *Store) Consume(msgs <-chan amqp.Delivery) {
+	for d := range msgs {
+		e, err := libs.ParseJobEvent(d)
+		if err != nil {
+			log.Printf("dropping job event: %v", err)
+			continue
+		}
+		s.Record(e)
+	}
+}
@@ -0,0 +1,104 @@
+package jobstatus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/streadway/amqp"
+)
+
+func newTestStore(ttl time.Duration) (*Store, *time.Time) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := NewStore(ttl)
+	s.now = func() time.Time { return now }
+	return s, &now
+}
+
+func TestStoreFollowsTheLifecycle(t *testing.T) {
+	s, now := newTestStore(time.Hour)
+
+	s.Published("job-1", "req-1", "pika")
+	s.Record(libs.JobEvent{JobID: "job-1", Status: libs.JobRunning, Attempt: 1, At: *now})
+	s.Record(libs.JobEvent{JobID: "job-1", Status: libs.JobRetrying, Attempt: 1, Error: "boom"})
+	// the second attempt finished before its running event arrived
+	s.Record(libs.JobEvent{JobID: "job-1", Status: libs.JobDone, Attempt: 2, Duration: libs.Duration(time.Second), At: *now})
+	s.Record(libs.JobEvent{JobID: "job-1", Status: libs.JobRunning, Attempt: 2, At: *now})
+	s.Record(libs.JobEvent{JobID: "job-1", Status: libs.JobRetrying, Attempt: 1})
+
+	j, ok := s.Get("job-1")
+	if !ok {
+		t.Fatal("job not found")
+	}
+	if j.Status != libs.JobDone || j.Attempts != 2 || j.Error != "" || j.Duration != libs.Duration(time.Second) {
+		t.Fatalf("job = %+v, want done after 2 attempts", j)
+	}
+	if j.CorrelationID != "req-1" || j.Name != "pika" || j.FinishedAt.IsZero() {
+		t.Fatalf("job lost its details: %+v", j)
+	}
+}
+
+func TestStoreKeepsEventsThatArriveBeforePublish(t *testing.T) {
+	s, _ := newTestStore(time.Hour)
+
+	s.Record(libs.JobEvent{JobID: "job-1", CorrelationID: "req-1", Status: libs.JobRunning, Attempt: 1})
+	s.Published("job-1", "req-1", "pika")
+
+	if j, _ := s.Get("job-1"); j.Status != libs.JobRunning || j.PublishedAt.IsZero() {
+		t.Fatalf("job = %+v, want running with a publish time", j)
+	}
+}
+
+func TestStoreListFiltersAndExpires(t *testing.T) {
+	s, now := newTestStore(time.Minute)
+
+	s.Published("old", "req-1", "a")
+	*now = now.Add(45 * time.Second)
+	s.Published("pending", "req-1", "b")
+	s.Published("other", "req-2", "c")
+	s.Record(libs.JobEvent{JobID: "failed", CorrelationID: "req-1", Status: libs.JobFailed, Attempt: 3})
+
+	if got := s.List(Filter{CorrelationID: "req-1"}); len(got) != 3 {
+		t.Fatalf("req-1 has %d jobs, want 3", len(got))
+	}
+	if got := s.List(Filter{Status: libs.JobFailed}); len(got) != 1 || got[0].ID != "failed" {
+		t.Fatalf("failed jobs = %+v", got)
+	}
+	if got := s.List(Filter{Limit: 2}); len(got) != 2 {
+		t.Fatalf("limit 2 returned %d jobs", len(got))
+	}
+
+	*now = now.Add(30 * time.Second)
+	if _, ok := s.Get("old"); ok {
+		t.Fatal("job past its TTL is still returned")
+	}
+	if got := s.List(Filter{Status: libs.JobPending}); len(got) != 2 {
+		t.Fatalf("%d pending jobs, want 2 after the oldest expired", len(got))
+	}
+	if n := s.Evict(); n != 1 {
+		t.Fatalf("evicted %d jobs, want 1", n)
+	}
+}
+
+func TestStoreConsumeSkipsInvalidEvents(t *testing.T) {
+	s, _ := newTestStore(time.Hour)
+
+	event, err := libs.JobEvent{JobID: "job-1", Status: libs.JobRunning, Attempt: 1}.Publishing()
+	if err != nil {
+		t.Fatalf("publishing: %v", err)
+	}
+	msgs := make(chan amqp.Delivery, 3)
+	msgs <- amqp.Delivery{Body: []byte("not json")}
+	msgs <- amqp.Delivery{Body: []byte(`{"job_id":"job-2","status":"lost"}`)}
+	msgs <- amqp.Delivery{Body: event.Body}
+	close(msgs)
+
+	s.Consume(msgs)
+
+	if j, ok := s.Get("job-1"); !ok || j.Status != libs.JobRunning {
+		t.Fatalf("job-1 = %+v, want running", j)
+	}
+	if _, ok := s.Get("job-2"); ok {
+		t.Fatal("recorded an event with an unknown status")
+	}
+}
@@ -0,0 +1,35 @@
+package libs
+
+import (
+	"context"
+
+	"github.com/streadway/amqp"
+)
+
+// Publisher publishes messages to a broker. PublishContext only returns once
+// the broker accepted the message. It is implemented by *ConfirmPublisher
+// and *MemoryBroker.
+type Publisher interface {
+	PublishContext(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) error
+}
+
+// AsyncPublisher is a Publisher that can also publish without waiting for
+// the broker's verdict.
+type AsyncPublisher interface {
+	Publisher
+	PublishAsync(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) (*Confirmation, error)
+}
+
+// Consumer consumes deliveries from a queue. It is implemented by
+// *RabbitMQClient and *MemoryBroker.
+type Consumer interface {
+	ConsumeContext(ctx context.Context, queue, consumer string, opts ConsumeOptions) (<-chan amqp.Delivery, error)
+	CancelContext(ctx context.Context, consumer string) error
+}
+
+var (
+	_ AsyncPublisher = (*ConfirmPublisher)(nil)
+	_ Consumer       = (*RabbitMQClient)(nil)
+	_ AsyncPublisher = (*MemoryBroker)(nil)
+	_ Consumer       = (*MemoryBroker)(nil)
+)
@@ -0,0 +1,157 @@
+package libs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ChannelPool owns a fixed set of confirm-mode channels used only for
+// publishing, so publishers never share a channel with consumers or with
+// each other. A goroutine leases a channel with Acquire, publishes on it and
+// gives it back with Release. The channels are reopened after a reconnect.
+type ChannelPool struct {
+	client   *RabbitMQClient
+	name     string
+	channels []*confirmChannel
+	free     chan *confirmChannel
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewChannelPoolContext opens size confirm-mode channels on the client's
+// connection. name labels the pool's metrics.
+func (c *RabbitMQClient) NewChannelPoolContext(ctx context.Context, name string, size int) (*ChannelPool, error) {
+	if size <= 0 {
+		size = 1
+	}
+
+	p := &ChannelPool{
+		client: c,
+		name:   name,
+		free:   make(chan *confirmChannel, size),
+	}
+	for range size {
+		cc := newConfirmChannel()
+		p.channels = append(p.channels, cc)
+		p.free <- cc
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	err := withContext(ctx, func() error {
+		return p.open(c.conn)
+	}, func() {
+		// the pool was never handed out
+		p.close()
+	})
+	if err != nil {
+		p.close()
+		return nil, wrapError(opPublish, err)
+	}
+
+	c.pools = append(c.pools, p)
+	channelPoolSize.WithLabelValues(name).Set(float64(size))
+	channelPoolInUse.WithLabelValues(name).Set(0)
+	return p, nil
+}
+
+func (p *ChannelPool) open(conn connection) error {
+	for _, cc := range p.channels {
+		if err := cc.open(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PooledChannel is a publish channel leased from a ChannelPool. It must not
+// be used after Release.
+type PooledChannel struct {
+	pool *ChannelPool
+	cc   *confirmChannel
+}
+
+// Acquire leases a channel, waiting until one is free or ctx is done.
+func (p *ChannelPool) Acquire(ctx context.Context) (*PooledChannel, error) {
+	start := time.Now()
+
+	var cc *confirmChannel
+	select {
+	case cc = <-p.free:
+		channelPoolWaitSeconds.WithLabelValues(p.name).Observe(time.Since(start).Seconds())
+	case <-ctx.Done():
+		channelPoolWaitSeconds.WithLabelValues(p.name).Observe(time.Since(start).Seconds())
+		return nil, wrapError(opPublish, ctx.Err())
+	}
+
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		p.free <- cc
+		return nil, ErrClosed
+	}
+
+	channelPoolInUse.WithLabelValues(p.name).Inc()
+	return &PooledChannel{pool: p, cc: cc}, nil
+}
+
+// PublishAsync publishes msg and returns without waiting for the broker.
+// The returned Confirmation resolves once the broker acked or nacked it.
+func (l *PooledChannel) PublishAsync(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) (*Confirmation, error) {
+	return l.cc.publish(ctx, exchange, key, mandatory, msg)
+}
+
+// Release gives the channel back to the pool. Confirmations of messages
+// published on it keep resolving afterwards.
+func (l *PooledChannel) Release() {
+	channelPoolInUse.WithLabelValues(l.pool.name).Dec()
+	l.pool.free <- l.cc
+}
+
+// Flush waits for every publish made so far on any channel of the pool to
+// be confirmed. It returns the first failed confirmation, or ctx.Err() if
+// ctx ends first.
+func (p *ChannelPool) Flush(ctx context.Context) error {
+	var first error
+	for _, cc := range p.channels {
+		for _, conf := range cc.unconfirmed() {
+			if err := conf.Wait(ctx); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// Close closes every channel of the pool. Call Flush first to wait for
+// outstanding confirmations.
+func (p *ChannelPool) Close() error {
+	p.client.removePool(p)
+	return p.close()
+}
+
+func (p *ChannelPool) close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	var errs []error
+	for _, cc := range p.channels {
+		if err := cc.close(); err != nil {
+			errs = append(errs, fmt.Errorf("close channel: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,251 @@
+package libs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	ErrNacked     = errors.New("rabbitmq: message nacked by broker")
+	ErrUnroutable = errors.New("rabbitmq: message returned as unroutable")
+)
+
+// Confirmation is the broker's verdict on one publish made on a confirm
+// channel.
+type Confirmation struct {
+	DeliveryTag uint64
+	messageID   string
+	done        chan struct{}
+	err         error
+}
+
+// Done is closed once the broker acked or nacked the message, or the
+// channel was lost before it did.
+func (c *Confirmation) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err reports the outcome after Done is closed: nil when the broker accepted
+// the message, ErrNacked, ErrUnroutable for mandatory messages that matched
+// no queue, or an ErrChannel error when the channel died first.
+func (c *Confirmation) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the confirmation arrives or ctx is done.
+func (c *Confirmation) Wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// confirmChannel is a channel in confirm mode that tracks every delivery tag
+// until the broker acks or nacks it. It is reopened after a reconnect;
+// publishes still waiting for a confirmation at that point fail because
+// their fate is unknown. Publishing is not safe for concurrent use, the
+// ChannelPool hands each channel to one goroutine at a time.
+type confirmChannel struct {
+	// mu guards the fields below and is never held during I/O.
+	mu       sync.Mutex
+	ch       channel
+	nextTag  uint64
+	pending  map[uint64]*Confirmation
+	returned map[uint64]string // delivery tag -> reply text of the return
+}
+
+func newConfirmChannel() *confirmChannel {
+	return &confirmChannel{
+		pending:  map[uint64]*Confirmation{},
+		returned: map[uint64]string{},
+	}
+}
+
+// open puts a fresh channel in confirm mode and starts listening for its
+// confirmations and returns.
+func (cc *confirmChannel) open(conn connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return err
+	}
+
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 256))
+	// unbuffered so a return is always handled before the ack that follows it
+	returns := ch.NotifyReturn(make(chan amqp.Return))
+
+	cc.mu.Lock()
+	cc.failPending()
+	cc.ch = ch
+	cc.nextTag = 0
+	cc.mu.Unlock()
+
+	go cc.listen(ch, confirms, returns)
+	return nil
+}
+
+func (cc *confirmChannel) listen(ch channel, confirms chan amqp.Confirmation, returns chan amqp.Return) {
+	for confirms != nil {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			cc.markReturned(r)
+		case c, ok := <-confirms:
+			if !ok {
+				confirms = nil
+				continue
+			}
+			cc.resolve(c)
+		}
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.ch == ch {
+		cc.ch = nil
+		cc.failPending()
+	}
+}
+
+// failPending fails every publish still waiting on the current channel,
+// nothing will confirm them once it is gone. Callers must hold cc.mu.
+func (cc *confirmChannel) failPending() {
+	for tag, conf := range cc.pending {
+		conf.err = &Error{Op: opPublish, Kind: ErrChannel, Err: amqp.ErrClosed}
+		close(conf.done)
+		delete(cc.pending, tag)
+	}
+	clear(cc.returned)
+}
+
+func (cc *confirmChannel) markReturned(r amqp.Return) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	// returns carry no delivery tag, so match the oldest pending publish
+	// with the same message id
+	var match uint64
+	for tag, conf := range cc.pending {
+		if _, seen := cc.returned[tag]; conf.messageID == r.MessageId && !seen && (match == 0 || tag < match) {
+			match = tag
+		}
+	}
+	if match != 0 {
+		cc.returned[match] = r.ReplyText
+	}
+}
+
+func (cc *confirmChannel) resolve(c amqp.Confirmation) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	conf, ok := cc.pending[c.DeliveryTag]
+	if !ok {
+		return
+	}
+
+	if reply, returned := cc.returned[c.DeliveryTag]; returned {
+		conf.err = fmt.Errorf("%w: %s", ErrUnroutable, reply)
+	} else if !c.Ack {
+		conf.err = ErrNacked
+	}
+	close(conf.done)
+	delete(cc.pending, c.DeliveryTag)
+	delete(cc.returned, c.DeliveryTag)
+}
+
+func (cc *confirmChannel) publish(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) (*Confirmation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(opPublish, err)
+	}
+
+	if mandatory && msg.MessageId == "" {
+		msg.MessageId = NewMessageID()
+	}
+
+	cc.mu.Lock()
+	ch := cc.ch
+	if ch == nil {
+		cc.mu.Unlock()
+		return nil, &Error{Op: opPublish, Kind: ErrChannel, Err: amqp.ErrClosed}
+	}
+	cc.nextTag++
+	conf := &Confirmation{
+		DeliveryTag: cc.nextTag,
+		messageID:   msg.MessageId,
+		done:        make(chan struct{}),
+	}
+	cc.pending[conf.DeliveryTag] = conf
+	cc.mu.Unlock()
+
+	if err := ch.Publish(exchange, key, mandatory, false, msg); err != nil {
+		cc.mu.Lock()
+		if cc.pending[conf.DeliveryTag] == conf {
+			delete(cc.pending, conf.DeliveryTag)
+		}
+		// the broker never numbers a publish that failed before it was
+		// sent, like one with invalid headers, so give the tag back for the
+		// next publish to match its confirmation. Publishes on the channel
+		// do not overlap, so the tag is still the last one handed out
+		// unless the channel was reopened meanwhile.
+		if cc.ch == ch && cc.nextTag == conf.DeliveryTag {
+			cc.nextTag--
+		}
+		cc.mu.Unlock()
+		return nil, wrapError(opPublish, err)
+	}
+
+	return conf, nil
+}
+
+// unconfirmed returns the publishes still waiting for the broker.
+func (cc *confirmChannel) unconfirmed() []*Confirmation {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	pending := make([]*Confirmation, 0, len(cc.pending))
+	for _, conf := range cc.pending {
+		pending = append(pending, conf)
+	}
+	return pending
+}
+
+func (cc *confirmChannel) close() error {
+	cc.mu.Lock()
+	ch := cc.ch
+	cc.mu.Unlock()
+
+	if ch == nil {
+		return nil
+	}
+	return ch.Close()
+}
+
+// NewMessageID returns a random 128-bit hex id for MessageId or
+// CorrelationId.
+func NewMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
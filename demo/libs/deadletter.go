@@ -0,0 +1,118 @@
+package libs
+
+import (
+	"context"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers set on messages that are retried or dead-lettered by a consumer.
+const (
+	HeaderAttempts      = "x-attempts"
+	HeaderFailureReason = "x-failure-reason"
+	HeaderOriginalQueue = "x-original-queue"
+	HeaderFailedAt      = "x-failed-at"
+)
+
+// DeadLetter names the dead-letter exchange and queue of a work queue.
+// Failed messages are published to Exchange with RoutingKey and end up in
+// Queue, where they can be inspected and replayed.
+type DeadLetter struct {
+	Exchange   string
+	Queue      string
+	RoutingKey string
+}
+
+func DeadLetterFor(queue string) DeadLetter {
+	return DeadLetter{
+		Exchange:   queue + ".dlx",
+		Queue:      queue + ".dlq",
+		RoutingKey: queue,
+	}
+}
+
+// DeclareDeadLetterContext declares the dead-letter exchange and queue for
+// queue and binds them together. Like every declaration it is replayed after
+// a reconnect.
+func (c *RabbitMQClient) DeclareDeadLetterContext(ctx context.Context, queue string) (DeadLetter, error) {
+	dl := DeadLetterFor(queue)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return DeadLetter{}, ErrClosed
+	}
+
+	err := c.declare(ctx, func(ch channel) error {
+		if err := ch.ExchangeDeclare(dl.Exchange, amqp.ExchangeDirect, true, false, false, false, nil); err != nil {
+			return err
+		}
+		if _, err := declareQueue(ch, dl.Queue, nil); err != nil {
+			return err
+		}
+		return ch.QueueBind(dl.Queue, dl.RoutingKey, dl.Exchange, false, nil)
+	})
+	if err != nil {
+		return DeadLetter{}, err
+	}
+
+	return dl, nil
+}
+
+// Attempts returns how many times the message has already been processed
+// according to HeaderAttempts. Messages that were never retried, or carry a
+// negative count, report 0.
+func Attempts(d amqp.Delivery) int {
+	var attempts int
+	switch v := d.Headers[HeaderAttempts].(type) {
+	case int:
+		attempts = v
+	case int16:
+		attempts = int(v)
+	case int32:
+		attempts = int(v)
+	case int64:
+		attempts = int(v)
+	}
+	return max(attempts, 0)
+}
+
+// Republish copies a delivery into a new publishing, merging headers on top
+// of the original ones.
+func Republish(d amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	merged := amqp.Table{}
+	for k, v := range d.Headers {
+		merged[k] = v
+	}
+	for k, v := range headers {
+		merged[k] = v
+	}
+
+	return amqp.Publishing{
+		Headers:         merged,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
+
+// DeadLetterHeaders describes why and when a message was given up on.
+func DeadLetterHeaders(queue string, attempts int, reason error) amqp.Table {
+	return amqp.Table{
+		HeaderAttempts:      int32(attempts),
+		HeaderFailureReason: reason.Error(),
+		HeaderOriginalQueue: queue,
+		HeaderFailedAt:      time.Now().UTC().Format(time.RFC3339),
+	}
+}
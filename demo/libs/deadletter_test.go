@@ -0,0 +1,81 @@
+package libs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestDeclareDeadLetterSurvivesReconnect(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+	p := newTestPublisher(t, c)
+
+	dl, err := c.DeclareDeadLetterContext(context.Background(), "jobs")
+	if err != nil {
+		t.Fatalf("declare dead letter: %v", err)
+	}
+
+	b.kill()
+	b.restart()
+	waitForReconnect(t, b, c)
+
+	msgs, err := c.ConsumeContext(context.Background(), dl.Queue, "inspector", ConsumeOptions{})
+	if err != nil {
+		t.Fatalf("consume dead letter queue: %v", err)
+	}
+
+	headers := DeadLetterHeaders("jobs", 3, errors.New("boom"))
+	if err := p.PublishContext(context.Background(), dl.Exchange, dl.RoutingKey, true, amqp.Publishing{Headers: headers, Body: []byte("job")}); err != nil {
+		t.Fatalf("publish to dead letter exchange: %v", err)
+	}
+
+	select {
+	case m := <-msgs:
+		if m.Headers[HeaderFailureReason] != "boom" || Attempts(m) != 3 {
+			t.Fatalf("unexpected dead letter headers: %v", m.Headers)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("dead-lettered message not routed to the dead letter queue")
+	}
+}
+
+func TestRepublishKeepsPropertiesAndMergesHeaders(t *testing.T) {
+	d := amqp.Delivery{
+		Headers:       amqp.Table{"trace": "abc", HeaderAttempts: int32(1)},
+		ContentType:   "application/json",
+		CorrelationId: "corr",
+		Body:          []byte(`{"name":"pika"}`),
+	}
+
+	p := Republish(d, amqp.Table{HeaderAttempts: int32(2)})
+
+	if p.Headers["trace"] != "abc" || p.Headers[HeaderAttempts] != int32(2) {
+		t.Fatalf("unexpected headers: %v", p.Headers)
+	}
+	if d.Headers[HeaderAttempts] != int32(1) {
+		t.Fatal("original delivery headers were modified")
+	}
+	if p.CorrelationId != "corr" || string(p.Body) != string(d.Body) {
+		t.Fatalf("properties not copied: %+v", p)
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	for value, want := range map[any]int{
+		nil:        0,
+		int32(3):   3,
+		int64(2):   2,
+		"3":        0,
+		int32(-1):  0,
+		int64(-50): 0,
+	} {
+		d := amqp.Delivery{Headers: amqp.Table{HeaderAttempts: value}}
+		if got := Attempts(d); got != want {
+			t.Errorf("Attempts(%v) = %d, want %d", value, got, want)
+		}
+	}
+}
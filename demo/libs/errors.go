@@ -0,0 +1,75 @@
+package libs
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	ErrDial            = errors.New("rabbitmq: dial failed")
+	ErrAuth            = errors.New("rabbitmq: authentication failed")
+	ErrChannel         = errors.New("rabbitmq: channel exception")
+	ErrDeclareConflict = errors.New("rabbitmq: declaration conflict")
+	ErrClosed          = errors.New("rabbitmq: client closed")
+)
+
+// Error is returned by every error-returning RabbitMQClient method. errors.Is
+// matches both the sentinel in Kind and the underlying cause, so callers can
+// check for ErrAuth as well as for *amqp.Error or context.DeadlineExceeded.
+type Error struct {
+	Op   string
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %s: %v", e.Kind, e.Op, e.Err)
+}
+
+func (e *Error) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+const (
+	opDial    = "dial"
+	opQos     = "qos"
+	opDeclare = "declare"
+	opConsume = "consume"
+	opPublish = "publish"
+)
+
+func wrapError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+
+	return &Error{Op: op, Kind: classify(op, err), Err: err}
+}
+
+func classify(op string, err error) error {
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) {
+		if op == opDial {
+			return ErrDial
+		}
+		return ErrChannel
+	}
+
+	switch {
+	case amqpErr.Code == amqp.AccessRefused:
+		return ErrAuth
+	case amqpErr.Code == amqp.PreconditionFailed && op == opDeclare:
+		return ErrDeclareConflict
+	case op == opDial:
+		return ErrDial
+	default:
+		return ErrChannel
+	}
+}
@@ -0,0 +1,86 @@
+package libs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestWrapErrorClassifies(t *testing.T) {
+	tests := []struct {
+		name string
+		op   string
+		err  error
+		want error
+	}{
+		{"refused connection", opDial, &net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrDial},
+		{"bad credentials", opDial, amqp.ErrCredentials, ErrAuth},
+		{"vhost access refused", opDeclare, &amqp.Error{Code: amqp.AccessRefused}, ErrAuth},
+		{"declare with different arguments", opDeclare, &amqp.Error{Code: amqp.PreconditionFailed}, ErrDeclareConflict},
+		{"precondition outside declare", opConsume, &amqp.Error{Code: amqp.PreconditionFailed}, ErrChannel},
+		{"closed channel", opPublish, amqp.ErrClosed, ErrChannel},
+		{"server closed during dial", opDial, &amqp.Error{Code: amqp.ConnectionForced}, ErrDial},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := wrapError(tt.op, tt.err)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want kind %v", err, tt.want)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("cause %v not reachable from %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestDialReturnsErrorInsteadOfPanicking(t *testing.T) {
+	b := newFakeBroker()
+	b.kill()
+
+	c := newRabbitMQClient("amqp://fake", 10, b.dial)
+	err := c.connect(context.Background())
+	if !errors.Is(err, ErrDial) {
+		t.Fatalf("got %v, want ErrDial", err)
+	}
+
+	var e *Error
+	if !errors.As(err, &e) || e.Op != opDial {
+		t.Fatalf("got %#v, want *Error for op %q", err, opDial)
+	}
+}
+
+func TestClosedClientReturnsErrClosed(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+	c.Close()
+
+	ctx := context.Background()
+	if _, err := c.QueueDeclareContext(ctx, "jobs"); !errors.Is(err, ErrClosed) {
+		t.Errorf("QueueDeclareContext: got %v, want ErrClosed", err)
+	}
+	if _, err := c.ConsumeContext(ctx, "jobs", "worker", ConsumeOptions{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("ConsumeContext: got %v, want ErrClosed", err)
+	}
+	if _, err := c.NewChannelPoolContext(ctx, "test", 1); !errors.Is(err, ErrClosed) {
+		t.Errorf("NewChannelPoolContext: got %v, want ErrClosed", err)
+	}
+}
+
+func TestPublishContextHonorsCancellation(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+	p := newTestPublisher(t, c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := p.PublishContext(ctx, "", "jobs", false, amqp.Publishing{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
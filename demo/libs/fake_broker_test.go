@@ -0,0 +1,455 @@
+package libs
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeBroker is a local stand-in for RabbitMQ. It can be killed, which drops
+// every open connection and refuses new dials, and restarted again. Queued
+// messages survive a restart as if the queues were durable.
+type fakeBroker struct {
+	mu       sync.Mutex
+	down     bool
+	dials    int
+	conns    []*fakeConn
+	queues   map[string]chan amqp.Delivery
+	bindings map[string]map[string]string // exchange -> routing key -> queue
+	declared []string
+	settings map[string]fakeDeclaration // queue or exchange -> how it was declared
+	qos      []int
+	consumes []amqp.Table // arguments of every Consume call
+
+	// nack makes the broker nack every publish on confirm channels,
+	// holdConfirms makes it never confirm them at all.
+	nack         bool
+	holdConfirms bool
+
+	// slow, if set, holds every queue declaration and consume until it is
+	// closed.
+	slow chan struct{}
+	// dialing, if set, holds every dial until it is closed.
+	dialing chan struct{}
+}
+
+// wait holds a call while the broker is slow.
+func (b *fakeBroker) wait() {
+	b.mu.Lock()
+	slow := b.slow
+	b.mu.Unlock()
+
+	if slow != nil {
+		<-slow
+	}
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		queues:   map[string]chan amqp.Delivery{},
+		bindings: map[string]map[string]string{},
+		settings: map[string]fakeDeclaration{},
+	}
+}
+
+// fakeDeclaration is what RabbitMQ compares when a queue or exchange is
+// declared again.
+type fakeDeclaration struct {
+	kind    string
+	durable bool
+	args    amqp.Table
+}
+
+// redeclare records d for name and fails like RabbitMQ when name was
+// declared before with different settings. Callers must hold b.mu.
+func (b *fakeBroker) redeclare(name string, d fakeDeclaration) error {
+	if prev, ok := b.settings[name]; ok && !reflect.DeepEqual(prev, d) {
+		return &amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - inequivalent arg for '" + name + "'"}
+	}
+	b.settings[name] = d
+	return nil
+}
+
+func (b *fakeBroker) dial(ctx context.Context, url string) (connection, error) {
+	b.mu.Lock()
+	dialing := b.dialing
+	b.mu.Unlock()
+	if dialing != nil {
+		<-dialing
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.dials++
+	if b.down {
+		return nil, errors.New("fake broker: connection refused")
+	}
+
+	conn := &fakeConn{broker: b}
+	b.conns = append(b.conns, conn)
+	return conn, nil
+}
+
+func (b *fakeBroker) kill() {
+	b.mu.Lock()
+	b.down = true
+	conns := b.conns
+	b.conns = nil
+	b.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.shutdown(&amqp.Error{Code: amqp.ConnectionForced, Reason: "broker shutdown", Server: true})
+	}
+}
+
+func (b *fakeBroker) restart() {
+	b.mu.Lock()
+	b.down = false
+	b.mu.Unlock()
+}
+
+func (b *fakeBroker) liveConns() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.conns)
+}
+
+func (b *fakeBroker) dialCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dials
+}
+
+func (b *fakeBroker) route(exchange, key string) chan amqp.Delivery {
+	if exchange == "" {
+		return b.queue(key)
+	}
+
+	b.mu.Lock()
+	name, ok := b.bindings[exchange][key]
+	b.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return b.queue(name)
+}
+
+func (b *fakeBroker) queue(name string) chan amqp.Delivery {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		q = make(chan amqp.Delivery, 100)
+		b.queues[name] = q
+	}
+	return q
+}
+
+type fakeConn struct {
+	broker *fakeBroker
+
+	mu       sync.Mutex
+	closed   bool
+	notify   []chan *amqp.Error
+	channels []*fakeChannel
+}
+
+func (c *fakeConn) Channel() (channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	ch := &fakeChannel{conn: c, closing: make(chan struct{})}
+	c.channels = append(c.channels, ch)
+	return ch, nil
+}
+
+func (c *fakeConn) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.notify = append(c.notify, receiver)
+	return receiver
+}
+
+func (c *fakeConn) Close() error {
+	c.shutdown(nil)
+	return nil
+}
+
+func (c *fakeConn) shutdown(reason *amqp.Error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	notify, channels := c.notify, c.channels
+	c.mu.Unlock()
+
+	for _, ch := range channels {
+		ch.shutdown(reason)
+	}
+	for _, n := range notify {
+		if reason != nil {
+			n <- reason
+		}
+		close(n)
+	}
+}
+
+type fakeChannel struct {
+	conn *fakeConn
+
+	mu        sync.Mutex
+	closed    bool
+	closing   chan struct{}
+	notify    []chan *amqp.Error
+	consumers map[string]chan struct{}
+	confirm   bool
+	tag       uint64
+	confirms  []chan amqp.Confirmation
+	returns   []chan amqp.Return
+}
+
+func (ch *fakeChannel) Confirm(noWait bool) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.confirm = true
+	return nil
+}
+
+func (ch *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+func (ch *fakeChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.returns = append(ch.returns, c)
+	return c
+}
+
+func (ch *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.qos = append(b.qos, prefetchCount)
+	return nil
+}
+
+func (ch *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.conn.broker
+	b.wait()
+	b.queue(name)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.redeclare(name, fakeDeclaration{kind: "queue", durable: durable, args: args}); err != nil {
+		return amqp.Queue{}, err
+	}
+	b.declared = append(b.declared, name)
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.redeclare(name, fakeDeclaration{kind: kind, durable: durable, args: args}); err != nil {
+		return err
+	}
+	if _, ok := b.bindings[name]; !ok {
+		b.bindings[name] = map[string]string{}
+	}
+	b.declared = append(b.declared, name)
+	return nil
+}
+
+func (ch *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bindings, ok := b.bindings[exchange]
+	if !ok {
+		return &amqp.Error{Code: amqp.NotFound, Reason: "no exchange " + exchange}
+	}
+	bindings[key] = name
+	return nil
+}
+
+func (ch *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	if ch.isClosed() {
+		return nil, amqp.ErrClosed
+	}
+
+	b := ch.conn.broker
+	b.wait()
+	b.mu.Lock()
+	b.consumes = append(b.consumes, args)
+	b.mu.Unlock()
+
+	q := b.queue(queue)
+	out := make(chan amqp.Delivery)
+	cancelled := make(chan struct{})
+
+	ch.mu.Lock()
+	if ch.consumers == nil {
+		ch.consumers = map[string]chan struct{}{}
+	}
+	ch.consumers[consumer] = cancelled
+	ch.mu.Unlock()
+
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case d := <-q:
+				select {
+				case out <- d:
+				case <-ch.closing:
+					q <- d
+					return
+				case <-cancelled:
+					q <- d
+					return
+				}
+			case <-ch.closing:
+				return
+			case <-cancelled:
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (ch *fakeChannel) Cancel(consumer string, noWait bool) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if cancelled, ok := ch.consumers[consumer]; ok {
+		close(cancelled)
+		delete(ch.consumers, consumer)
+	}
+	return nil
+}
+
+// Publish routes the message and, on confirm channels, notifies returns
+// and confirmations in the same order as RabbitMQ: return first, then ack.
+func (ch *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	// like streadway, invalid headers fail before anything is sent
+	if err := msg.Headers.Validate(); err != nil {
+		return err
+	}
+
+	b := ch.conn.broker
+	q := b.route(exchange, key)
+	if q != nil {
+		q <- amqp.Delivery{
+			ContentType: msg.ContentType,
+			Headers:     msg.Headers,
+			MessageId:   msg.MessageId,
+			Exchange:    exchange,
+			RoutingKey:  key,
+			Body:        msg.Body,
+		}
+	}
+
+	if !ch.confirm {
+		return nil
+	}
+
+	ch.tag++
+	if q == nil && mandatory {
+		for _, r := range ch.returns {
+			r <- amqp.Return{ReplyCode: amqp.NoRoute, ReplyText: "NO_ROUTE", Exchange: exchange, RoutingKey: key, MessageId: msg.MessageId}
+		}
+	}
+
+	b.mu.Lock()
+	nack, hold := b.nack, b.holdConfirms
+	b.mu.Unlock()
+
+	if !hold {
+		for _, c := range ch.confirms {
+			c <- amqp.Confirmation{DeliveryTag: ch.tag, Ack: !nack}
+		}
+	}
+	return nil
+}
+
+func (ch *fakeChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		close(receiver)
+		return receiver
+	}
+	ch.notify = append(ch.notify, receiver)
+	return receiver
+}
+
+func (ch *fakeChannel) Close() error {
+	ch.shutdown(nil)
+	return nil
+}
+
+func (ch *fakeChannel) isClosed() bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.closed
+}
+
+func (ch *fakeChannel) shutdown(reason *amqp.Error) {
+	ch.mu.Lock()
+	if ch.closed {
+		ch.mu.Unlock()
+		return
+	}
+	ch.closed = true
+	close(ch.closing)
+	notify := ch.notify
+	for _, c := range ch.confirms {
+		close(c)
+	}
+	for _, r := range ch.returns {
+		close(r)
+	}
+	ch.mu.Unlock()
+
+	for _, n := range notify {
+		if reason != nil {
+			n <- reason
+		}
+		close(n)
+	}
+}
@@ -0,0 +1,88 @@
+package libs
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// JobStatus is where a job is in its lifecycle.
+type JobStatus string
+
+const (
+	// JobPending is a job that was published but not picked up yet.
+	JobPending JobStatus = "pending"
+	// JobRunning is a job a worker is processing.
+	JobRunning JobStatus = "running"
+	// JobRetrying is a job that failed and waits for its next attempt.
+	JobRetrying JobStatus = "retrying"
+	// JobDone is a job that finished successfully.
+	JobDone JobStatus = "done"
+	// JobFailed is a job that was dead-lettered.
+	JobFailed JobStatus = "failed"
+)
+
+// JobStatuses lists every status in lifecycle order.
+var JobStatuses = []JobStatus{JobPending, JobRunning, JobRetrying, JobDone, JobFailed}
+
+func ParseJobStatus(s string) (JobStatus, error) {
+	for _, status := range JobStatuses {
+		if JobStatus(s) == status {
+			return status, nil
+		}
+	}
+	return "", fmt.Errorf("unknown job status %q", s)
+}
+
+// Terminal reports whether no more events follow the status.
+func (s JobStatus) Terminal() bool {
+	return s == JobDone || s == JobFailed
+}
+
+// JobEvent is published to the status exchange whenever a worker starts,
+// finishes, retries or gives up on a job, with the status as routing key.
+type JobEvent struct {
+	JobID         string    `json:"job_id"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	Status        JobStatus `json:"status"`
+	// Attempt counts from 1 and orders events of the same job, which may
+	// arrive out of order over different publish channels.
+	Attempt int    `json:"attempt"`
+	Error   string `json:"error,omitempty"`
+	// Duration is how long the attempt ran, set once it is over.
+	Duration Duration  `json:"duration,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+func (e JobEvent) Publishing() (amqp.Publishing, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+
+	return amqp.Publishing{
+		ContentType:   "application/json",
+		Type:          string(e.Status),
+		MessageId:     e.JobID,
+		CorrelationId: e.CorrelationID,
+		Timestamp:     e.At,
+		Body:          body,
+	}, nil
+}
+
+// ParseJobEvent decodes an event consumed from the status exchange.
+func ParseJobEvent(d amqp.Delivery) (JobEvent, error) {
+	var e JobEvent
+	if err := json.Unmarshal(d.Body, &e); err != nil {
+		return JobEvent{}, fmt.Errorf("decode job event: %w", err)
+	}
+	if e.JobID == "" {
+		return JobEvent{}, fmt.Errorf("job event without job id")
+	}
+	if _, err := ParseJobStatus(string(e.Status)); err != nil {
+		return JobEvent{}, fmt.Errorf("job event %s: %w", e.JobID, err)
+	}
+	return e, nil
+}
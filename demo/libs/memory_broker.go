@@ -0,0 +1,481 @@
+package libs
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// MemoryBroker is an in-process stand-in for RabbitMQ for unit and
+// integration tests. It routes through the default exchange and direct
+// bindings, tracks unacknowledged deliveries per consumer, redelivers nacked
+// and rejected messages with requeue, and stops handing out deliveries to a
+// consumer once prefetch of them are unacknowledged. Queue arguments such as
+// TTLs or dead-letter exchanges are not emulated.
+type MemoryBroker struct {
+	prefetch int
+
+	mu        sync.Mutex
+	changed   *sync.Cond // broadcast whenever a consumer may make progress
+	queues    map[string]*memoryQueue
+	bindings  map[string]map[string]string // exchange -> routing key -> queue
+	consumers []*memoryConsumer
+	published uint64
+	nextTag   uint64
+	closed    bool
+}
+
+type memoryQueue struct {
+	name  string
+	ready []amqp.Delivery
+}
+
+// memoryConsumer is also the amqp.Acknowledger of the deliveries it hands
+// out, so they can be acked after the consumer was cancelled, as with
+// RabbitMQ.
+type memoryConsumer struct {
+	broker  *MemoryBroker
+	queue   *memoryQueue
+	name    string
+	autoAck bool
+	out     chan amqp.Delivery
+
+	// guarded by broker.mu
+	unacked   map[uint64]amqp.Delivery
+	cancelled bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewMemoryBroker returns an empty broker. prefetch limits the unacknowledged
+// deliveries of each consumer like basic.qos; 0 means unlimited.
+func NewMemoryBroker(prefetch int) *MemoryBroker {
+	b := &MemoryBroker{
+		prefetch: prefetch,
+		queues:   map[string]*memoryQueue{},
+		bindings: map[string]map[string]string{},
+	}
+	b.changed = sync.NewCond(&b.mu)
+	return b
+}
+
+// QueueDeclareContext declares a queue. Declaring an existing queue is a
+// no-op.
+func (b *MemoryBroker) QueueDeclareContext(ctx context.Context, name string) (amqp.Queue, error) {
+	if err := ctx.Err(); err != nil {
+		return amqp.Queue{}, wrapError(opDeclare, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return amqp.Queue{}, ErrClosed
+	}
+
+	q, ok := b.queues[name]
+	if !ok {
+		q = &memoryQueue{name: name}
+		b.queues[name] = q
+	}
+	return amqp.Queue{Name: name, Messages: len(q.ready), Consumers: b.consumerCount(q)}, nil
+}
+
+// QueueBindContext routes messages published to exchange with key to queue.
+// The exchange is created on first use and behaves like a direct exchange.
+func (b *MemoryBroker) QueueBindContext(ctx context.Context, queue, key, exchange string) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(opDeclare, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	if _, ok := b.queues[queue]; !ok {
+		return wrapError(opDeclare, notFound(queue))
+	}
+
+	if _, ok := b.bindings[exchange]; !ok {
+		b.bindings[exchange] = map[string]string{}
+	}
+	b.bindings[exchange][key] = queue
+	return nil
+}
+
+// ApplyTopologyContext declares the queues and bindings of t. Exchanges only
+// exist through their bindings and queue arguments are ignored.
+func (b *MemoryBroker) ApplyTopologyContext(ctx context.Context, t Topology) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
+	for _, q := range t.Queues {
+		if _, err := b.QueueDeclareContext(ctx, q.Name); err != nil {
+			return err
+		}
+	}
+	for _, bind := range t.Bindings {
+		if err := b.QueueBindContext(ctx, bind.Queue, bind.RoutingKey, bind.Exchange); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PublishContext routes msg to its queue. Unroutable mandatory messages fail
+// with ErrUnroutable, other unroutable messages are dropped.
+func (b *MemoryBroker) PublishContext(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) error {
+	conf, err := b.PublishAsync(ctx, exchange, key, mandatory, msg)
+	if err != nil {
+		return err
+	}
+	return conf.Wait(ctx)
+}
+
+// PublishAsync is PublishContext with the outcome reported through an
+// already resolved Confirmation.
+func (b *MemoryBroker) PublishAsync(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) (*Confirmation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(opPublish, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	b.published++
+	conf := &Confirmation{
+		DeliveryTag: b.published,
+		messageID:   msg.MessageId,
+		done:        make(chan struct{}),
+	}
+
+	q := b.route(exchange, key)
+	switch {
+	case q != nil:
+		q.ready = append(q.ready, memoryDelivery(exchange, key, msg))
+		b.changed.Broadcast()
+	case mandatory:
+		conf.err = fmt.Errorf("%w: NO_ROUTE", ErrUnroutable)
+	}
+	close(conf.done)
+
+	return conf, nil
+}
+
+// route returns the queue a message published to exchange with key ends up
+// in, or nil. Callers must hold b.mu.
+func (b *MemoryBroker) route(exchange, key string) *memoryQueue {
+	if exchange != "" {
+		key = b.bindings[exchange][key]
+	}
+	return b.queues[key]
+}
+
+func memoryDelivery(exchange, key string, msg amqp.Publishing) amqp.Delivery {
+	return amqp.Delivery{
+		Headers:         maps.Clone(msg.Headers),
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Exchange:        exchange,
+		RoutingKey:      key,
+		Body:            slices.Clone(msg.Body),
+	}
+}
+
+// ConsumeContext starts a consumer on an existing queue. Its delivery
+// channel is closed by CancelContext or Close.
+func (b *MemoryBroker) ConsumeContext(ctx context.Context, queue, consumer string, opts ConsumeOptions) (<-chan amqp.Delivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(opConsume, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, wrapError(opConsume, notFound(queue))
+	}
+	if b.consumer(consumer) != nil {
+		return nil, wrapError(opConsume, &amqp.Error{Code: amqp.NotAllowed, Reason: fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumer)})
+	}
+
+	cons := &memoryConsumer{
+		broker:  b,
+		queue:   q,
+		name:    consumer,
+		autoAck: opts.AutoAck,
+		out:     make(chan amqp.Delivery),
+		unacked: map[uint64]amqp.Delivery{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	b.consumers = append(b.consumers, cons)
+	go b.dispatch(cons)
+
+	return cons.out, nil
+}
+
+// CancelContext stops the named consumer and closes its delivery channel.
+// Deliveries it already handed out stay unacknowledged until they are
+// settled or the broker is closed.
+func (b *MemoryBroker) CancelContext(ctx context.Context, consumer string) error {
+	b.mu.Lock()
+	cons := b.consumer(consumer)
+	if cons != nil {
+		b.cancel(cons)
+	}
+	b.mu.Unlock()
+
+	if cons == nil {
+		return nil
+	}
+
+	select {
+	case <-cons.done:
+		return nil
+	case <-ctx.Done():
+		return wrapError(opConsume, ctx.Err())
+	}
+}
+
+// consumer returns the active consumer with the given tag. Callers must
+// hold b.mu.
+func (b *MemoryBroker) consumer(name string) *memoryConsumer {
+	for _, cons := range b.consumers {
+		if cons.name == name && !cons.cancelled {
+			return cons
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBroker) consumerCount(q *memoryQueue) int {
+	n := 0
+	for _, cons := range b.consumers {
+		if cons.queue == q && !cons.cancelled {
+			n++
+		}
+	}
+	return n
+}
+
+// cancel stops cons. Callers must hold b.mu.
+func (b *MemoryBroker) cancel(cons *memoryConsumer) {
+	if cons.cancelled {
+		return
+	}
+	cons.cancelled = true
+	close(cons.stop)
+	b.changed.Broadcast()
+}
+
+func (b *MemoryBroker) dispatch(cons *memoryConsumer) {
+	defer close(cons.done)
+	defer close(cons.out)
+
+	for {
+		d, ok := b.next(cons)
+		if !ok {
+			return
+		}
+
+		select {
+		case cons.out <- d:
+		case <-cons.stop:
+			// never reached the application, so it is not a redelivery.
+			// Close may already have requeued it along with the unacked ones.
+			b.mu.Lock()
+			if _, pending := cons.unacked[d.DeliveryTag]; pending || cons.autoAck {
+				delete(cons.unacked, d.DeliveryTag)
+				d.DeliveryTag, d.Acknowledger, d.ConsumerTag = 0, nil, ""
+				cons.queue.ready = append([]amqp.Delivery{d}, cons.queue.ready...)
+			}
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+// next waits until cons may receive another delivery and takes it off the
+// queue. It reports false once cons is cancelled or the broker is closed.
+func (b *MemoryBroker) next(cons *memoryConsumer) (amqp.Delivery, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for {
+		if cons.cancelled || b.closed {
+			return amqp.Delivery{}, false
+		}
+		if len(cons.queue.ready) > 0 && (cons.autoAck || b.prefetch <= 0 || len(cons.unacked) < b.prefetch) {
+			break
+		}
+		b.changed.Wait()
+	}
+
+	d := cons.queue.ready[0]
+	cons.queue.ready = cons.queue.ready[1:]
+
+	b.nextTag++
+	d.DeliveryTag = b.nextTag
+	d.ConsumerTag = cons.name
+	if !cons.autoAck {
+		d.Acknowledger = cons
+		cons.unacked[d.DeliveryTag] = d
+	}
+	return d, true
+}
+
+func (cons *memoryConsumer) Ack(tag uint64, multiple bool) error {
+	return cons.settle(tag, multiple, false)
+}
+
+func (cons *memoryConsumer) Nack(tag uint64, multiple, requeue bool) error {
+	return cons.settle(tag, multiple, requeue)
+}
+
+func (cons *memoryConsumer) Reject(tag uint64, requeue bool) error {
+	return cons.settle(tag, false, requeue)
+}
+
+func (cons *memoryConsumer) settle(tag uint64, multiple, requeue bool) error {
+	b := cons.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return amqp.ErrClosed
+	}
+
+	var tags []uint64
+	for t := range cons.unacked {
+		if t == tag || (multiple && t < tag) {
+			tags = append(tags, t)
+		}
+	}
+	if !slices.Contains(tags, tag) {
+		return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag)}
+	}
+	slices.Sort(tags)
+
+	var requeued []amqp.Delivery
+	for _, t := range tags {
+		d := cons.unacked[t]
+		delete(cons.unacked, t)
+		if requeue {
+			requeued = append(requeued, redelivery(d))
+		}
+	}
+	cons.queue.ready = append(requeued, cons.queue.ready...)
+	b.changed.Broadcast()
+
+	return nil
+}
+
+func redelivery(d amqp.Delivery) amqp.Delivery {
+	d.DeliveryTag, d.Acknowledger, d.ConsumerTag = 0, nil, ""
+	d.Redelivered = true
+	return d
+}
+
+// Get removes the oldest ready message from queue, like basic.get with
+// automatic acknowledgement.
+func (b *MemoryBroker) Get(queue string) (amqp.Delivery, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queue]
+	if !ok || len(q.ready) == 0 {
+		return amqp.Delivery{}, false
+	}
+
+	d := q.ready[0]
+	q.ready = q.ready[1:]
+	return d, true
+}
+
+// Len returns the number of ready messages in queue.
+func (b *MemoryBroker) Len(queue string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if q, ok := b.queues[queue]; ok {
+		return len(q.ready)
+	}
+	return 0
+}
+
+// Unacked returns the number of deliveries from queue that were handed to
+// a consumer and not settled yet.
+func (b *MemoryBroker) Unacked(queue string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for _, cons := range b.consumers {
+		if cons.queue.name == queue {
+			n += len(cons.unacked)
+		}
+	}
+	return n
+}
+
+// Close cancels every consumer and, like a lost connection, puts their
+// unacknowledged deliveries back in the queue marked as redelivered. Queued
+// messages are kept, so tests can inspect them after Close.
+func (b *MemoryBroker) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+
+	consumers := b.consumers
+	for _, cons := range consumers {
+		tags := slices.Sorted(maps.Keys(cons.unacked))
+		requeued := make([]amqp.Delivery, 0, len(tags))
+		for _, t := range tags {
+			requeued = append(requeued, redelivery(cons.unacked[t]))
+		}
+		cons.queue.ready = append(requeued, cons.queue.ready...)
+		clear(cons.unacked)
+		b.cancel(cons)
+	}
+	b.closed = true
+	b.changed.Broadcast()
+	b.mu.Unlock()
+
+	for _, cons := range consumers {
+		<-cons.done
+	}
+}
+
+func notFound(queue string) *amqp.Error {
+	return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", queue)}
+}
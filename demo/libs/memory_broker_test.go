@@ -0,0 +1,175 @@
+package libs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func newTestMemoryBroker(t *testing.T, prefetch int, queues ...string) *MemoryBroker {
+	t.Helper()
+
+	b := NewMemoryBroker(prefetch)
+	for _, q := range queues {
+		if _, err := b.QueueDeclareContext(context.Background(), q); err != nil {
+			t.Fatalf("declare %s: %v", q, err)
+		}
+	}
+	t.Cleanup(b.Close)
+
+	return b
+}
+
+func receiveDelivery(t *testing.T, msgs <-chan amqp.Delivery) amqp.Delivery {
+	t.Helper()
+
+	select {
+	case d, ok := <-msgs:
+		if !ok {
+			t.Fatal("delivery channel closed")
+		}
+		return d
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for delivery")
+	}
+	return amqp.Delivery{}
+}
+
+func noDelivery(t *testing.T, msgs <-chan amqp.Delivery) {
+	t.Helper()
+
+	select {
+	case d := <-msgs:
+		t.Fatalf("unexpected delivery %q", d.Body)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestMemoryBrokerRedeliversNackedMessages(t *testing.T) {
+	// prefetch 1 so "b" is not already on its way while "a" is nacked
+	b := newTestMemoryBroker(t, 1, "jobs")
+	ctx := context.Background()
+
+	msgs, err := b.ConsumeContext(ctx, "jobs", "worker", ConsumeOptions{})
+	if err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	for _, body := range []string{"a", "b"} {
+		if err := b.PublishContext(ctx, "", "jobs", true, amqp.Publishing{Body: []byte(body)}); err != nil {
+			t.Fatalf("publish %s: %v", body, err)
+		}
+	}
+
+	first := receiveDelivery(t, msgs)
+	if first.Redelivered {
+		t.Fatal("first delivery marked as redelivered")
+	}
+	if err := first.Nack(false, true); err != nil {
+		t.Fatalf("nack: %v", err)
+	}
+
+	// requeued messages go back to the head of the queue
+	again := receiveDelivery(t, msgs)
+	if string(again.Body) != "a" || !again.Redelivered {
+		t.Fatalf("got %q (redelivered=%v), want redelivered %q", again.Body, again.Redelivered, "a")
+	}
+	if err := again.Ack(false); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	if err := again.Ack(false); err == nil {
+		t.Fatal("acking the same delivery twice should fail")
+	}
+
+	second := receiveDelivery(t, msgs)
+	if err := second.Reject(false); err != nil {
+		t.Fatalf("reject: %v", err)
+	}
+	if n := b.Len("jobs") + b.Unacked("jobs"); n != 0 {
+		t.Fatalf("%d message(s) left after ack and reject", n)
+	}
+}
+
+func TestMemoryBrokerPrefetchLimitsUnackedDeliveries(t *testing.T) {
+	b := newTestMemoryBroker(t, 2, "jobs")
+	ctx := context.Background()
+
+	for range 3 {
+		if err := b.PublishContext(ctx, "", "jobs", false, amqp.Publishing{}); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	msgs, err := b.ConsumeContext(ctx, "jobs", "worker", ConsumeOptions{})
+	if err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	first := receiveDelivery(t, msgs)
+	receiveDelivery(t, msgs)
+	noDelivery(t, msgs)
+
+	if err := first.Ack(false); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	receiveDelivery(t, msgs)
+}
+
+func TestMemoryBrokerRouting(t *testing.T) {
+	b := newTestMemoryBroker(t, 0, "jobs.dlq")
+	ctx := context.Background()
+
+	if err := b.QueueBindContext(ctx, "jobs.dlq", "jobs", "jobs.dlx"); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+
+	if err := b.PublishContext(ctx, "jobs.dlx", "jobs", true, amqp.Publishing{Body: []byte("dead")}); err != nil {
+		t.Fatalf("publish through binding: %v", err)
+	}
+	if d, ok := b.Get("jobs.dlq"); !ok || string(d.Body) != "dead" {
+		t.Fatalf("got %q (%v), want %q in jobs.dlq", d.Body, ok, "dead")
+	}
+
+	if err := b.PublishContext(ctx, "", "missing", true, amqp.Publishing{}); !errors.Is(err, ErrUnroutable) {
+		t.Fatalf("unroutable mandatory publish: got %v, want ErrUnroutable", err)
+	}
+	if err := b.PublishContext(ctx, "", "missing", false, amqp.Publishing{}); err != nil {
+		t.Fatalf("unroutable non-mandatory publish: %v", err)
+	}
+
+	if _, err := b.ConsumeContext(ctx, "missing", "worker", ConsumeOptions{}); !errors.Is(err, ErrChannel) {
+		t.Fatalf("consume from missing queue: got %v, want ErrChannel", err)
+	}
+}
+
+func TestMemoryBrokerCloseRequeuesUnacked(t *testing.T) {
+	b := NewMemoryBroker(0)
+	ctx := context.Background()
+
+	if _, err := b.QueueDeclareContext(ctx, "jobs"); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+	msgs, err := b.ConsumeContext(ctx, "jobs", "worker", ConsumeOptions{})
+	if err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if err := b.PublishContext(ctx, "", "jobs", false, amqp.Publishing{Body: []byte("job")}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	d := receiveDelivery(t, msgs)
+
+	b.Close()
+
+	if _, ok := <-msgs; ok {
+		t.Fatal("expected delivery channel to be closed")
+	}
+	if err := d.Ack(false); err == nil {
+		t.Fatal("ack after Close should fail")
+	}
+	if got, ok := b.Get("jobs"); !ok || !got.Redelivered {
+		t.Fatalf("unacked delivery not requeued as redelivered: %+v", got)
+	}
+}
@@ -0,0 +1,34 @@
+package libs
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	channelPoolSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rabbitmq_channel_pool_size",
+			Help: "Publish channels in the pool.",
+		},
+		[]string{"pool"},
+	)
+
+	channelPoolInUse = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "rabbitmq_channel_pool_in_use",
+			Help: "Publish channels currently leased from the pool.",
+		},
+		[]string{"pool"},
+	)
+
+	channelPoolWaitSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "rabbitmq_channel_pool_wait_seconds",
+			Help:    "Time spent waiting to lease a publish channel.",
+			Buckets: []float64{.00001, .0001, .001, .005, .01, .05, .1, .5, 1, 5},
+		},
+		[]string{"pool"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(channelPoolSize, channelPoolInUse, channelPoolWaitSeconds)
+}
@@ -0,0 +1,59 @@
+package libs
+
+import (
+	"context"
+
+	"github.com/streadway/amqp"
+)
+
+// ConfirmPublisher publishes with publisher confirms on channels leased from
+// a ChannelPool, one lease per publish, so it is safe for concurrent use.
+// Mandatory messages that cannot be routed fail with ErrUnroutable.
+type ConfirmPublisher struct {
+	pool *ChannelPool
+}
+
+func NewConfirmPublisher(pool *ChannelPool) *ConfirmPublisher {
+	return &ConfirmPublisher{pool: pool}
+}
+
+// NewConfirmPublisherContext opens a channel pool of size channels and
+// returns a publisher on top of it.
+func (c *RabbitMQClient) NewConfirmPublisherContext(ctx context.Context, name string, size int) (*ConfirmPublisher, error) {
+	pool, err := c.NewChannelPoolContext(ctx, name, size)
+	if err != nil {
+		return nil, err
+	}
+	return NewConfirmPublisher(pool), nil
+}
+
+// PublishAsync publishes msg and returns without waiting for the broker.
+// The returned Confirmation resolves once the broker acked or nacked it.
+func (p *ConfirmPublisher) PublishAsync(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) (*Confirmation, error) {
+	lease, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer lease.Release()
+
+	return lease.PublishAsync(ctx, exchange, key, mandatory, msg)
+}
+
+// PublishContext publishes msg and waits until the broker confirmed it.
+func (p *ConfirmPublisher) PublishContext(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) error {
+	conf, err := p.PublishAsync(ctx, exchange, key, mandatory, msg)
+	if err != nil {
+		return err
+	}
+	return conf.Wait(ctx)
+}
+
+// Flush waits for every publish made so far to be confirmed.
+func (p *ConfirmPublisher) Flush(ctx context.Context) error {
+	return p.pool.Flush(ctx)
+}
+
+// Close closes the underlying channel pool.
+func (p *ConfirmPublisher) Close() error {
+	return p.pool.Close()
+}
@@ -0,0 +1,221 @@
+package libs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func newTestPublisher(t *testing.T, c *RabbitMQClient) *ConfirmPublisher {
+	t.Helper()
+
+	p, err := c.NewConfirmPublisherContext(context.Background(), "test", 2)
+	if err != nil {
+		t.Fatalf("new confirm publisher: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	return p
+}
+
+func TestConfirmPublisherOutcomes(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+	p := newTestPublisher(t, c)
+	ctx := context.Background()
+
+	if _, err := c.QueueDeclareContext(ctx, "jobs"); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+
+	if err := p.PublishContext(ctx, "", "jobs", true, amqp.Publishing{Body: []byte("ok")}); err != nil {
+		t.Fatalf("routable publish: %v", err)
+	}
+
+	err := p.PublishContext(ctx, "missing-exchange", "jobs", true, amqp.Publishing{Body: []byte("lost")})
+	if !errors.Is(err, ErrUnroutable) {
+		t.Fatalf("unroutable mandatory publish: got %v, want ErrUnroutable", err)
+	}
+
+	if err := p.PublishContext(ctx, "missing-exchange", "jobs", false, amqp.Publishing{}); err != nil {
+		t.Fatalf("unroutable non-mandatory publish should be acked, got %v", err)
+	}
+
+	b.mu.Lock()
+	b.nack = true
+	b.mu.Unlock()
+
+	if err := p.PublishContext(ctx, "", "jobs", false, amqp.Publishing{}); !errors.Is(err, ErrNacked) {
+		t.Fatalf("nacked publish: got %v, want ErrNacked", err)
+	}
+}
+
+func TestConfirmPublisherKeepsTagsAfterAFailedPublish(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// a single channel, so both publishes go through it
+	p, err := c.NewConfirmPublisherContext(ctx, "test", 1)
+	if err != nil {
+		t.Fatalf("new confirm publisher: %v", err)
+	}
+	defer p.Close()
+
+	if _, err := c.QueueDeclareContext(ctx, "jobs"); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+
+	// an uint is not a valid header value, so nothing is sent
+	invalid := amqp.Publishing{Headers: amqp.Table{"attempt": uint(1)}}
+	if err := p.PublishContext(ctx, "", "jobs", true, invalid); err == nil {
+		t.Fatal("published invalid headers")
+	}
+
+	// the next publish gets the confirmation of its own tag
+	if err := p.PublishContext(ctx, "", "jobs", true, amqp.Publishing{Body: []byte("ok")}); err != nil {
+		t.Fatalf("publish after a failed one: %v", err)
+	}
+}
+
+func TestConfirmPublisherAsyncAndFlush(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+	ctx := context.Background()
+
+	// a single channel so delivery tags are sequential across publishes
+	pool, err := c.NewChannelPoolContext(ctx, "test", 1)
+	if err != nil {
+		t.Fatalf("new channel pool: %v", err)
+	}
+	p := NewConfirmPublisher(pool)
+	defer p.Close()
+
+	var confs []*Confirmation
+	for range 10 {
+		conf, err := p.PublishAsync(ctx, "", "jobs", false, amqp.Publishing{})
+		if err != nil {
+			t.Fatalf("publish async: %v", err)
+		}
+		confs = append(confs, conf)
+	}
+
+	if err := p.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	for i, conf := range confs {
+		if conf.DeliveryTag != uint64(i+1) {
+			t.Errorf("confirmation %d has delivery tag %d", i, conf.DeliveryTag)
+		}
+		select {
+		case <-conf.Done():
+		default:
+			t.Errorf("confirmation %d not done after Flush", i)
+		}
+	}
+}
+
+func TestConfirmPublisherFailsPendingAndRecoversOnReconnect(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+	p := newTestPublisher(t, c)
+	ctx := context.Background()
+
+	b.mu.Lock()
+	b.holdConfirms = true
+	b.mu.Unlock()
+
+	conf, err := p.PublishAsync(ctx, "", "jobs", false, amqp.Publishing{})
+	if err != nil {
+		t.Fatalf("publish async: %v", err)
+	}
+
+	b.kill()
+	if err := conf.Wait(ctx); !errors.Is(err, ErrChannel) {
+		t.Fatalf("pending confirmation after broker loss: got %v, want ErrChannel", err)
+	}
+
+	b.mu.Lock()
+	b.holdConfirms = false
+	b.mu.Unlock()
+	b.restart()
+	waitForReconnect(t, b, c)
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if err := p.PublishContext(ctx, "", "jobs", false, amqp.Publishing{}); err != nil {
+		t.Fatalf("publish after reconnect: %v", err)
+	}
+}
+
+func TestChannelPoolLeasesChannelsExclusively(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+
+	pool, err := c.NewChannelPoolContext(context.Background(), "test", 2)
+	if err != nil {
+		t.Fatalf("new channel pool: %v", err)
+	}
+	defer pool.Close()
+
+	first, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire first: %v", err)
+	}
+	second, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire second: %v", err)
+	}
+	if first.cc == second.cc {
+		t.Fatal("the same channel was leased twice")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire on exhausted pool: got %v, want context.DeadlineExceeded", err)
+	}
+
+	first.Release()
+	third, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	if third.cc != first.cc {
+		t.Fatal("released channel was not handed out again")
+	}
+	third.Release()
+	second.Release()
+}
+
+func TestConfirmPublisherConcurrentPublishes(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+	p := newTestPublisher(t, c)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- p.PublishContext(context.Background(), "", "jobs", false, amqp.Publishing{})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent publish: %v", err)
+		}
+	}
+	if got := len(b.queue("jobs")); got != 50 {
+		t.Fatalf("queue has %d messages, want 50", got)
+	}
+}
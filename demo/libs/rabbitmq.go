@@ -1,77 +1,576 @@
 package libs
 
 import (
+	"context"
 	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/streadway/amqp"
 )
 
+// connection and channel are the subset of *amqp.Connection and
+// *amqp.Channel used by RabbitMQClient, so tests can swap in a fake broker.
+type connection interface {
+	Channel() (channel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+type channel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+type dialer func(ctx context.Context, url string) (connection, error)
+
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func (c amqpConnection) Channel() (channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+const dialTimeout = 30 * time.Second
+
+func dialAMQP(ctx context.Context, url string) (connection, error) {
+	conn, err := amqp.DialConfig(url, amqp.Config{
+		Heartbeat: 10 * time.Second,
+		Locale:    "en_US",
+		Dial: func(network, addr string) (net.Conn, error) {
+			d := net.Dialer{Timeout: dialTimeout}
+			conn, err := d.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			// the handshake has no heartbeat yet, so bound it by the caller's
+			// deadline as well as our own. amqp clears it once the connection opens.
+			deadline := time.Now().Add(dialTimeout)
+			if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+				deadline = d
+			}
+			if err := conn.SetDeadline(deadline); err != nil {
+				conn.Close()
+				return nil, err
+			}
+
+			return conn, nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return amqpConnection{conn}, nil
+}
+
+// backoff computes exponential reconnect delays with equal jitter.
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+}
+
+func (b backoff) duration(attempt int) time.Duration {
+	d := b.max
+	if attempt < 32 {
+		if next := b.initial << attempt; next > 0 && next < b.max {
+			d = next
+		}
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// ConsumeOptions tunes a consumer. The zero value consumes with manual
+// acknowledgements, so every delivery must be acked, nacked or rejected.
+type ConsumeOptions struct {
+	AutoAck bool
+	// StreamOffset must be set to consume a stream and picks where to start.
+	// Streams require manual acknowledgements.
+	StreamOffset StreamOffset
+}
+
+type consumer struct {
+	queue string
+	name  string
+	opts  ConsumeOptions
+	out   chan amqp.Delivery
+
+	// stop is closed by CancelContext; forwarders tracks the goroutines
+	// writing to out so it is only closed once they are gone.
+	stop       chan struct{}
+	forwarders sync.WaitGroup
+
+	// offset is one past the last stream offset forwarded, so a stream
+	// consumer resumes there after a reconnect instead of at StreamOffset.
+	offset atomic.Int64
+}
+
+// arguments returns the consume arguments, resuming streams after the last
+// forwarded delivery.
+func (cons *consumer) arguments() amqp.Table {
+	if cons.opts.StreamOffset.IsZero() {
+		return nil
+	}
+
+	offset := cons.opts.StreamOffset
+	if next := cons.offset.Load(); next > 0 {
+		offset = OffsetAt(next)
+	}
+	return amqp.Table{HeaderStreamOffset: offset.value}
+}
+
+// close waits for the forwarders to exit and closes the output channel.
+func (cons *consumer) close() {
+	cons.forwarders.Wait()
+	close(cons.out)
+}
+
+// declaration is a piece of topology (queue, exchange, binding) that is
+// replayed on every new channel.
+type declaration func(ch channel) error
+
+// RabbitMQClient keeps a connection to RabbitMQ alive. Its own channel is
+// used for declarations and consumers; publishing goes through a ChannelPool.
+// When the broker goes away it reconnects in the background, re-declares the
+// topology declared through it, re-applies Qos, re-attaches consumers so the
+// channels returned by Consume keep delivering and reopens channel pools.
 type RabbitMQClient struct {
-	conn *amqp.Connection
-	ch   *amqp.Channel
+	url           string
+	prefetchCount int
+	dial          dialer
+	backoff       backoff
+
+	// ctx lives until Close and bounds background reconnects.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.RWMutex
+	conn      connection
+	ch        channel
+	topology  []declaration
+	consumers []*consumer
+	pools     []*ChannelPool
+	closed    bool
 }
 
+// Dial connects to RabbitMQ and sets the prefetch count on the channel.
+// Failures are returned as *Error matching ErrDial, ErrAuth or ErrChannel.
+func Dial(ctx context.Context, url string, prefetchCount int) (*RabbitMQClient, error) {
+	c := newRabbitMQClient(url, prefetchCount, dialAMQP)
+	if err := c.connect(ctx); err != nil {
+		c.cancel()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// NewRabbitMQClient is the panicking form of Dial kept for the cmd entrypoints.
 func NewRabbitMQClient(url string, prefetchCount int) *RabbitMQClient {
+	c, err := Dial(context.Background(), url, prefetchCount)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return c
+}
+
+func newRabbitMQClient(url string, prefetchCount int, dial dialer) *RabbitMQClient {
 	if prefetchCount <= 0 {
 		prefetchCount = 100
 	}
 
-	conn, err := amqp.Dial(url)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &RabbitMQClient{
+		url:           url,
+		prefetchCount: prefetchCount,
+		dial:          dial,
+		backoff:       backoff{initial: 500 * time.Millisecond, max: 30 * time.Second},
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
+// connect dials the broker and restores every queue and consumer registered
+// so far. The dial can take long, so it runs without the lock; the restore
+// holds it so callers never observe a half-recovered client.
+func (c *RabbitMQClient) connect(ctx context.Context) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+
+	conn, err := c.dial(ctx, c.url)
 	if err != nil {
-		log.Panic(err)
+		return wrapError(opDial, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Close ran while dialing
+	if c.closed {
+		conn.Close()
+		return ErrClosed
 	}
 
+	ch, err := c.setup(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.conn = conn
+	c.ch = ch
+	go c.watch(conn, ch)
+
+	return nil
+}
+
+func (c *RabbitMQClient) setup(conn connection) (channel, error) {
 	ch, err := conn.Channel()
 	if err != nil {
-		log.Panic(err)
+		return nil, wrapError(opDial, err)
 	}
 
-	ch.Qos(prefetchCount, 0, false)
+	if err := ch.Qos(c.prefetchCount, 0, false); err != nil {
+		return nil, wrapError(opQos, err)
+	}
 
-	return &RabbitMQClient{
-		conn: conn,
-		ch:   ch,
+	for _, declare := range c.topology {
+		if err := declare(ch); err != nil {
+			return nil, wrapError(opDeclare, err)
+		}
+	}
+
+	for _, cons := range c.consumers {
+		msgs, err := consume(ch, cons)
+		if err != nil {
+			return nil, wrapError(opConsume, err)
+		}
+		c.forward(cons, msgs)
+	}
+
+	for _, p := range c.pools {
+		if err := p.open(conn); err != nil {
+			return nil, wrapError(opPublish, err)
+		}
 	}
+
+	return ch, nil
+}
+
+func (c *RabbitMQClient) watch(conn connection, ch channel) {
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	var reason *amqp.Error
+	select {
+	case reason = <-connClosed:
+	case reason = <-chClosed:
+	case <-c.ctx.Done():
+		return
+	}
+
+	if c.isClosed() {
+		return
+	}
+
+	log.Printf("rabbitmq: connection lost: %v, reconnecting ...", reason)
+	conn.Close()
+	c.reconnect()
+}
+
+func (c *RabbitMQClient) reconnect() {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-time.After(c.backoff.duration(attempt)):
+		case <-c.ctx.Done():
+			return
+		}
+
+		if err := c.connect(c.ctx); err != nil {
+			log.Printf("rabbitmq: reconnect attempt %d failed: %v", attempt+1, err)
+			continue
+		}
+
+		log.Printf("rabbitmq: reconnected after %d attempt(s)", attempt+1)
+		return
+	}
+}
+
+// forward copies deliveries from the current channel into the consumer's
+// long-lived output channel until the channel dies or the client is closed.
+func (c *RabbitMQClient) forward(cons *consumer, msgs <-chan amqp.Delivery) {
+	cons.forwarders.Add(1)
+	go func() {
+		defer cons.forwarders.Done()
+		for m := range msgs {
+			select {
+			case cons.out <- m:
+				if offset, ok := StreamOffsetOf(m); ok {
+					cons.offset.Store(offset + 1)
+				}
+			case <-cons.stop:
+				return
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (c *RabbitMQClient) removePool(p *ChannelPool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, candidate := range c.pools {
+		if candidate == p {
+			c.pools = append(c.pools[:i:i], c.pools[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *RabbitMQClient) isClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed
 }
 
 func (c *RabbitMQClient) Close() {
-	c.ch.Close()
-	c.conn.Close()
+	// stops a reconnect first, so Close does not wait for its dial
+	c.cancel()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	// Close closes every consumer, so CancelContext must not find them again
+	conn, ch, consumers := c.conn, c.ch, c.consumers
+	c.consumers = nil
+	c.mu.Unlock()
+
+	if ch != nil {
+		ch.Close()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+
+	for _, cons := range consumers {
+		cons.close()
+	}
 }
 
-func (c *RabbitMQClient) QueueDeclare(name string) amqp.Queue {
-	q, err := c.ch.QueueDeclare(
-		name,
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
+// QueueDeclareContext declares a durable queue without arguments and
+// remembers it so it is declared again after a reconnect. Use
+// ApplyTopologyContext for queues that need arguments.
+func (c *RabbitMQClient) QueueDeclareContext(ctx context.Context, name string) (amqp.Queue, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return amqp.Queue{}, ErrClosed
+	}
 
+	var q amqp.Queue
+	err := c.declare(ctx, func(ch channel) (err error) {
+		q, err = declareQueue(ch, name, nil)
+		return err
+	})
+	return q, err
+}
+
+// declare runs a declaration on the current channel and, if it succeeds,
+// records it for replay after a reconnect. Callers must hold c.mu.
+func (c *RabbitMQClient) declare(ctx context.Context, d declaration) error {
+	ch := c.ch
+	err := withContext(ctx, func() error {
+		return d(ch)
+	}, func() {
+		// the broker has it, so it must be replayed like the others
+		c.mu.Lock()
+		c.topology = append(c.topology, d)
+		c.mu.Unlock()
+	})
+	if err != nil {
+		return wrapError(opDeclare, err)
+	}
+
+	c.topology = append(c.topology, d)
+	return nil
+}
+
+func (c *RabbitMQClient) QueueDeclare(name string) amqp.Queue {
+	q, err := c.QueueDeclareContext(context.Background(), name)
 	if err != nil {
 		log.Panic(err)
 	}
 	return q
 }
 
-func (c *RabbitMQClient) Consume(queue string, consumer string) <-chan amqp.Delivery {
-	msgs, err := c.ch.Consume(
-		queue,
-		consumer,
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
+// ConsumeContext starts a consumer whose delivery channel survives
+// reconnects. The channel is closed by Close. Deliveries received before a
+// reconnect can no longer be acknowledged afterwards; the broker redelivers
+// them instead. Stream consumers resume after the last delivery they
+// forwarded.
+func (c *RabbitMQClient) ConsumeContext(ctx context.Context, queue string, consumerName string, opts ConsumeOptions) (<-chan amqp.Delivery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if consumerName == "" {
+		// the consumer needs a tag we know to be cancelled by
+		consumerName = NewMessageID()
+	}
+
+	cons := &consumer{
+		queue: queue,
+		name:  consumerName,
+		opts:  opts,
+		out:   make(chan amqp.Delivery),
+		stop:  make(chan struct{}),
+	}
+
+	ch := c.ch
+	var msgs <-chan amqp.Delivery
+	err := withContext(ctx, func() (err error) {
+		msgs, err = consume(ch, cons)
+		return err
+	}, func() {
+		// nobody reads its deliveries, so stop the consumer again
+		if err := ch.Cancel(cons.name, false); err != nil {
+			log.Printf("rabbitmq: cancel abandoned consumer %s: %v", cons.name, err)
+		}
+	})
+	if err != nil {
+		return nil, wrapError(opConsume, err)
+	}
+
+	c.consumers = append(c.consumers, cons)
+	c.forward(cons, msgs)
+
+	return cons.out, nil
+}
+
+// CancelContext stops the named consumer: the broker stops sending it
+// deliveries, it is not re-attached after a reconnect and its delivery
+// channel is closed. Deliveries that were prefetched but not yet read from
+// the channel are redelivered by the broker. After Close, which closes every
+// delivery channel itself, it returns ErrClosed.
+func (c *RabbitMQClient) CancelContext(ctx context.Context, consumerName string) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	var cons *consumer
+	for i, candidate := range c.consumers {
+		if candidate.name == consumerName {
+			cons = candidate
+			c.consumers = append(c.consumers[:i:i], c.consumers[i+1:]...)
+			break
+		}
+	}
+	ch := c.ch
+	c.mu.Unlock()
+
+	if cons == nil {
+		return nil
+	}
+
+	err := withContext(ctx, func() error {
+		return ch.Cancel(consumerName, false)
+	}, nil)
+	close(cons.stop)
+	cons.close()
 
+	return wrapError(opConsume, err)
+}
+
+func (c *RabbitMQClient) Consume(queue string, consumerName string) <-chan amqp.Delivery {
+	msgs, err := c.ConsumeContext(context.Background(), queue, consumerName, ConsumeOptions{AutoAck: true})
 	if err != nil {
 		log.Panic(err)
 	}
 	return msgs
 }
 
-func (c *RabbitMQClient) Channel() *amqp.Channel {
-	return c.ch
+// withContext runs a broker call that has no context support of its own and
+// gives up waiting for it once ctx is done. The call itself goes on: if it
+// succeeds after the caller gave up, abandoned, if set, is run to undo or
+// keep track of what the broker did.
+func withContext(ctx context.Context, fn func() error, abandoned func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// unbuffered so exactly one side knows whether the caller got the result
+	errc := make(chan error)
+	go func() {
+		err := fn()
+		select {
+		case errc <- err:
+		case <-ctx.Done():
+			if err == nil && abandoned != nil {
+				abandoned()
+			}
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// declareQueue declares a durable queue so it survives a broker restart.
+func declareQueue(ch channel, name string, args amqp.Table) (amqp.Queue, error) {
+	return ch.QueueDeclare(
+		name,
+		true,
+		false,
+		false,
+		false,
+		args,
+	)
+}
+
+func consume(ch channel, cons *consumer) (<-chan amqp.Delivery, error) {
+	return ch.Consume(
+		cons.queue,
+		cons.name,
+		cons.opts.AutoAck,
+		false,
+		false,
+		false,
+		cons.arguments(),
+	)
 }
@@ -0,0 +1,268 @@
+package libs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func newTestClient(t *testing.T, b *fakeBroker) *RabbitMQClient {
+	t.Helper()
+
+	c := newRabbitMQClient("amqp://fake", 10, b.dial)
+	c.backoff = backoff{initial: 5 * time.Millisecond, max: 20 * time.Millisecond}
+	if err := c.connect(context.Background()); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(c.Close)
+
+	return c
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitForReconnect waits until the client finished restoring itself on a
+// new connection after the broker was restarted.
+func waitForReconnect(t *testing.T, b *fakeBroker, c *RabbitMQClient) {
+	t.Helper()
+
+	waitFor(t, "reconnect", func() bool {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return b.liveConns() == 1 && !c.ch.(*fakeChannel).isClosed()
+	})
+}
+
+func receive(t *testing.T, msgs <-chan amqp.Delivery) string {
+	t.Helper()
+
+	select {
+	case m, ok := <-msgs:
+		if !ok {
+			t.Fatal("delivery channel closed")
+		}
+		return string(m.Body)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for delivery")
+	}
+	return ""
+}
+
+func TestRabbitMQClientRecoversAfterBrokerRestart(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+
+	p := newTestPublisher(t, c)
+
+	c.QueueDeclare("jobs")
+	msgs := c.Consume("jobs", "worker")
+
+	if err := p.PublishContext(context.Background(), "", "jobs", false, amqp.Publishing{Body: []byte("before")}); err != nil {
+		t.Fatalf("publish before restart: %v", err)
+	}
+	if got := receive(t, msgs); got != "before" {
+		t.Fatalf("got %q, want %q", got, "before")
+	}
+
+	b.kill()
+	waitFor(t, "failed redials while broker is down", func() bool { return b.dialCount() >= 3 })
+	b.restart()
+	waitForReconnect(t, b, c)
+
+	if err := p.PublishContext(context.Background(), "", "jobs", false, amqp.Publishing{Body: []byte("after")}); err != nil {
+		t.Fatalf("publish after restart: %v", err)
+	}
+	if got := receive(t, msgs); got != "after" {
+		t.Fatalf("got %q, want %q", got, "after")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.declared) != 2 || b.declared[1] != "jobs" {
+		t.Errorf("queue not re-declared after reconnect: %v", b.declared)
+	}
+	if len(b.qos) != 2 || b.qos[1] != 10 {
+		t.Errorf("qos not re-applied after reconnect: %v", b.qos)
+	}
+}
+
+func TestRabbitMQClientCloseStopsReconnecting(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+	msgs := c.Consume("jobs", "worker")
+
+	b.kill()
+	c.Close()
+
+	if _, ok := <-msgs; ok {
+		t.Fatal("expected delivery channel to be closed")
+	}
+
+	dials := b.dialCount()
+	time.Sleep(50 * time.Millisecond)
+	if b.dialCount() != dials {
+		t.Fatal("client kept dialing after Close")
+	}
+}
+
+func TestRabbitMQClientCloseDoesNotWaitForDial(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+
+	dialing := make(chan struct{})
+	t.Cleanup(func() { close(dialing) })
+	b.mu.Lock()
+	b.dialing = dialing
+	b.mu.Unlock()
+
+	// the reconnect blocks in its dial
+	dials := b.dialCount()
+	b.kill()
+	b.restart()
+	time.Sleep(50 * time.Millisecond)
+	if b.dialCount() != dials {
+		t.Fatal("dial was not held")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close waited for the dial")
+	}
+}
+
+func TestRabbitMQClientCancelAfterClose(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+	msgs := c.Consume("jobs", "worker")
+
+	c.Close()
+	if _, ok := <-msgs; ok {
+		t.Fatal("expected delivery channel to be closed")
+	}
+
+	if err := c.CancelContext(context.Background(), "worker"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("cancel after close: got %v, want ErrClosed", err)
+	}
+}
+
+func TestBackoffDuration(t *testing.T) {
+	b := backoff{initial: 100 * time.Millisecond, max: time.Second}
+
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		for range 20 {
+			got := b.duration(attempt)
+			if got < want/2 || got > want {
+				t.Fatalf("attempt %d: got %v, want within [%v, %v]", attempt, got, want/2, want)
+			}
+		}
+	}
+
+	if got := b.duration(100); got > time.Second {
+		t.Fatalf("large attempt overflowed the cap: %v", got)
+	}
+}
+
+func TestCancelContextStopsConsumerAcrossReconnects(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+
+	p := newTestPublisher(t, c)
+
+	msgs, err := c.ConsumeContext(context.Background(), "jobs", "worker", ConsumeOptions{})
+	if err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	if err := c.CancelContext(context.Background(), "worker"); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	if _, ok := <-msgs; ok {
+		t.Fatal("expected delivery channel to be closed after cancel")
+	}
+
+	b.kill()
+	b.restart()
+	waitForReconnect(t, b, c)
+
+	if err := p.PublishContext(context.Background(), "", "jobs", false, amqp.Publishing{Body: []byte("left")}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if got := len(b.queue("jobs")); got != 1 {
+		t.Fatalf("cancelled consumer was re-attached, queue has %d message(s)", got)
+	}
+}
+
+func TestAbandonedCallsLeaveNoOrphans(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+	p := newTestPublisher(t, c)
+
+	c.mu.RLock()
+	declared := len(c.topology)
+	c.mu.RUnlock()
+
+	slow := make(chan struct{})
+	b.mu.Lock()
+	b.slow = slow
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.ConsumeContext(ctx, "jobs", "worker", ConsumeOptions{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("consume: got %v, want context.DeadlineExceeded", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.QueueDeclareContext(ctx, "late"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("declare: got %v, want context.DeadlineExceeded", err)
+	}
+
+	// the broker gets to both calls after all
+	close(slow)
+	eventually(t, "the late declaration was recorded", func() bool {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return len(c.topology) == declared+1
+	})
+
+	// nobody consumes the message in place of the abandoned consumer
+	if err := p.PublishContext(context.Background(), "", "jobs", false, amqp.Publishing{Body: []byte("left")}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	eventually(t, "the message stayed in the queue", func() bool {
+		return len(b.queue("jobs")) == 1
+	})
+}
+
+// eventually fails the test unless cond holds within 2 seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,134 @@
+package libs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// Reply types set in the Type property of a reply.
+const (
+	// ReplyTypeResult carries the result of a request in the body.
+	ReplyTypeResult = "result"
+	// ReplyTypeError reports a request that failed for good. The reason is
+	// in HeaderFailureReason.
+	ReplyTypeError = "error"
+)
+
+// Replies consumes a reply queue and hands each reply to the caller waiting
+// for its correlation id, for request/reply over RabbitMQ. Publish requests
+// with ReplyTo set to Queue() and a unique CorrelationId.
+type Replies struct {
+	consumer Consumer
+	queue    string
+	tag      string
+
+	mu      sync.Mutex
+	waiting map[string]chan amqp.Delivery
+	done    chan struct{}
+}
+
+// NewReplies starts consuming queue, which should be exclusive to this
+// process. Replies nobody waits for anymore are dropped.
+func NewReplies(ctx context.Context, consumer Consumer, queue string) (*Replies, error) {
+	r := &Replies{
+		consumer: consumer,
+		queue:    queue,
+		tag:      queue + ".consumer",
+		waiting:  map[string]chan amqp.Delivery{},
+		done:     make(chan struct{}),
+	}
+
+	msgs, err := consumer.ConsumeContext(ctx, queue, r.tag, ConsumeOptions{AutoAck: true})
+	if err != nil {
+		return nil, fmt.Errorf("consume replies: %w", err)
+	}
+
+	go r.dispatch(msgs)
+	return r, nil
+}
+
+func (r *Replies) Queue() string {
+	return r.queue
+}
+
+func (r *Replies) dispatch(msgs <-chan amqp.Delivery) {
+	defer close(r.done)
+
+	for d := range msgs {
+		r.mu.Lock()
+		reply, ok := r.waiting[d.CorrelationId]
+		delete(r.waiting, d.CorrelationId)
+		r.mu.Unlock()
+
+		if !ok {
+			log.Printf("rabbitmq: dropping reply %q nobody waits for", d.CorrelationId)
+			continue
+		}
+		reply <- d
+	}
+}
+
+// PendingReply is a reply registered with Expect.
+type PendingReply struct {
+	replies       *Replies
+	correlationID string
+	reply         chan amqp.Delivery
+}
+
+// Expect registers interest in the reply to correlationID. Call it before
+// publishing the request so a fast reply is not dropped, and Cancel the
+// result once done waiting.
+func (r *Replies) Expect(correlationID string) *PendingReply {
+	p := &PendingReply{
+		replies:       r,
+		correlationID: correlationID,
+		reply:         make(chan amqp.Delivery, 1),
+	}
+
+	r.mu.Lock()
+	r.waiting[correlationID] = p.reply
+	r.mu.Unlock()
+
+	return p
+}
+
+// Wait blocks until the reply arrives or ctx is done.
+func (p *PendingReply) Wait(ctx context.Context) (amqp.Delivery, error) {
+	select {
+	case d := <-p.reply:
+		return d, nil
+	case <-p.replies.done:
+		return amqp.Delivery{}, ErrClosed
+	case <-ctx.Done():
+		return amqp.Delivery{}, ctx.Err()
+	}
+}
+
+// Cancel stops waiting for the reply.
+func (p *PendingReply) Cancel() {
+	r := p.replies
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.waiting[p.correlationID] == p.reply {
+		delete(r.waiting, p.correlationID)
+	}
+}
+
+// Close stops consuming replies. Pending Waits return ErrClosed.
+func (r *Replies) Close(ctx context.Context) error {
+	if err := r.consumer.CancelContext(ctx, r.tag); err != nil {
+		return err
+	}
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,71 @@
+package libs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRepliesMatchCorrelationID(t *testing.T) {
+	b := newTestMemoryBroker(t, 0, "replies")
+	ctx := context.Background()
+
+	r, err := NewReplies(ctx, b, "replies")
+	if err != nil {
+		t.Fatalf("replies: %v", err)
+	}
+	defer r.Close(ctx)
+
+	first := r.Expect("req-1")
+	second := r.Expect("req-2")
+	defer first.Cancel()
+	defer second.Cancel()
+
+	// a reply nobody waits for is dropped without blocking the others
+	for _, id := range []string{"stale", "req-2", "req-1"} {
+		if err := b.PublishContext(ctx, "", "replies", true, amqp.Publishing{CorrelationId: id, Body: []byte(id)}); err != nil {
+			t.Fatalf("publish %s: %v", id, err)
+		}
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	for id, p := range map[string]*PendingReply{"req-1": first, "req-2": second} {
+		d, err := p.Wait(waitCtx)
+		if err != nil {
+			t.Fatalf("wait %s: %v", id, err)
+		}
+		if string(d.Body) != id {
+			t.Errorf("%s got reply %q", id, d.Body)
+		}
+	}
+}
+
+func TestRepliesWaitStopsOnContextAndClose(t *testing.T) {
+	b := newTestMemoryBroker(t, 0, "replies")
+	ctx := context.Background()
+
+	r, err := NewReplies(ctx, b, "replies")
+	if err != nil {
+		t.Fatalf("replies: %v", err)
+	}
+
+	p := r.Expect("req-1")
+	defer p.Cancel()
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Wait(timeoutCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if err := r.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if _, err := p.Wait(ctx); !errors.Is(err, ErrClosed) {
+		t.Fatalf("wait after close = %v, want %v", err, ErrClosed)
+	}
+}
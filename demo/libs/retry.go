@@ -0,0 +1,80 @@
+package libs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// RetryTier is a delay queue. Messages published to Queue sit there for
+// Delay and are then dead-lettered back to the work queue.
+type RetryTier struct {
+	Delay time.Duration
+	Queue string
+}
+
+// RetryQueues lists the delay tiers of a work queue, shortest delay first.
+type RetryQueues struct {
+	Queue string
+	Tiers []RetryTier
+}
+
+func RetryQueueName(queue string, delay time.Duration) string {
+	if delay%time.Second == 0 {
+		return fmt.Sprintf("%s.retry.%ds", queue, delay/time.Second)
+	}
+	return fmt.Sprintf("%s.retry.%dms", queue, delay/time.Millisecond)
+}
+
+// TierFor returns the shortest tier that waits at least delay, or the longest
+// tier when delay exceeds all of them. ok is false when there are no tiers.
+func (r RetryQueues) TierFor(delay time.Duration) (tier RetryTier, ok bool) {
+	for _, t := range r.Tiers {
+		tier, ok = t, true
+		if t.Delay >= delay {
+			return tier, ok
+		}
+	}
+	return tier, ok
+}
+
+// DeclareRetryQueuesContext declares one delay queue per entry in delays
+// (which must be sorted ascending). Each uses a per-queue message TTL and
+// dead-letters expired messages to queue through the default exchange.
+func (c *RabbitMQClient) DeclareRetryQueuesContext(ctx context.Context, queue string, delays []time.Duration) (RetryQueues, error) {
+	retry := RetryQueues{Queue: queue}
+	for _, delay := range delays {
+		retry.Tiers = append(retry.Tiers, RetryTier{
+			Delay: delay,
+			Queue: RetryQueueName(queue, delay),
+		})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return RetryQueues{}, ErrClosed
+	}
+
+	err := c.declare(ctx, func(ch channel) error {
+		for _, tier := range retry.Tiers {
+			_, err := declareQueue(ch, tier.Queue, amqp.Table{
+				"x-message-ttl":             int64(tier.Delay / time.Millisecond),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queue,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return RetryQueues{}, err
+	}
+
+	return retry, nil
+}
@@ -0,0 +1,38 @@
+package libs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryQueuesTierFor(t *testing.T) {
+	r := RetryQueues{Queue: "jobs"}
+	for _, d := range []time.Duration{time.Second, 10 * time.Second, time.Minute} {
+		r.Tiers = append(r.Tiers, RetryTier{Delay: d, Queue: RetryQueueName("jobs", d)})
+	}
+
+	tests := []struct {
+		delay time.Duration
+		want  string
+	}{
+		{0, "jobs.retry.1s"},
+		{time.Second, "jobs.retry.1s"},
+		{5 * time.Second, "jobs.retry.10s"},
+		{time.Minute, "jobs.retry.60s"},
+		{time.Hour, "jobs.retry.60s"},
+	}
+
+	for _, tt := range tests {
+		tier, ok := r.TierFor(tt.delay)
+		if !ok || tier.Queue != tt.want {
+			t.Errorf("TierFor(%v) = %q, %v; want %q", tt.delay, tier.Queue, ok, tt.want)
+		}
+	}
+
+	if _, ok := (RetryQueues{}).TierFor(time.Second); ok {
+		t.Error("TierFor on empty RetryQueues reported a tier")
+	}
+	if got := RetryQueueName("jobs", 1500*time.Millisecond); got != "jobs.retry.1500ms" {
+		t.Errorf("RetryQueueName = %q", got)
+	}
+}
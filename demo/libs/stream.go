@@ -0,0 +1,94 @@
+package libs
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// HeaderStreamOffset is the consume argument selecting where a stream
+// consumer starts, and the header carrying each delivery's offset.
+const HeaderStreamOffset = "x-stream-offset"
+
+// StreamOffset selects where a consumer of a stream starts reading. The zero
+// value means the queue is not a stream.
+type StreamOffset struct {
+	value any
+}
+
+var (
+	// OffsetFirst replays the stream from the oldest retained message.
+	OffsetFirst = StreamOffset{value: "first"}
+	// OffsetLast starts at the last chunk written, so recent messages are
+	// replayed too.
+	OffsetLast = StreamOffset{value: "last"}
+	// OffsetNext only delivers messages published after the consumer
+	// started.
+	OffsetNext = StreamOffset{value: "next"}
+)
+
+// OffsetAt starts at a numeric offset, as found in HeaderStreamOffset.
+func OffsetAt(offset int64) StreamOffset {
+	return StreamOffset{value: offset}
+}
+
+// OffsetSince starts at the first message published at or after t.
+func OffsetSince(t time.Time) StreamOffset {
+	return StreamOffset{value: t}
+}
+
+// OffsetAge starts at the messages published during the last d.
+func OffsetAge(d time.Duration) StreamOffset {
+	return StreamOffset{value: fmt.Sprintf("%ds", int64(d/time.Second))}
+}
+
+// ParseStreamOffset reads "first", "last", "next", a numeric offset, an
+// RFC 3339 timestamp or a duration such as "1h" meaning OffsetAge.
+func ParseStreamOffset(s string) (StreamOffset, error) {
+	switch s {
+	case "first":
+		return OffsetFirst, nil
+	case "last":
+		return OffsetLast, nil
+	case "next":
+		return OffsetNext, nil
+	}
+
+	if offset, err := strconv.ParseInt(s, 10, 64); err == nil && offset >= 0 {
+		return OffsetAt(offset), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return OffsetSince(t), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return OffsetAge(d), nil
+	}
+	return StreamOffset{}, fmt.Errorf("invalid stream offset %q", s)
+}
+
+func (o StreamOffset) IsZero() bool {
+	return o.value == nil
+}
+
+func (o StreamOffset) String() string {
+	if t, ok := o.value.(time.Time); ok {
+		return t.Format(time.RFC3339)
+	}
+	return fmt.Sprint(o.value)
+}
+
+// StreamOffsetOf returns the offset of a delivery consumed from a stream.
+func StreamOffsetOf(d amqp.Delivery) (int64, bool) {
+	switch v := d.Headers[HeaderStreamOffset].(type) {
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,79 @@
+package libs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestParseStreamOffset(t *testing.T) {
+	since := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		in   string
+		want StreamOffset
+	}{
+		{"first", OffsetFirst},
+		{"last", OffsetLast},
+		{"next", OffsetNext},
+		{"42", OffsetAt(42)},
+		{"2024-05-01T12:00:00Z", OffsetSince(since)},
+		{"90m", OffsetAge(90 * time.Minute)},
+	}
+	for _, tt := range tests {
+		got, err := ParseStreamOffset(tt.in)
+		if err != nil {
+			t.Errorf("ParseStreamOffset(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseStreamOffset(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "-1", "yesterday", "-5m"} {
+		if _, err := ParseStreamOffset(in); err == nil {
+			t.Errorf("ParseStreamOffset(%q): expected an error", in)
+		}
+	}
+}
+
+func TestStreamConsumerResumesAfterReconnect(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+	p := newTestPublisher(t, c)
+	ctx := context.Background()
+
+	msgs, err := c.ConsumeContext(ctx, "generated", "replay", ConsumeOptions{StreamOffset: OffsetFirst})
+	if err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	for offset := range int64(3) {
+		msg := amqp.Publishing{Headers: amqp.Table{HeaderStreamOffset: offset}}
+		if err := p.PublishContext(ctx, "", "generated", false, msg); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		if got, _ := StreamOffsetOf(receiveDelivery(t, msgs)); got != offset {
+			t.Fatalf("got offset %d, want %d", got, offset)
+		}
+	}
+
+	b.kill()
+	b.restart()
+	waitForReconnect(t, b, c)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.consumes) != 2 {
+		t.Fatalf("consumer attached %d time(s), want 2", len(b.consumes))
+	}
+	if got := b.consumes[0][HeaderStreamOffset]; got != "first" {
+		t.Errorf("first attach at offset %v, want first", got)
+	}
+	if got := b.consumes[1][HeaderStreamOffset]; got != int64(3) {
+		t.Errorf("re-attached at offset %v, want 3", got)
+	}
+}
@@ -0,0 +1,346 @@
+package libs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Topology is the declarative description of the exchanges, queues and
+// bindings a service needs. It is usually loaded from a JSON file with
+// LoadTopology and applied with ApplyTopologyContext.
+type Topology struct {
+	Exchanges []ExchangeSpec `json:"exchanges"`
+	Queues    []QueueSpec    `json:"queues"`
+	Bindings  []BindingSpec  `json:"bindings"`
+}
+
+type ExchangeSpec struct {
+	Name string `json:"name"`
+	// Kind is the exchange type, "direct" when empty.
+	Kind       string         `json:"kind"`
+	Durable    bool           `json:"durable"`
+	AutoDelete bool           `json:"auto_delete"`
+	Internal   bool           `json:"internal"`
+	Args       map[string]any `json:"args"`
+}
+
+// Queue types accepted by QueueSpec.Type.
+const (
+	QueueTypeClassic = "classic"
+	QueueTypeQuorum  = "quorum"
+	QueueTypeStream  = "stream"
+)
+
+type QueueSpec struct {
+	Name       string `json:"name"`
+	Durable    bool   `json:"durable"`
+	AutoDelete bool   `json:"auto_delete"`
+	Exclusive  bool   `json:"exclusive"`
+	// Type sets x-queue-type: QueueTypeClassic (the default),
+	// QueueTypeQuorum or QueueTypeStream.
+	Type string `json:"type"`
+	// MessageTTL sets x-message-ttl, e.g. "60s". Not supported by streams.
+	MessageTTL Duration `json:"message_ttl"`
+	// MaxLength sets x-max-length. Overflow picks what happens once the
+	// queue is full: "drop-head" (the default), "reject-publish" or
+	// "reject-publish-dlx".
+	MaxLength int64  `json:"max_length"`
+	Overflow  string `json:"overflow"`
+	// DeadLetterExchange and DeadLetterRoutingKey set where rejected,
+	// expired and poison messages are dead-lettered to.
+	DeadLetterExchange   string `json:"dead_letter_exchange"`
+	DeadLetterRoutingKey string `json:"dead_letter_routing_key"`
+	// DeliveryLimit sets x-delivery-limit on quorum queues: a message
+	// redelivered more often than this is a poison message and is
+	// dead-lettered, or dropped without a dead-letter exchange.
+	DeliveryLimit int64 `json:"delivery_limit"`
+	// MaxPriority sets x-max-priority on classic queues, so messages with a
+	// higher AMQP priority (up to MaxPriority) are delivered first.
+	MaxPriority uint8 `json:"max_priority"`
+	// MaxAge and MaxLengthBytes set the retention of a stream, e.g. "24h".
+	MaxAge         Duration `json:"max_age"`
+	MaxLengthBytes int64    `json:"max_length_bytes"`
+	// Args holds any other x-arguments and wins over the fields above.
+	Args map[string]any `json:"args"`
+}
+
+type BindingSpec struct {
+	Queue      string         `json:"queue"`
+	Exchange   string         `json:"exchange"`
+	RoutingKey string         `json:"routing_key"`
+	Args       map[string]any `json:"args"`
+}
+
+// Duration is a time.Duration written as a string like "1m30s" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"60s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadTopology reads a topology from a JSON file.
+func LoadTopology(path string) (Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Topology{}, fmt.Errorf("read topology: %w", err)
+	}
+	return ParseTopology(data)
+}
+
+// ParseTopology decodes and validates a JSON topology. Unknown fields are
+// rejected so typos do not silently declare something else.
+func ParseTopology(data []byte) (Topology, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	// keep integers as integers, RabbitMQ rejects x-arguments like
+	// x-max-priority sent as floats
+	dec.UseNumber()
+
+	var t Topology
+	if err := dec.Decode(&t); err != nil {
+		return Topology{}, fmt.Errorf("parse topology: %w", err)
+	}
+	if err := t.Validate(); err != nil {
+		return Topology{}, err
+	}
+	return t, nil
+}
+
+// Validate checks that every item is named and every binding refers to a
+// queue and exchange of the topology. The default exchange cannot be bound.
+func (t Topology) Validate() error {
+	var errs []error
+
+	exchanges := map[string]bool{}
+	for i, e := range t.Exchanges {
+		if e.Name == "" {
+			errs = append(errs, fmt.Errorf("exchange %d has no name", i))
+		}
+		exchanges[e.Name] = true
+	}
+
+	queues := map[string]bool{}
+	for i, q := range t.Queues {
+		if q.Name == "" {
+			errs = append(errs, fmt.Errorf("queue %d has no name", i))
+		}
+		if err := q.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("queue %q: %w", q.Name, err))
+		}
+		queues[q.Name] = true
+	}
+
+	for _, b := range t.Bindings {
+		if !queues[b.Queue] {
+			errs = append(errs, fmt.Errorf("binding %s -> %s: unknown queue", b.Exchange, b.Queue))
+		}
+		if !exchanges[b.Exchange] {
+			errs = append(errs, fmt.Errorf("binding %s -> %s: unknown exchange", b.Exchange, b.Queue))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid topology: %w", err)
+	}
+	return nil
+}
+
+// Queue returns the spec of the named queue.
+func (t Topology) Queue(name string) (QueueSpec, bool) {
+	for _, q := range t.Queues {
+		if q.Name == name {
+			return q, true
+		}
+	}
+	return QueueSpec{}, false
+}
+
+// Exchange returns the spec of the named exchange.
+func (t Topology) Exchange(name string) (ExchangeSpec, bool) {
+	for _, e := range t.Exchanges {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return ExchangeSpec{}, false
+}
+
+func (q QueueSpec) validate() error {
+	var errs []error
+	if q.MessageTTL < 0 || q.MaxLength < 0 || q.DeliveryLimit < 0 || q.MaxAge < 0 || q.MaxLengthBytes < 0 {
+		errs = append(errs, errors.New("limits must not be negative"))
+	}
+
+	switch q.Type {
+	case "", QueueTypeClassic:
+	case QueueTypeQuorum:
+		if !q.Durable || q.Exclusive || q.AutoDelete {
+			errs = append(errs, errors.New("quorum queues must be durable and neither exclusive nor auto-delete"))
+		}
+	case QueueTypeStream:
+		if !q.Durable || q.Exclusive || q.AutoDelete {
+			errs = append(errs, errors.New("streams must be durable and neither exclusive nor auto-delete"))
+		}
+		if q.MessageTTL != 0 || q.Overflow != "" || q.DeadLetterExchange != "" {
+			errs = append(errs, errors.New("streams do not support message_ttl, overflow or dead-lettering, use max_age and max_length_bytes"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown queue type %q", q.Type))
+	}
+
+	if q.DeliveryLimit > 0 && q.Type != QueueTypeQuorum {
+		errs = append(errs, errors.New("delivery_limit requires a quorum queue"))
+	}
+	if q.MaxPriority > 0 && q.Type != "" && q.Type != QueueTypeClassic {
+		errs = append(errs, errors.New("max_priority requires a classic queue"))
+	}
+	if q.MaxAge > 0 && q.Type != QueueTypeStream {
+		errs = append(errs, errors.New("max_age requires a stream"))
+	}
+	return errors.Join(errs...)
+}
+
+func (q QueueSpec) arguments() amqp.Table {
+	args := amqp.Table{}
+	if q.Type != "" {
+		args["x-queue-type"] = q.Type
+	}
+	if q.MessageTTL > 0 {
+		args["x-message-ttl"] = int64(time.Duration(q.MessageTTL) / time.Millisecond)
+	}
+	if q.MaxLength > 0 {
+		args["x-max-length"] = q.MaxLength
+	}
+	if q.Overflow != "" {
+		args["x-overflow"] = q.Overflow
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	if q.DeliveryLimit > 0 {
+		args["x-delivery-limit"] = q.DeliveryLimit
+	}
+	if q.MaxPriority > 0 {
+		args["x-max-priority"] = int64(q.MaxPriority)
+	}
+	if q.MaxAge > 0 {
+		// streams take the age in units of Y, M, D, h, m or s
+		args["x-max-age"] = fmt.Sprintf("%ds", int64(time.Duration(q.MaxAge)/time.Second))
+	}
+	if q.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = q.MaxLengthBytes
+	}
+	for k, v := range table(q.Args) {
+		args[k] = v
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// table converts decoded JSON values into types amqp can encode.
+func table(m map[string]any) amqp.Table {
+	if len(m) == 0 {
+		return nil
+	}
+
+	t := amqp.Table{}
+	for k, v := range m {
+		t[k] = tableValue(v)
+	}
+	return t
+}
+
+func tableValue(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case float64:
+		if v == float64(int64(v)) {
+			return int64(v)
+		}
+		return v
+	case map[string]any:
+		return table(v)
+	case []any:
+		values := make([]any, len(v))
+		for i, item := range v {
+			values[i] = tableValue(item)
+		}
+		return values
+	default:
+		return v
+	}
+}
+
+// ApplyTopologyContext declares every exchange, then every queue, then every
+// binding of t. Declaring is idempotent: items that already exist with the
+// same settings are left alone, items that exist with different settings
+// fail with ErrDeclareConflict. The topology is declared again after a
+// reconnect.
+func (c *RabbitMQClient) ApplyTopologyContext(ctx context.Context, t Topology) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	return c.declare(ctx, func(ch channel) error {
+		for _, e := range t.Exchanges {
+			kind := e.Kind
+			if kind == "" {
+				kind = amqp.ExchangeDirect
+			}
+			if err := ch.ExchangeDeclare(e.Name, kind, e.Durable, e.AutoDelete, e.Internal, false, table(e.Args)); err != nil {
+				return fmt.Errorf("exchange %s: %w", e.Name, err)
+			}
+		}
+
+		for _, q := range t.Queues {
+			if _, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.arguments()); err != nil {
+				return fmt.Errorf("queue %s: %w", q.Name, err)
+			}
+		}
+
+		for _, b := range t.Bindings {
+			if err := ch.QueueBind(b.Queue, b.RoutingKey, b.Exchange, false, table(b.Args)); err != nil {
+				return fmt.Errorf("binding %s -> %s: %w", b.Exchange, b.Queue, err)
+			}
+		}
+		return nil
+	})
+}
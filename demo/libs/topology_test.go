@@ -0,0 +1,170 @@
+package libs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const testTopology = `{
+	"exchanges": [{"name": "events", "kind": "topic", "durable": true}],
+	"queues": [
+		{"name": "jobs", "durable": true, "type": "quorum", "args": {"x-delivery-limit": 5}},
+		{"name": "generated", "durable": true, "message_ttl": "90s", "max_length": 1000}
+	],
+	"bindings": [{"queue": "generated", "exchange": "events", "routing_key": "pokemon.#"}]
+}`
+
+func TestParseTopology(t *testing.T) {
+	topo, err := ParseTopology([]byte(testTopology))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	jobs, _ := topo.Queue("jobs")
+	if got := jobs.arguments(); got["x-queue-type"] != "quorum" || got["x-delivery-limit"] != int64(5) {
+		t.Errorf("jobs arguments = %v", got)
+	}
+
+	generated, _ := topo.Queue("generated")
+	args := generated.arguments()
+	if args["x-message-ttl"] != int64(90000) || args["x-max-length"] != int64(1000) {
+		t.Errorf("generated arguments = %v", args)
+	}
+	if err := args.Validate(); err != nil {
+		t.Errorf("arguments cannot be encoded: %v", err)
+	}
+
+	invalid := map[string]string{
+		"unknown field":         `{"queues": [{"name": "jobs", "durabel": true}]}`,
+		"binding to nowhere":    `{"exchanges": [{"name": "events"}], "bindings": [{"queue": "jobs", "exchange": "events"}]}`,
+		"bad duration":          `{"queues": [{"name": "jobs", "message_ttl": "soon"}]}`,
+		"unnamed queue":         `{"queues": [{"durable": true}]}`,
+		"bind default exchange": `{"queues": [{"name": "jobs"}], "bindings": [{"queue": "jobs", "exchange": ""}]}`,
+	}
+	for name, data := range invalid {
+		if _, err := ParseTopology([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestApplyTopologyIsIdempotentAndReplayed(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+	ctx := context.Background()
+
+	topo, err := ParseTopology([]byte(testTopology))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	for range 2 {
+		if err := c.ApplyTopologyContext(ctx, topo); err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+	}
+
+	b.mu.Lock()
+	jobs := b.settings["jobs"]
+	b.mu.Unlock()
+	if !jobs.durable {
+		t.Error("jobs queue was not declared durable")
+	}
+	if q := b.route("events", "pokemon.#"); q == nil {
+		t.Error("generated queue was not bound to events")
+	}
+
+	b.kill()
+	b.restart()
+	waitForReconnect(t, b, c)
+
+	b.mu.Lock()
+	declared := len(b.declared)
+	b.mu.Unlock()
+	// exchange and two queues, applied twice and replayed twice
+	if declared != 12 {
+		t.Errorf("declared %d items, want 12", declared)
+	}
+
+	topo.Queues[1].MaxLength = 5
+	err = c.ApplyTopologyContext(ctx, topo)
+	if !errors.Is(err, ErrDeclareConflict) {
+		t.Fatalf("redeclare with other settings: got %v, want ErrDeclareConflict", err)
+	}
+}
+
+func TestQueueDeclareIsDurable(t *testing.T) {
+	b := newFakeBroker()
+	c := newTestClient(t, b)
+
+	if _, err := c.QueueDeclareContext(context.Background(), "jobs"); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.settings["jobs"].durable {
+		t.Fatal("jobs queue was not declared durable")
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	d := Duration(90 * time.Second)
+	data, err := d.MarshalJSON()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	var got Duration
+	if err := got.UnmarshalJSON(data); err != nil || got != d {
+		t.Fatalf("round trip of %s: got %v, %v", data, time.Duration(got), err)
+	}
+}
+
+func TestQueueSpecQuorumAndStream(t *testing.T) {
+	quorum := QueueSpec{Name: "jobs", Durable: true, Type: QueueTypeQuorum, DeliveryLimit: 3, DeadLetterExchange: "jobs.dlx"}
+	if err := quorum.validate(); err != nil {
+		t.Fatalf("quorum queue: %v", err)
+	}
+	if args := quorum.arguments(); args["x-delivery-limit"] != int64(3) || args["x-dead-letter-exchange"] != "jobs.dlx" {
+		t.Errorf("quorum arguments = %v", args)
+	}
+
+	stream := QueueSpec{Name: "generated", Durable: true, Type: QueueTypeStream, MaxAge: Duration(24 * time.Hour), MaxLengthBytes: 1 << 30}
+	if err := stream.validate(); err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	if args := stream.arguments(); args["x-max-age"] != "86400s" || args["x-max-length-bytes"] != int64(1<<30) {
+		t.Errorf("stream arguments = %v", args)
+	}
+
+	invalid := map[string]QueueSpec{
+		"transient quorum queue":    {Name: "q", Type: QueueTypeQuorum},
+		"delivery limit on classic": {Name: "q", Durable: true, DeliveryLimit: 3},
+		"stream with message ttl":   {Name: "q", Durable: true, Type: QueueTypeStream, MessageTTL: Duration(time.Minute)},
+		"max age on a quorum queue": {Name: "q", Durable: true, Type: QueueTypeQuorum, MaxAge: Duration(time.Hour)},
+		"unknown type":              {Name: "q", Durable: true, Type: "lazy"},
+	}
+	for name, q := range invalid {
+		if err := q.validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestQueueSpecMaxPriority(t *testing.T) {
+	q := QueueSpec{Name: "jobs", Durable: true, MaxPriority: 9}
+	if err := q.validate(); err != nil {
+		t.Fatalf("priority queue: %v", err)
+	}
+	if got := q.arguments()["x-max-priority"]; got != int64(9) {
+		t.Errorf("x-max-priority = %v, want 9", got)
+	}
+
+	q.Type = QueueTypeStream
+	if err := q.validate(); err == nil {
+		t.Error("max_priority on a stream: expected an error")
+	}
+}
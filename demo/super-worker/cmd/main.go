@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -11,15 +12,19 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"slices"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/dna"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/catalog"
 	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/controller"
 	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/repo"
 	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/usecase"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/xyproto/randomstring"
 )
 
 func main() {
@@ -40,35 +45,145 @@ func main() {
 
 	// ไม่ต้องสนใจสิ่งนี้
 	pokemonServer := simulateHttp()
-	defer pokemonServer.Close()
 
 	config := readConfig()
 
-	rmq := libs.NewRabbitMQClient(config.RabbitMQURL, 1000)
-	defer rmq.Close()
+	// in bounded mode the broker only hands out as many jobs as there are
+	// workers, the rest stay in the queue
+	prefetch := 1000
+	if config.Mode == controller.ModeBounded {
+		prefetch = config.MaxWorkers
+	}
 
-	rmq.QueueDeclare(config.RabbitMQQueue)
-	rmq.QueueDeclare("pokemon_generated")
-	msgs := rmq.Consume(config.RabbitMQQueue, "worker")
+	rmq := libs.NewRabbitMQClient(config.RabbitMQURL, prefetch)
 
-	pokemonRepo := repo.NewPokemon(pokemonServer.URL)
-	pokemonUsecase := usecase.NewPokemonUsecase(pokemonRepo)
-	worker := controller.NewWorker(config.MaxWorkers, pokemonUsecase, rmq.Channel())
+	topology, err := libs.LoadTopology(config.TopologyFile)
+	if err != nil {
+		log.Fatalf("failed to load topology: %v", err)
+	}
+	if _, ok := topology.Queue(config.RabbitMQQueue); !ok {
+		log.Fatalf("queue %s is missing from %s", config.RabbitMQQueue, config.TopologyFile)
+	}
+	if _, ok := topology.Exchange(config.StatusExchange); config.StatusExchange != "" && !ok {
+		log.Fatalf("exchange %s is missing from %s", config.StatusExchange, config.TopologyFile)
+	}
+	if err := rmq.ApplyTopologyContext(context.Background(), topology); err != nil {
+		log.Fatalf("failed to apply topology: %v", err)
+	}
+
+	deadLetter, err := rmq.DeclareDeadLetterContext(context.Background(), config.RabbitMQQueue)
+	if err != nil {
+		log.Fatalf("failed to declare dead letter queue: %v", err)
+	}
+	// a delay queue for every delay of every policy, so none of them is
+	// rounded to another one
+	retryDelays := slices.Clone(config.RetryDelays)
+	for _, policy := range config.RetryPolicies {
+		retryDelays = append(retryDelays, policy.Delays...)
+	}
+	slices.Sort(retryDelays)
+	retryQueues, err := rmq.DeclareRetryQueuesContext(context.Background(), config.RabbitMQQueue, slices.Compact(retryDelays))
+	if err != nil {
+		log.Fatalf("failed to declare retry queues: %v", err)
+	}
+
+	publisher, err := rmq.NewConfirmPublisherContext(context.Background(), "super-worker", config.PublishChannels)
+	if err != nil {
+		log.Fatalf("failed to open publisher: %v", err)
+	}
+
+	// the reports of the matches tournaments fan out come back on a queue
+	// only this process reads
+	matchQueue := "super-worker.matches." + libs.NewMessageID()[:8]
+	instanceTopology := libs.Topology{
+		Queues: []libs.QueueSpec{{Name: matchQueue, Exclusive: true, AutoDelete: true}},
+	}
+	if err := rmq.ApplyTopologyContext(context.Background(), instanceTopology); err != nil {
+		log.Fatalf("failed to declare instance queues: %v", err)
+	}
+	matchReplies, err := libs.NewReplies(context.Background(), rmq, matchQueue)
+	if err != nil {
+		log.Fatalf("failed to consume match replies: %v", err)
+	}
+
+	pokemonRepo := repo.NewPokemon(pokemonServer.URL, 100*time.Millisecond)
+	pokemonUsecase := usecase.NewPokemonUsecase(pokemonRepo, nil, config.DNAGenerator)
+	worker := controller.NewWorker(controller.WorkerConfig{
+		MaxWorkers:  config.MaxWorkers,
+		Mode:        config.Mode,
+		Queue:       config.RabbitMQQueue,
+		DeadLetter:  deadLetter,
+		RetryQueues: retryQueues,
+		DefaultRetryPolicy: controller.RetryPolicy{
+			MaxAttempts: config.MaxAttempts,
+			Delays:      config.RetryDelays,
+		},
+		RetryPolicies:     config.RetryPolicies,
+		StatusExchange:    config.StatusExchange,
+		Replies:           matchReplies,
+		MaxTournaments:    config.MaxTournaments,
+		TournamentTimeout: config.TournamentTimeout,
+	}, pokemonUsecase, publisher)
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 
-	fmt.Println("worker started ...")
+	handle, err := worker.Start(context.Background(), rmq)
+	if err != nil {
+		log.Fatalf("failed to start worker: %v", err)
+	}
 
-	go worker.Start(msgs)
+	fmt.Println("worker started ...")
 
 	<-signalChan
+
+	// stop consuming, let in-flight jobs finish, wait for any outstanding
+	// publisher confirms, then tear down the connection and the simulated
+	// pokemon server in that order
+	log.Printf("shutting down, draining in-flight jobs for up to %v ...", config.DrainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancel()
+
+	// tournaments would wait for matches nobody consumes anymore, without
+	// their replies they fail and are retried by another worker
+	if err := matchReplies.Close(ctx); err != nil {
+		log.Printf("failed to stop consuming match replies: %v", err)
+	}
+	if err := handle.Stop(ctx); err != nil {
+		log.Printf("worker did not drain cleanly: %v", err)
+	}
+	if err := publisher.Flush(ctx); err != nil {
+		log.Printf("failed to flush pending publishes: %v", err)
+	}
+	publisher.Close()
+
+	rmq.Close()
+	pokemonServer.Close()
+	log.Println("worker stopped")
 }
 
 type config struct {
-	MaxWorkers    int
-	RabbitMQURL   string
-	RabbitMQQueue string
+	MaxWorkers   int
+	Mode         controller.Mode
+	DrainTimeout time.Duration
+	// PublishChannels is the size of the publish channel pool.
+	PublishChannels int
+	MaxAttempts     int
+	RetryDelays     []time.Duration
+	RetryPolicies   map[string]controller.RetryPolicy
+	RabbitMQURL     string
+	RabbitMQQueue   string
+	// TopologyFile declares the exchanges, queues and bindings to apply at
+	// startup.
+	TopologyFile string
+	// StatusExchange receives job lifecycle events, "-" disables them.
+	StatusExchange string
+	// MaxTournaments and TournamentTimeout keep the worker's defaults when
+	// zero.
+	MaxTournaments    int
+	TournamentTimeout time.Duration
+	// DNAGenerator selects how the DNA of generated pokemon is built.
+	DNAGenerator dna.Generator
 }
 
 func readConfig() *config {
@@ -77,13 +192,101 @@ func readConfig() *config {
 		log.Fatalf("failed to parse MAX_WORKERS: %v", err)
 	}
 
+	mode, err := controller.ParseMode(os.Getenv("WORKER_MODE"))
+	if err != nil {
+		log.Fatalf("failed to parse WORKER_MODE: %v", err)
+	}
+
+	drainTimeout, err := time.ParseDuration(getEnv("DRAIN_TIMEOUT", "30s"))
+	if err != nil {
+		log.Fatalf("failed to parse DRAIN_TIMEOUT: %v", err)
+	}
+
+	publishChannels := maxWorkers
+	if v := os.Getenv("PUBLISH_CHANNELS"); v != "" {
+		publishChannels, err = strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("failed to parse PUBLISH_CHANNELS: %v", err)
+		}
+	}
+
+	maxAttempts := 5
+	if v := os.Getenv("MAX_ATTEMPTS"); v != "" {
+		maxAttempts, err = strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("failed to parse MAX_ATTEMPTS: %v", err)
+		}
+	}
+
+	retryDelays, err := controller.ParseDelays(getEnv("RETRY_DELAYS", "1s,10s,60s"))
+	if err != nil {
+		log.Fatalf("failed to parse RETRY_DELAYS: %v", err)
+	}
+	slices.Sort(retryDelays)
+
+	// per job type overrides, e.g. RETRY_POLICY_GENERATE=3:1s,10s
+	retryPolicies := map[string]controller.RetryPolicy{}
+	for _, jobType := range controller.JobTypes {
+		key := "RETRY_POLICY_" + strings.ToUpper(jobType)
+		if v := os.Getenv(key); v != "" {
+			retryPolicies[jobType], err = controller.ParseRetryPolicy(v)
+			if err != nil {
+				log.Fatalf("failed to parse %s: %v", key, err)
+			}
+		}
+	}
+
+	var maxTournaments int
+	if v := os.Getenv("MAX_TOURNAMENTS"); v != "" {
+		maxTournaments, err = strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("failed to parse MAX_TOURNAMENTS: %v", err)
+		}
+	}
+
+	var tournamentTimeout time.Duration
+	if v := os.Getenv("TOURNAMENT_TIMEOUT"); v != "" {
+		tournamentTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("failed to parse TOURNAMENT_TIMEOUT: %v", err)
+		}
+	}
+
+	dnaGenerator, err := dna.ParseGenerator(os.Getenv("DNA_GENERATOR"))
+	if err != nil {
+		log.Fatalf("failed to parse DNA_GENERATOR: %v", err)
+	}
+
 	rabbitMQURL := os.Getenv("RABBITMQ_URL")
 	rabbitMQQueue := os.Getenv("RABBITMQ_QUEUE")
+	topologyFile := getEnv("TOPOLOGY_FILE", "topology.json")
+	statusExchange := getEnv("STATUS_EXCHANGE", "pokemon_jobs.status")
+	if statusExchange == "-" {
+		statusExchange = ""
+	}
 	return &config{
-		MaxWorkers:    maxWorkers,
-		RabbitMQURL:   rabbitMQURL,
-		RabbitMQQueue: rabbitMQQueue,
+		MaxWorkers:        maxWorkers,
+		Mode:              mode,
+		DrainTimeout:      drainTimeout,
+		PublishChannels:   publishChannels,
+		MaxAttempts:       maxAttempts,
+		RetryDelays:       retryDelays,
+		RetryPolicies:     retryPolicies,
+		RabbitMQURL:       rabbitMQURL,
+		RabbitMQQueue:     rabbitMQQueue,
+		TopologyFile:      topologyFile,
+		StatusExchange:    statusExchange,
+		MaxTournaments:    maxTournaments,
+		TournamentTimeout: tournamentTimeout,
+		DNAGenerator:      dnaGenerator,
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
+	return fallback
 }
 
 func simulateHttp() *httptest.Server {
@@ -94,9 +297,20 @@ func simulateHttp() *httptest.Server {
 			limitInt = 3
 		}
 
+		// any ability of the catalog with some training, the worker keeps
+		// those its pokemon can learn
+		catalogAbilities := catalog.Default().Abilities()
 		abilities := map[string]int{}
-		for i := 0; i < limitInt; i++ {
-			abilities[randomstring.HumanFriendlyString(7)] = rand.Intn(100)
+		// with a seed the same abilities come back every time
+		if seed, err := strconv.ParseInt(r.URL.Query().Get("seed"), 10, 64); err == nil {
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < limitInt; i++ {
+				abilities[catalogAbilities[rng.Intn(len(catalogAbilities))].Name] = rng.Intn(100)
+			}
+		} else {
+			for i := 0; i < limitInt; i++ {
+				abilities[catalogAbilities[rand.Intn(len(catalogAbilities))].Name] = rand.Intn(100)
+			}
 		}
 
 		data, err := json.Marshal(abilities)
@@ -0,0 +1,33 @@
+package dna
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	for _, g := range []Generator{Naive, Fast} {
+		for _, length := range []int{0, 1, 31, 32, 33, 1000} {
+			dna := g.Generate(rand.New(rand.NewSource(1)), length)
+			if len(dna) != length || strings.Trim(dna, Bases) != "" {
+				t.Errorf("%s: DNA of length %d is %q", g, length, dna)
+			}
+			if again := g.Generate(rand.New(rand.NewSource(1)), length); again != dna {
+				t.Errorf("%s: the same seed gave a different DNA of length %d", g, length)
+			}
+		}
+
+		// every base is drawn about as often
+		dna := g.Generate(rand.New(rand.NewSource(2)), 10000)
+		for _, b := range Bases {
+			if n := strings.Count(dna, string(b)); n < 2300 || n > 2700 {
+				t.Errorf("%s: %d of %d bases are %c", g, n, len(dna), b)
+			}
+		}
+	}
+
+	if _, err := ParseGenerator("clever"); err == nil {
+		t.Fatal("parsed an unknown DNA generator")
+	}
+}
@@ -0,0 +1,313 @@
+// Package battle simulates turn based battles between two pokemon. A battle
+// only depends on the pokemon and the seed, so its log can be reproduced.
+//
+// Every turn both pokemon attack, the faster one first and ties decided by
+// the random generator. The attacker picks one of its moves with a chance
+// proportional to the damage it expects from it. Moves are the abilities of
+// the pokemon known to the catalog, the move of an ability being the first
+// element it has an affinity with and its power the pokemon's strength in
+// it, at most catalog.MaxPower. A pokemon without such abilities uses
+// Struggle. Damage follows the classic formula: it grows with the level,
+// the power and the ratio of attack to defense, is multiplied by 1.5 when
+// the move shares an element with the attacker, by the Effectiveness
+// against the defender, by 1.5 on a critical hit (1 in 16) and by a random
+// factor from 0.85 to 1. The battle ends when a pokemon faints or after
+// MaxTurns turns, which the pokemon with the larger share of its HP left
+// wins.
+package battle
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/catalog"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/entity"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/genetics"
+)
+
+// DefaultMaxTurns is the number of turns a battle lasts at most.
+const DefaultMaxTurns = 100
+
+// Draw is the Winner of a battle nobody won.
+const Draw = -1
+
+// Struggle is the move of a pokemon without moves.
+var Struggle = Move{Name: "struggle", Power: 50, Element: genetics.Normal}
+
+type Move struct {
+	Name    string           `json:"name"`
+	Power   int              `json:"power"`
+	Element genetics.Element `json:"element"`
+}
+
+// Event is one attack of a battle.
+type Event struct {
+	Turn int `json:"turn"`
+	// Attacker is 0 or 1, the index of the attacking pokemon.
+	Attacker      int     `json:"attacker"`
+	Move          string  `json:"move"`
+	Damage        int     `json:"damage"`
+	Critical      bool    `json:"critical,omitempty"`
+	Effectiveness float64 `json:"effectiveness"`
+	// DefenderHP is what the defender has left.
+	DefenderHP int `json:"defender_hp"`
+}
+
+type Result struct {
+	Fighters [2]string `json:"fighters"`
+	// Winner is the index of the winner, or Draw.
+	Winner int `json:"winner"`
+	Turns  int `json:"turns"`
+	// HP is what both pokemon have left, MaxHP what they started with.
+	HP    [2]int  `json:"hp"`
+	MaxHP [2]int  `json:"max_hp"`
+	Log   []Event `json:"log,omitempty"`
+}
+
+type Options struct {
+	// MaxTurns defaults to DefaultMaxTurns.
+	MaxTurns int
+	// NoLog leaves Result.Log empty, for battles only the outcome of
+	// matters.
+	NoLog bool
+}
+
+// fighter is a pokemon with its battle stats at its level.
+type fighter struct {
+	types []genetics.Element
+	level int
+	moves []Move
+
+	hp, maxHP           int
+	attack, defense     int
+	spAttack, spDefense int
+	speed               int
+}
+
+// Simulate battles a against b with a random generator seeded with seed.
+func Simulate(a, b entity.Pokemon, seed int64, opts Options) (Result, error) {
+	maxTurns := opts.MaxTurns
+	if maxTurns == 0 {
+		maxTurns = DefaultMaxTurns
+	}
+	if maxTurns < 0 {
+		return Result{}, errors.New("max turns must not be negative")
+	}
+
+	var fighters [2]*fighter
+	for i, p := range []entity.Pokemon{a, b} {
+		f, err := newFighter(p, catalog.Default())
+		if err != nil {
+			return Result{}, fmt.Errorf("fighter %d: %w", i+1, err)
+		}
+		fighters[i] = f
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	result := Result{
+		Fighters: [2]string{a.Name, b.Name},
+		Winner:   Draw,
+		MaxHP:    [2]int{fighters[0].maxHP, fighters[1].maxHP},
+	}
+
+	for turn := 1; turn <= maxTurns && result.Winner == Draw; turn++ {
+		result.Turns = turn
+		first := 0
+		if s0, s1 := fighters[0].speed, fighters[1].speed; s1 > s0 || s1 == s0 && rng.Intn(2) == 1 {
+			first = 1
+		}
+
+		for _, attacker := range []int{first, 1 - first} {
+			defender := 1 - attacker
+			e := fighters[attacker].hit(fighters[defender], rng)
+			e.Turn, e.Attacker = turn, attacker
+			if !opts.NoLog {
+				result.Log = append(result.Log, e)
+			}
+			if fighters[defender].hp == 0 {
+				result.Winner = attacker
+				break
+			}
+		}
+	}
+
+	result.HP = [2]int{fighters[0].hp, fighters[1].hp}
+	if result.Winner == Draw {
+		// the larger share of HP left wins, compared without dividing
+		left0 := fighters[0].hp * fighters[1].maxHP
+		left1 := fighters[1].hp * fighters[0].maxHP
+		switch {
+		case left0 > left1:
+			result.Winner = 0
+		case left1 > left0:
+			result.Winner = 1
+		}
+	}
+	return result, nil
+}
+
+func newFighter(p entity.Pokemon, c *catalog.Catalog) (*fighter, error) {
+	types := make([]genetics.Element, 0, 2)
+	for _, t := range p.Types {
+		e, err := genetics.ParseElement(t)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, e)
+	}
+	if len(types) == 0 {
+		// pokemon generated before they had types
+		primary, secondary, err := genetics.Types(p.DNA)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, primary)
+		if secondary != "" {
+			types = append(types, secondary)
+		}
+	}
+
+	level := min(max(p.Level, p.Stats.BaseLv, 1), 100)
+	// stats come from the caller, keep them in the range DNA gives them so
+	// the formulas below cannot overflow
+	base := func(s genetics.Stat, value int) int {
+		return min(max(value, 1), genetics.Caps[s])
+	}
+	stat := func(s genetics.Stat, value int) int {
+		return 2*base(s, value)*level/100 + 5
+	}
+	f := &fighter{
+		types:     types,
+		level:     level,
+		maxHP:     2*base(genetics.HP, p.Stats.HP)*level/100 + level + 10,
+		attack:    stat(genetics.Attack, p.Stats.Attack),
+		defense:   stat(genetics.Defense, p.Stats.Defense),
+		spAttack:  stat(genetics.SpecialAttack, p.Stats.SpecialAttack),
+		spDefense: stat(genetics.SpecialDefense, p.Stats.SpecialDefense),
+		speed:     stat(genetics.Speed, p.Stats.Speed),
+	}
+	f.hp = f.maxHP
+
+	// map order is random, keep the moves in a fixed order
+	for _, name := range slices.Sorted(maps.Keys(p.Abilities)) {
+		a, ok := c.Lookup(name)
+		if !ok {
+			continue
+		}
+		f.moves = append(f.moves, Move{
+			Name:    name,
+			Power:   min(max(p.Abilities[name], 1), catalog.MaxPower),
+			Element: a.Affinities[0],
+		})
+	}
+	if len(f.moves) == 0 {
+		f.moves = []Move{Struggle}
+	}
+	return f, nil
+}
+
+// hit attacks d with a move picked with a chance proportional to its
+// expected damage, or the first move if none would do any.
+func (f *fighter) hit(d *fighter, rng *rand.Rand) Event {
+	weights := make([]int, len(f.moves))
+	total := 0
+	for i, m := range f.moves {
+		weights[i] = f.damage(d, m, 1)
+		total += weights[i]
+	}
+
+	move := f.moves[0]
+	if total > 0 {
+		pick := rng.Intn(total)
+		for i, w := range weights {
+			if pick < w {
+				move = f.moves[i]
+				break
+			}
+			pick -= w
+		}
+	}
+
+	critical := rng.Intn(16) == 0
+	multiplier := 0.85 + 0.15*rng.Float64()
+	if critical {
+		multiplier *= criticalMultiplier
+	}
+	damage := min(f.damage(d, move, multiplier), d.hp)
+	d.hp -= damage
+
+	return Event{
+		Move:          move.Name,
+		Damage:        damage,
+		Critical:      critical,
+		Effectiveness: Effectiveness(move.Element, d.types...),
+		DefenderHP:    d.hp,
+	}
+}
+
+// damage is the damage of m against d, times multiplier. Moves that have an
+// effect do at least 1 damage.
+func (f *fighter) damage(d *fighter, m Move, multiplier float64) int {
+	attack, defense := f.attack, d.defense
+	if special[m.Element] {
+		attack, defense = f.spAttack, d.spDefense
+	}
+
+	base := float64((2*f.level/5+2)*m.Power*attack/max(defense, 1)/50 + 2)
+	if slices.Contains(f.types, m.Element) {
+		base *= stabMultiplier
+	}
+	effectiveness := Effectiveness(m.Element, d.types...)
+	if effectiveness == NoEffect {
+		return 0
+	}
+	return max(int(base*effectiveness*multiplier), 1)
+}
+
+// Report tallies a series of battles between the same two pokemon.
+type Report struct {
+	Seed     int64     `json:"seed"`
+	Fighters [2]string `json:"fighters"`
+	Rounds   int       `json:"rounds"`
+	Wins     [2]int    `json:"wins"`
+	Draws    int       `json:"draws"`
+	// Turns is the mean number of turns of a battle.
+	Turns float64 `json:"turns"`
+	// First is the first battle, with its log.
+	First Result `json:"first"`
+}
+
+// Series fights rounds battles between a and b, each seeded from a random
+// generator seeded with seed. Only the first battle keeps its log.
+func Series(a, b entity.Pokemon, seed int64, rounds int, opts Options) (Report, error) {
+	if rounds < 1 {
+		return Report{}, errors.New("a series needs at least 1 round")
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	report := Report{Seed: seed, Fighters: [2]string{a.Name, b.Name}, Rounds: rounds}
+	turns := 0
+	for round := range rounds {
+		o := opts
+		o.NoLog = opts.NoLog || round > 0
+		result, err := Simulate(a, b, rng.Int63(), o)
+		if err != nil {
+			return Report{}, err
+		}
+
+		if round == 0 {
+			report.First = result
+		}
+		if result.Winner == Draw {
+			report.Draws++
+		} else {
+			report.Wins[result.Winner]++
+		}
+		turns += result.Turns
+	}
+	report.Turns = float64(turns) / float64(rounds)
+	return report, nil
+}
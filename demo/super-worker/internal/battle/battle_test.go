@@ -0,0 +1,179 @@
+package battle
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/entity"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/genetics"
+)
+
+func pokemon(name string, level, stat int, types []string, abilities map[string]int) entity.Pokemon {
+	return entity.Pokemon{
+		Name:      name,
+		Types:     types,
+		Level:     level,
+		Abilities: abilities,
+		Stats: entity.Stats{
+			BaseLv:         level,
+			HP:             stat,
+			Attack:         stat,
+			Defense:        stat,
+			SpecialAttack:  stat,
+			SpecialDefense: stat,
+			Speed:          stat,
+		},
+	}
+}
+
+var (
+	charizard = pokemon("charizard", 50, 120, []string{"fire", "flying"}, map[string]int{"flamethrower": 90, "wing_attack": 60, "tackle": 40})
+	blastoise = pokemon("blastoise", 50, 120, []string{"water"}, map[string]int{"surf": 90, "ice_beam": 90, "body_slam": 85})
+)
+
+func TestSimulateIsDeterministic(t *testing.T) {
+	first, err := Simulate(charizard, blastoise, 7, Options{})
+	if err != nil {
+		t.Fatalf("simulate: %v", err)
+	}
+	again, _ := Simulate(charizard, blastoise, 7, Options{})
+	if !reflect.DeepEqual(first, again) {
+		t.Fatal("the same seed gave different battles")
+	}
+
+	other, _ := Simulate(charizard, blastoise, 8, Options{})
+	if reflect.DeepEqual(first.Log, other.Log) {
+		t.Fatal("different seeds gave the same battle")
+	}
+}
+
+func TestSimulateLogAddsUp(t *testing.T) {
+	result, err := Simulate(charizard, blastoise, 1, Options{})
+	if err != nil {
+		t.Fatalf("simulate: %v", err)
+	}
+
+	hp := result.MaxHP
+	for _, e := range result.Log {
+		defender := 1 - e.Attacker
+		hp[defender] -= e.Damage
+		if hp[defender] != e.DefenderHP {
+			t.Fatalf("turn %d: defender has %d HP, log says %d", e.Turn, hp[defender], e.DefenderHP)
+		}
+	}
+	if hp != result.HP {
+		t.Fatalf("HP left %v, log adds up to %v", result.HP, hp)
+	}
+	if result.Winner == Draw || result.HP[1-result.Winner] != 0 {
+		t.Fatalf("winner %d with HP %v after %d turns", result.Winner, result.HP, result.Turns)
+	}
+
+	quiet, _ := Simulate(charizard, blastoise, 1, Options{NoLog: true})
+	if quiet.Log != nil || quiet.Winner != result.Winner || quiet.HP != result.HP {
+		t.Fatalf("battle without log = %+v", quiet)
+	}
+}
+
+func TestTypesAndStatsDecideBattles(t *testing.T) {
+	// water beats fire and the stronger pokemon beats the weaker one
+	for _, tc := range []struct {
+		a, b entity.Pokemon
+	}{
+		{blastoise, charizard},
+		{pokemon("strong", 60, 200, []string{"normal"}, nil), pokemon("weak", 20, 40, []string{"normal"}, nil)},
+	} {
+		wins := 0
+		for seed := range int64(50) {
+			result, err := Simulate(tc.a, tc.b, seed, Options{NoLog: true})
+			if err != nil {
+				t.Fatalf("simulate: %v", err)
+			}
+			if result.Winner == 0 {
+				wins++
+			}
+		}
+		if wins < 40 {
+			t.Errorf("%s won %d of 50 battles against %s", tc.a.Name, wins, tc.b.Name)
+		}
+	}
+}
+
+func TestSimulateEndsAfterMaxTurns(t *testing.T) {
+	// struggle does not affect ghosts and snorlax outlasts 5 turns of
+	// tackles, so gengar wins on HP
+	a := pokemon("gengar", 50, 100, []string{"ghost"}, map[string]int{"tackle": 40})
+	b := pokemon("snorlax", 50, 100, []string{"normal"}, nil)
+	b.Stats.HP = 255
+
+	result, err := Simulate(a, b, 1, Options{MaxTurns: 5})
+	if err != nil {
+		t.Fatalf("simulate: %v", err)
+	}
+	if result.Turns != 5 || result.HP[0] != result.MaxHP[0] {
+		t.Fatalf("turns %d, HP %v of %v", result.Turns, result.HP, result.MaxHP)
+	}
+	if result.Winner != 0 || result.HP[1] == 0 {
+		t.Fatalf("winner %d with HP %v of %v", result.Winner, result.HP, result.MaxHP)
+	}
+
+	if _, err := Simulate(a, pokemon("missingno", 1, 1, []string{"bird"}, nil), 1, Options{}); err == nil {
+		t.Fatal("simulated a battle with an unknown type")
+	}
+}
+
+func TestSimulateClampsStatsToTheirCaps(t *testing.T) {
+	// a defense this large overflowed the damage formula to a division by 0
+	huge := pokemon("huge", 50, 9223372036854775558, []string{"normal"}, map[string]int{"tackle": 40})
+	capped := pokemon("capped", 50, 255, []string{"normal"}, map[string]int{"tackle": 40})
+
+	for _, opponent := range []entity.Pokemon{charizard, pokemon("negative", 50, -10, []string{"water"}, nil)} {
+		got, err := Simulate(huge, opponent, 1, Options{NoLog: true})
+		if err != nil {
+			t.Fatalf("simulate: %v", err)
+		}
+		want, _ := Simulate(capped, opponent, 1, Options{NoLog: true})
+		if got.Turns != want.Turns || got.Winner != want.Winner || got.HP != want.HP || got.MaxHP != want.MaxHP {
+			t.Errorf("against %s: huge stats fought %+v, capped ones %+v", opponent.Name, got, want)
+		}
+	}
+}
+
+func TestEffectiveness(t *testing.T) {
+	for _, tc := range []struct {
+		attack    genetics.Element
+		defending []genetics.Element
+		want      float64
+	}{
+		{genetics.Water, []genetics.Element{genetics.Fire}, SuperEffective},
+		{genetics.Water, []genetics.Element{genetics.Fire, genetics.Ground}, 4},
+		{genetics.Fire, []genetics.Element{genetics.Water}, NotVeryEffective},
+		{genetics.Electric, []genetics.Element{genetics.Water, genetics.Ground}, NoEffect},
+		{genetics.Ice, []genetics.Element{genetics.Fire, genetics.Flying}, NeutralEffect},
+		{genetics.Psychic, []genetics.Element{genetics.Normal}, NeutralEffect},
+	} {
+		if got := Effectiveness(tc.attack, tc.defending...); got != tc.want {
+			t.Errorf("%s against %v = %v, want %v", tc.attack, tc.defending, got, tc.want)
+		}
+	}
+}
+
+// BenchmarkSimulate is the CPU bound workload of battle jobs, profile it
+// with make benchmark-battle.
+func BenchmarkSimulate(b *testing.B) {
+	for _, opts := range []struct {
+		name string
+		Options
+	}{
+		{"log", Options{}},
+		{"nolog", Options{NoLog: true}},
+	} {
+		b.Run(opts.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := range b.N {
+				if _, err := Simulate(charizard, blastoise, int64(i), opts.Options); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package battle
+
+import "github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/genetics"
+
+// Effectiveness multipliers of a move against one defending element.
+const (
+	SuperEffective   = 2.0
+	NeutralEffect    = 1.0
+	NotVeryEffective = 0.5
+	NoEffect         = 0.0
+)
+
+const (
+	// stabMultiplier boosts moves sharing an element with the attacker.
+	stabMultiplier     = 1.5
+	criticalMultiplier = 1.5
+)
+
+// chart lists the matchups that are not neutral, by attacking element.
+var chart = map[genetics.Element]map[genetics.Element]float64{
+	genetics.Normal: {
+		genetics.Rock:  NotVeryEffective,
+		genetics.Ghost: NoEffect,
+	},
+	genetics.Fire: {
+		genetics.Grass:  SuperEffective,
+		genetics.Ice:    SuperEffective,
+		genetics.Fire:   NotVeryEffective,
+		genetics.Water:  NotVeryEffective,
+		genetics.Rock:   NotVeryEffective,
+		genetics.Dragon: NotVeryEffective,
+	},
+	genetics.Water: {
+		genetics.Fire:   SuperEffective,
+		genetics.Ground: SuperEffective,
+		genetics.Rock:   SuperEffective,
+		genetics.Water:  NotVeryEffective,
+		genetics.Grass:  NotVeryEffective,
+		genetics.Dragon: NotVeryEffective,
+	},
+	genetics.Grass: {
+		genetics.Water:  SuperEffective,
+		genetics.Ground: SuperEffective,
+		genetics.Rock:   SuperEffective,
+		genetics.Fire:   NotVeryEffective,
+		genetics.Grass:  NotVeryEffective,
+		genetics.Flying: NotVeryEffective,
+		genetics.Dragon: NotVeryEffective,
+	},
+	genetics.Electric: {
+		genetics.Water:    SuperEffective,
+		genetics.Flying:   SuperEffective,
+		genetics.Electric: NotVeryEffective,
+		genetics.Grass:    NotVeryEffective,
+		genetics.Dragon:   NotVeryEffective,
+		genetics.Ground:   NoEffect,
+	},
+	genetics.Ice: {
+		genetics.Grass:  SuperEffective,
+		genetics.Ground: SuperEffective,
+		genetics.Flying: SuperEffective,
+		genetics.Dragon: SuperEffective,
+		genetics.Fire:   NotVeryEffective,
+		genetics.Water:  NotVeryEffective,
+		genetics.Ice:    NotVeryEffective,
+	},
+	genetics.Ground: {
+		genetics.Fire:     SuperEffective,
+		genetics.Electric: SuperEffective,
+		genetics.Rock:     SuperEffective,
+		genetics.Grass:    NotVeryEffective,
+		genetics.Flying:   NoEffect,
+	},
+	genetics.Flying: {
+		genetics.Grass:    SuperEffective,
+		genetics.Electric: NotVeryEffective,
+		genetics.Rock:     NotVeryEffective,
+	},
+	genetics.Psychic: {
+		genetics.Psychic: NotVeryEffective,
+	},
+	genetics.Rock: {
+		genetics.Fire:   SuperEffective,
+		genetics.Ice:    SuperEffective,
+		genetics.Flying: SuperEffective,
+		genetics.Ground: NotVeryEffective,
+	},
+	genetics.Ghost: {
+		genetics.Psychic: SuperEffective,
+		genetics.Ghost:   SuperEffective,
+		genetics.Normal:  NoEffect,
+	},
+	genetics.Dragon: {
+		genetics.Dragon: SuperEffective,
+	},
+}
+
+// Effectiveness is the multiplier of a move of element attack against a
+// pokemon of the defending types: the product of the matchups against each
+// of them.
+func Effectiveness(attack genetics.Element, defending ...genetics.Element) float64 {
+	m := NeutralEffect
+	for _, d := range defending {
+		if v, ok := chart[attack][d]; ok {
+			m *= v
+		}
+	}
+	return m
+}
+
+// special elements hit with SpecialAttack against SpecialDefense, the others
+// with Attack against Defense.
+var special = map[genetics.Element]bool{
+	genetics.Fire:     true,
+	genetics.Water:    true,
+	genetics.Grass:    true,
+	genetics.Electric: true,
+	genetics.Ice:      true,
+	genetics.Psychic:  true,
+	genetics.Dragon:   true,
+}
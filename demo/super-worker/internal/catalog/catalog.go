@@ -0,0 +1,117 @@
+// Package catalog lists the abilities pokemon can learn and the elements
+// they have an affinity with. The default catalog is embedded from
+// abilities.json.
+package catalog
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/genetics"
+)
+
+//go:embed abilities.json
+var abilitiesJSON []byte
+
+// MaxPower is the power of the strongest ability.
+const MaxPower = 250
+
+type Ability struct {
+	Name  string `json:"name"`
+	Power int    `json:"power"`
+	// Affinities are the elements of the pokemon that can learn the
+	// ability. Abilities with a genetics.Normal affinity can be learned by
+	// any pokemon.
+	Affinities []genetics.Element `json:"affinities"`
+}
+
+// Learnable reports whether a pokemon of the given types can learn a.
+func (a Ability) Learnable(types ...genetics.Element) bool {
+	for _, e := range a.Affinities {
+		if e == genetics.Normal || slices.Contains(types, e) {
+			return true
+		}
+	}
+	return false
+}
+
+type Catalog struct {
+	abilities []Ability
+	byName    map[string]int
+}
+
+// Default returns the embedded catalog.
+var Default = sync.OnceValue(func() *Catalog {
+	c, err := Parse(abilitiesJSON)
+	if err != nil {
+		panic(fmt.Sprintf("embedded abilities: %v", err))
+	}
+	return c
+})
+
+// Parse decodes and validates a JSON array of abilities. Every ability needs
+// a unique name, a power from 1 to MaxPower and at least one known element.
+func Parse(data []byte) (*Catalog, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var abilities []Ability
+	if err := dec.Decode(&abilities); err != nil {
+		return nil, fmt.Errorf("parse catalog: %w", err)
+	}
+
+	c := &Catalog{abilities: abilities, byName: map[string]int{}}
+	var errs []error
+	for i, a := range abilities {
+		if a.Name == "" {
+			errs = append(errs, fmt.Errorf("ability %d has no name", i))
+		} else if _, ok := c.byName[a.Name]; ok {
+			errs = append(errs, fmt.Errorf("ability %q is listed twice", a.Name))
+		}
+		if a.Power < 1 || a.Power > MaxPower {
+			errs = append(errs, fmt.Errorf("ability %q: power must be between 1 and %d", a.Name, MaxPower))
+		}
+		if len(a.Affinities) == 0 {
+			errs = append(errs, fmt.Errorf("ability %q has no affinity", a.Name))
+		}
+		for _, e := range a.Affinities {
+			if _, err := genetics.ParseElement(string(e)); err != nil {
+				errs = append(errs, fmt.Errorf("ability %q: %w", a.Name, err))
+			}
+		}
+		c.byName[a.Name] = i
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("invalid catalog: %w", err)
+	}
+	return c, nil
+}
+
+// Abilities returns every ability in the order of the catalog.
+func (c *Catalog) Abilities() []Ability {
+	return slices.Clone(c.abilities)
+}
+
+func (c *Catalog) Lookup(name string) (Ability, bool) {
+	i, ok := c.byName[name]
+	if !ok {
+		return Ability{}, false
+	}
+	return c.abilities[i], true
+}
+
+// Learnable returns the abilities a pokemon of the given types can learn.
+func (c *Catalog) Learnable(types ...genetics.Element) []Ability {
+	var abilities []Ability
+	for _, a := range c.abilities {
+		if a.Learnable(types...) {
+			abilities = append(abilities, a)
+		}
+	}
+	return abilities
+}
@@ -0,0 +1,48 @@
+package catalog
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/genetics"
+)
+
+func TestDefaultCatalogCoversEveryElement(t *testing.T) {
+	c := Default()
+
+	for _, e := range genetics.Elements {
+		if !slices.ContainsFunc(c.Abilities(), func(a Ability) bool { return slices.Contains(a.Affinities, e) }) {
+			t.Errorf("no ability of element %s", e)
+		}
+	}
+
+	a, ok := c.Lookup("flamethrower")
+	if !ok || !a.Learnable(genetics.Fire) || a.Learnable(genetics.Water) {
+		t.Fatalf("flamethrower = %+v, %v", a, ok)
+	}
+	if _, ok := c.Lookup("splash"); ok {
+		t.Fatal("found an ability that is not in the catalog")
+	}
+}
+
+func TestParseRejectsInvalidAbilities(t *testing.T) {
+	for _, data := range []string{
+		`[{"name": "ember", "power": 40, "affinities": ["fire"]}, {"name": "ember", "power": 50, "affinities": ["fire"]}]`,
+		`[{"name": "ember", "power": 0, "affinities": ["fire"]}]`,
+		`[{"name": "ember", "power": 40, "affinities": []}]`,
+		`[{"name": "ember", "power": 40, "affinities": ["lava"]}]`,
+		`[{"name": "ember", "power": 40, "affinities": ["fire"], "accuracy": 100}]`,
+		`[{"power": 40, "affinities": ["fire"]}]`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("parsed %s", data)
+		}
+	}
+
+	if _, err := Parse([]byte(`[{"name": "ember", "power": 40, "affinities": ["fire"]}]`)); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if _, err := Parse([]byte(`[{"name": "ember"`)); err == nil {
+		t.Fatal("parsed invalid JSON")
+	}
+}
@@ -0,0 +1,57 @@
+package controller
+
+import "errors"
+
+// errDeadlineExceeded is returned for jobs whose deadline passed before they
+// could be processed.
+var errDeadlineExceeded = errors.New("job deadline exceeded")
+
+// permanentError marks a failure that will not go away on redelivery, such as
+// a malformed job. Everything else is treated as transient.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// seededError carries the seed a job without one was run with, so its retry
+// runs with the same seed and reproduces what the failed attempt published.
+type seededError struct {
+	err  error
+	seed int64
+}
+
+func (e *seededError) Error() string {
+	return e.err.Error()
+}
+
+func (e *seededError) Unwrap() error {
+	return e.err
+}
+
+func withSeed(err error, seed int64) error {
+	return &seededError{err: err, seed: seed}
+}
+
+func seedOf(err error) (int64, bool) {
+	var s *seededError
+	if !errors.As(err, &s) {
+		return 0, false
+	}
+	return s.seed, true
+}
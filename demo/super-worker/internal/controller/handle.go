@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+)
+
+// WorkerHandle controls a started WorkerController.
+type WorkerHandle struct {
+	consumer    libs.Consumer
+	consumerTag string
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	loops    sync.WaitGroup
+	inFlight sync.WaitGroup
+}
+
+// Stop cancels the consumer so no new deliveries arrive, lets the worker
+// goroutines finish the jobs they are running and waits for them until ctx
+// is done. Deliveries that were prefetched but not started are left unacked
+// and redelivered by the broker. It returns ctx.Err() when the drain timed
+// out with jobs still in flight.
+func (h *WorkerHandle) Stop(ctx context.Context) error {
+	var cancelErr error
+	h.stopOnce.Do(func() {
+		cancelErr = h.consumer.CancelContext(ctx, h.consumerTag)
+		if cancelErr != nil {
+			cancelErr = fmt.Errorf("cancel consumer: %w", cancelErr)
+		}
+		close(h.stop)
+	})
+
+	drained := make(chan struct{})
+	go func() {
+		h.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return cancelErr
+	case <-ctx.Done():
+		return errors.Join(cancelErr, fmt.Errorf("drain in-flight jobs: %w", ctx.Err()))
+	}
+}
+
+// Wait blocks until every worker goroutine has exited and every in-flight
+// job, including the ones spawned in ModeNaive, has been settled.
+func (h *WorkerHandle) Wait() {
+	h.loops.Wait()
+	h.inFlight.Wait()
+}
@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/streadway/amqp"
+)
+
+type fakeConsumer struct {
+	msgs      chan amqp.Delivery
+	cancelled chan string
+}
+
+func (f *fakeConsumer) ConsumeContext(ctx context.Context, queue, consumer string, opts libs.ConsumeOptions) (<-chan amqp.Delivery, error) {
+	return f.msgs, nil
+}
+
+func (f *fakeConsumer) CancelContext(ctx context.Context, consumer string) error {
+	f.cancelled <- consumer
+	return nil
+}
+
+// blockingPublisher holds every publish until release is closed.
+type blockingPublisher struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingPublisher) PublishContext(ctx context.Context, exchange, key string, mandatory bool, msg amqp.Publishing) error {
+	p.started <- struct{}{}
+	<-p.release
+	return nil
+}
+
+type recordingAcknowledger struct {
+	mu   sync.Mutex
+	acks int
+}
+
+func (a *recordingAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acks++
+	return nil
+}
+
+func (a *recordingAcknowledger) Nack(tag uint64, multiple, requeue bool) error { return nil }
+func (a *recordingAcknowledger) Reject(tag uint64, requeue bool) error         { return nil }
+
+func TestWorkerHandleStopDrainsInFlightJobs(t *testing.T) {
+	consumer := &fakeConsumer{msgs: make(chan amqp.Delivery, 1), cancelled: make(chan string, 1)}
+	publisher := &blockingPublisher{started: make(chan struct{}, 1), release: make(chan struct{})}
+	acker := &recordingAcknowledger{}
+
+	worker := NewWorker(WorkerConfig{MaxWorkers: 1, Mode: ModeBounded, Queue: "jobs"}, nil, publisher)
+	handle, err := worker.Start(context.Background(), consumer)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	// malformed jobs are dead-lettered without touching the usecase, which is
+	// enough to keep a job in flight while the publisher blocks
+	consumer.msgs <- amqp.Delivery{Acknowledger: acker, Body: []byte("not json")}
+	<-publisher.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := handle.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Stop with a job in flight: got %v, want context.DeadlineExceeded", err)
+	}
+	if tag := <-consumer.cancelled; tag != "worker" {
+		t.Fatalf("cancelled consumer %q, want %q", tag, "worker")
+	}
+
+	close(publisher.release)
+	handle.Wait()
+
+	if err := handle.Stop(context.Background()); err != nil {
+		t.Fatalf("second Stop after drain: %v", err)
+	}
+
+	acker.mu.Lock()
+	defer acker.mu.Unlock()
+	if acker.acks != 1 {
+		t.Fatalf("in-flight job was not settled before Wait returned, acks = %d", acker.acks)
+	}
+}
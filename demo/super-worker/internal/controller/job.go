@@ -1,5 +1,166 @@
 package controller
 
+import (
+	"strconv"
+	"time"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/entity"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/usecase"
+	"github.com/streadway/amqp"
+)
+
+const (
+	JobTypeGenerate = "generate"
+	// JobTypeBreed breeds the two Parents of the job.
+	JobTypeBreed = "breed"
+	// JobTypeEvolve generates a pokemon, then evolves it into every form
+	// of its Evolution.
+	JobTypeEvolve = "evolve"
+	// JobTypeBattle fights a series of battles between the two Fighters of
+	// the job. Unlike the other types it is bound by the CPU.
+	JobTypeBattle = "battle"
+	// JobTypeTournament plays a tournament between the Entrants of its
+	// Tournament, every match being a JobTypeBattle job of its own.
+	JobTypeTournament = "tournament"
+)
+
+// JobTypes lists every job type the worker understands.
+var JobTypes = []string{JobTypeGenerate, JobTypeBreed, JobTypeEvolve, JobTypeBattle, JobTypeTournament}
+
+// Headers of the pokemon a JobTypeEvolve job publishes, one message per
+// stage.
+const (
+	// HeaderLineage is the id of the evolve job, shared by all its stages.
+	HeaderLineage = "x-lineage"
+	// HeaderEvolutionStage is 0 for the generated pokemon and n for its
+	// n-th evolved form.
+	HeaderEvolutionStage = "x-evolution-stage"
+)
+
+// HeaderSeed pins the seed of a retried job that had none, so the retry
+// publishes what the failed attempt did under the same message ids.
+const HeaderSeed = "x-seed"
+
+// HeaderPostponements counts how often a job was postponed because the
+// worker had no room for it.
+const HeaderPostponements = "x-postponements"
+
+// postponements returns HeaderPostponements of d, 0 if it was never
+// postponed or carries a negative count.
+func postponements(d amqp.Delivery) int {
+	var n int
+	switch v := d.Headers[HeaderPostponements].(type) {
+	case int32:
+		n = int(v)
+	case int64:
+		n = int(v)
+	}
+	return max(n, 0)
+}
+
+// JobMaxPriority is the x-max-priority of the job queue. Higher priority
+// jobs are delivered first.
+const JobMaxPriority = 9
+
 type Job struct {
+	// ID identifies the job and is used as the AMQP message id.
+	ID string `json:"id,omitempty"`
+	// CorrelationID ties the job and its result to the request that
+	// created it.
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// Type selects what the worker does with the job. Empty means JobTypeGenerate.
+	Type string `json:"type,omitempty"`
 	Name string `json:"name"`
+	// ReplyTo names the queue the result is sent to besides
+	// pokemon_generated, correlated by CorrelationID.
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Priority ranges from 0 to JobMaxPriority.
+	Priority uint8 `json:"priority,omitempty"`
+	// Seed makes the generated pokemon reproducible. Without one every run
+	// differs.
+	Seed *int64 `json:"seed,omitempty"`
+	// Options tune how the pokemon is generated.
+	Options usecase.GenerateOptions `json:"options,omitzero"`
+	// Parents and Breeding are the input of JobTypeBreed.
+	Parents  []entity.Pokemon     `json:"parents,omitempty"`
+	Breeding usecase.BreedOptions `json:"breeding,omitzero"`
+	// Evolution is the input of JobTypeEvolve.
+	Evolution Evolution `json:"evolution,omitzero"`
+	// Fighters and Battle are the input of JobTypeBattle. Battle also
+	// tunes every match of a tournament.
+	Fighters []entity.Pokemon      `json:"fighters,omitempty"`
+	Battle   usecase.BattleOptions `json:"battle,omitzero"`
+	// Tournament is the input of JobTypeTournament.
+	Tournament Tournament `json:"tournament,omitzero"`
+	// Deadline is when the result stops being useful. Jobs past their
+	// deadline are dead-lettered without being processed.
+	Deadline time.Time `json:"deadline,omitzero"`
+}
+
+// Evolution names the forms a pokemon evolves into, one stage each, and
+// tunes every stage.
+type Evolution struct {
+	Names []string `json:"names"`
+	usecase.EvolveOptions
+}
+
+// Tournament lists the entrants of a tournament, by seed for a bracket.
+type Tournament struct {
+	Entrants []entity.Pokemon `json:"entrants"`
+	usecase.TournamentOptions
+}
+
+func (j Job) JobType() string {
+	if j.Type == "" {
+		return JobTypeGenerate
+	}
+	return j.Type
+}
+
+// Expired reports whether the job has a deadline that passed by now.
+func (j Job) Expired(now time.Time) bool {
+	return !j.Deadline.IsZero() && !now.Before(j.Deadline)
+}
+
+// Expiration is the AMQP per-message TTL that makes the broker drop the job
+// at its deadline, or "" without one.
+func (j Job) Expiration(now time.Time) string {
+	if j.Deadline.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(max(j.Deadline.Sub(now).Milliseconds(), 0), 10)
+}
+
+// withDelivery fills in what the publisher only set on the AMQP message.
+func (j Job) withDelivery(d amqp.Delivery) Job {
+	if j.ID == "" {
+		j.ID = d.MessageId
+	}
+	if j.CorrelationID == "" {
+		j.CorrelationID = d.CorrelationId
+	}
+	if j.ReplyTo == "" {
+		j.ReplyTo = d.ReplyTo
+	}
+	if j.Priority == 0 {
+		j.Priority = d.Priority
+	}
+	if seed, ok := d.Headers[HeaderSeed].(int64); ok && j.Seed == nil {
+		j.Seed = &seed
+	}
+	return j
+}
+
+// stageID is the message id of an evolve job's stage. The generated pokemon
+// keeps the job's id.
+func stageID(jobID string, stage int) string {
+	if stage == 0 || jobID == "" {
+		return jobID
+	}
+	return jobID + "/" + strconv.Itoa(stage)
+}
+
+// matchID is the message id of the battle job of a tournament's match.
+func matchID(jobID, match string) string {
+	return jobID + "/" + match
 }
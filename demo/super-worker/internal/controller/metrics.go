@@ -0,0 +1,39 @@
+package controller
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	jobsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "worker_jobs_in_flight",
+			Help: "Jobs currently being processed.",
+		},
+	)
+
+	jobRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "worker_job_retries_total",
+			Help: "Failed jobs republished to a retry delay queue.",
+		},
+		[]string{"job_type", "delay"},
+	)
+
+	jobDeadLetteredTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "worker_job_dead_lettered_total",
+			Help: "Jobs sent to the dead-letter queue, by why they were given up on.",
+		},
+		[]string{"job_type", "reason"},
+	)
+
+	tournamentsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "worker_tournaments_in_flight",
+			Help: "Tournaments currently waiting on their matches.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(jobsInFlight, jobRetriesTotal, jobDeadLetteredTotal, tournamentsInFlight)
+}
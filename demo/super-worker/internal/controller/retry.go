@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy decides how often and how late a failed job is retried.
+// Delays[n] is the wait before attempt n+2; the last delay is reused when
+// there are more attempts than delays.
+type RetryPolicy struct {
+	MaxAttempts int
+	Delays      []time.Duration
+}
+
+func (p RetryPolicy) delay(attempts int) time.Duration {
+	if len(p.Delays) == 0 {
+		return 0
+	}
+	// attempts come from a header anyone can set
+	attempts = min(max(attempts, 1), len(p.Delays))
+	return p.Delays[attempts-1]
+}
+
+// ParseRetryPolicy parses "<max attempts>:<delay>,<delay>,...", for example
+// "5:1s,10s,60s". The delay list may be omitted.
+func ParseRetryPolicy(s string) (RetryPolicy, error) {
+	attempts, delays, _ := strings.Cut(s, ":")
+
+	maxAttempts, err := strconv.Atoi(strings.TrimSpace(attempts))
+	if err != nil || maxAttempts <= 0 {
+		return RetryPolicy{}, fmt.Errorf("invalid max attempts %q", attempts)
+	}
+
+	parsed, err := ParseDelays(delays)
+	if err != nil {
+		return RetryPolicy{}, err
+	}
+
+	return RetryPolicy{MaxAttempts: maxAttempts, Delays: parsed}, nil
+}
+
+// ParseDelays parses a comma separated list of durations such as "1s,10s,60s".
+func ParseDelays(s string) ([]time.Duration, error) {
+	var delays []time.Duration
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry delay %q: %w", part, err)
+		}
+		delays = append(delays, d)
+	}
+
+	return delays, nil
+}
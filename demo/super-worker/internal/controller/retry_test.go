@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseRetryPolicy(t *testing.T) {
+	p, err := ParseRetryPolicy("3:1s, 10s,1m")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	want := []time.Duration{time.Second, 10 * time.Second, time.Minute}
+	if p.MaxAttempts != 3 || !slices.Equal(p.Delays, want) {
+		t.Fatalf("got %+v", p)
+	}
+
+	for attempts, want := range map[int]time.Duration{-3: time.Second, 0: time.Second, 1: time.Second, 2: 10 * time.Second, 3: time.Minute, 7: time.Minute} {
+		if got := p.delay(attempts); got != want {
+			t.Errorf("delay(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+
+	for _, bad := range []string{"", "0:1s", "x:1s", "3:soon"} {
+		if _, err := ParseRetryPolicy(bad); err == nil {
+			t.Errorf("ParseRetryPolicy(%q) succeeded", bad)
+		}
+	}
+}
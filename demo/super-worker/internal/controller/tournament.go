@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/battle"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/entity"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/tournament"
+	"github.com/streadway/amqp"
+)
+
+// errTournamentBusy is returned for tournaments beyond MaxTournaments. They
+// are retried, maybe by a worker with room for them.
+var errTournamentBusy = errors.New("too many tournaments in progress")
+
+// tournament plays a tournament job round by round. The matches of a round
+// fan out to the job queue as battle jobs replying to config.Replies, so any
+// worker of the fleet fights them, and their reports fan back in as they
+// return. The final standings are published to pokemon_tournaments and
+// replied with. The goroutine running the job only waits, which is why
+// MaxTournaments leaves some to the matches; a worker with a single
+// goroutine leaves them to the rest of the fleet. A retry plays the tournament
+// again from the first round; with a seed it schedules the same matches
+// under the same message ids.
+func (c *WorkerController) tournament(ctx context.Context, job Job) error {
+	if c.config.Replies == nil {
+		return permanent(errors.New("tournament jobs need a reply queue"))
+	}
+	if job.ID == "" {
+		// match ids are derived from the job's
+		job.ID = libs.NewMessageID()
+	}
+
+	opts := job.Tournament.TournamentOptions
+	opts.Seed = job.Seed
+	t, err := c.pokemonUsecase.NewTournament(job.Tournament.Entrants, opts)
+	if err != nil {
+		return permanent(fmt.Errorf("tournament: %w", err))
+	}
+
+	select {
+	case c.tournaments <- struct{}{}:
+		defer func() { <-c.tournaments }()
+	default:
+		return errTournamentBusy
+	}
+	tournamentsInFlight.Inc()
+	defer tournamentsInFlight.Dec()
+
+	deadline := time.Now().Add(c.config.TournamentTimeout)
+	if !job.Deadline.IsZero() && job.Deadline.Before(deadline) {
+		deadline = job.Deadline
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	for {
+		matches, err := t.Next()
+		if err != nil {
+			return err
+		}
+		if matches == nil {
+			break
+		}
+		if err := c.playRound(ctx, job, deadline, t, matches); err != nil {
+			return err
+		}
+	}
+
+	data, err := c.publishResult(ctx, "pokemon_tournaments", t.Report(), amqp.Publishing{
+		MessageId:     job.ID,
+		CorrelationId: job.CorrelationID,
+	})
+	if err != nil {
+		return fmt.Errorf("publish tournament: %w", err)
+	}
+
+	c.reply(ctx, job, amqp.Publishing{
+		ContentType: "application/json",
+		Type:        libs.ReplyTypeResult,
+		Body:        data,
+	})
+	return nil
+}
+
+type matchReply struct {
+	match tournament.Match
+	reply amqp.Delivery
+	err   error
+}
+
+// playRound publishes the matches of a round as battle jobs and records
+// their reports in whatever order they come back. A match that failed
+// fails the tournament for good: battles only fail on invalid fighters.
+func (c *WorkerController) playRound(ctx context.Context, job Job, deadline time.Time, t *tournament.Tournament, matches []tournament.Match) error {
+	// stop the waits below on return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	entrants := job.Tournament.Entrants
+	replies := make(chan matchReply, len(matches))
+	for _, m := range matches {
+		id := matchID(job.ID, m.ID)
+		pending := c.config.Replies.Expect(id)
+		defer pending.Cancel()
+
+		seed := m.Seed
+		err := c.publishJob(ctx, Job{
+			ID:            id,
+			CorrelationID: id,
+			Type:          JobTypeBattle,
+			Name:          m.ID,
+			ReplyTo:       c.config.Replies.Queue(),
+			Priority:      job.Priority,
+			Seed:          &seed,
+			Fighters:      []entity.Pokemon{entrants[m.Entrants[0]], entrants[m.Entrants[1]]},
+			Battle:        job.Battle,
+			Deadline:      deadline,
+		})
+		if err != nil {
+			return fmt.Errorf("publish match %s: %w", m.ID, err)
+		}
+
+		go func() {
+			d, err := pending.Wait(ctx)
+			replies <- matchReply{match: m, reply: d, err: err}
+		}()
+	}
+
+	for range matches {
+		r := <-replies
+		if r.err != nil {
+			return fmt.Errorf("wait for match %s: %w", r.match.ID, r.err)
+		}
+		if r.reply.Type == libs.ReplyTypeError {
+			return permanent(fmt.Errorf("match %s failed: %v", r.match.ID, r.reply.Headers[libs.HeaderFailureReason]))
+		}
+
+		var report battle.Report
+		if err := json.Unmarshal(r.reply.Body, &report); err != nil {
+			return permanent(fmt.Errorf("decode match %s: %w", r.match.ID, err))
+		}
+		if err := t.Record(r.match.ID, report); err != nil {
+			return permanent(err)
+		}
+	}
+	return nil
+}
+
+// publishJob publishes job to the job queue the way producers do.
+func (c *WorkerController) publishJob(ctx context.Context, job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return permanent(fmt.Errorf("marshal job: %w", err))
+	}
+
+	return c.output.PublishContext(ctx, "", c.config.Queue, true, amqp.Publishing{
+		ContentType:   "application/json",
+		DeliveryMode:  amqp.Persistent,
+		MessageId:     job.ID,
+		CorrelationId: job.CorrelationID,
+		ReplyTo:       job.ReplyTo,
+		Priority:      job.Priority,
+		Expiration:    job.Expiration(time.Now()),
+		Body:          data,
+	})
+}
@@ -0,0 +1,236 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/dna"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/tournament"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/usecase"
+	"github.com/streadway/amqp"
+)
+
+// startTournamentWorker wires a worker of 2 goroutines, one to play a
+// tournament and one to fight its matches, to an in-memory broker with the
+// queues tournaments publish to declared.
+func startTournamentWorker(t *testing.T) (*libs.MemoryBroker, libs.DeadLetter) {
+	t.Helper()
+
+	ctx := context.Background()
+	broker := libs.NewMemoryBroker(2)
+	t.Cleanup(broker.Close)
+
+	dl := libs.DeadLetterFor("jobs")
+	for _, q := range []string{"jobs", dl.Queue, "matches", "pokemon_battles", "pokemon_tournaments"} {
+		if _, err := broker.QueueDeclareContext(ctx, q); err != nil {
+			t.Fatalf("declare %s: %v", q, err)
+		}
+	}
+	if err := broker.QueueBindContext(ctx, dl.Queue, dl.RoutingKey, dl.Exchange); err != nil {
+		t.Fatalf("bind dead letter: %v", err)
+	}
+
+	replies, err := libs.NewReplies(ctx, broker, "matches")
+	if err != nil {
+		t.Fatalf("consume replies: %v", err)
+	}
+
+	worker := NewWorker(WorkerConfig{
+		MaxWorkers:         2,
+		Mode:               ModeBounded,
+		Queue:              "jobs",
+		DeadLetter:         dl,
+		DefaultRetryPolicy: RetryPolicy{MaxAttempts: 3},
+		Replies:            replies,
+	}, usecase.NewPokemonUsecase(nil, nil, dna.Naive), broker)
+	handle, err := worker.Start(ctx, broker)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { handle.Stop(context.Background()) })
+
+	return broker, dl
+}
+
+func entrants(types ...string) string {
+	fighter := `{"name":"%s","types":["%s"],"level":50,"stats":{"base_lv":50,"hp":100,"attack":100,"defense":100,"special_attack":100,"special_defense":100,"speed":100}}`
+	var list []string
+	for _, typ := range types {
+		list = append(list, fmt.Sprintf(fighter, typ+"mon", typ))
+	}
+	return "[" + strings.Join(list, ",") + "]"
+}
+
+func TestWorkerFansTournamentMatchesOut(t *testing.T) {
+	broker, _ := startTournamentWorker(t)
+	ctx := context.Background()
+
+	body := fmt.Sprintf(`{"type":"tournament","name":"league","seed":5,"battle":{"rounds":3},"tournament":{"entrants":%s}}`,
+		entrants("fire", "water", "grass", "electric"))
+	if err := broker.PublishContext(ctx, "", "jobs", true, amqp.Publishing{MessageId: "job-1", Body: []byte(body)}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	d := waitForMessage(t, broker, "pokemon_tournaments")
+	var report tournament.Report
+	if err := json.Unmarshal(d.Body, &report); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	if d.MessageId != "job-1" || report.Format != tournament.RoundRobin || report.Seed != 5 {
+		t.Fatalf("message %q has report %+v", d.MessageId, report)
+	}
+	if len(report.Matches) != 6 || len(report.Standings) != 4 {
+		t.Fatalf("%d matches and %d standings", len(report.Matches), len(report.Standings))
+	}
+	played := 0
+	for _, s := range report.Standings {
+		played += s.Played
+		if s.BattlesWon+s.BattlesLost > 3*s.Played {
+			t.Errorf("standing %+v counts too many battles", s)
+		}
+	}
+	if played != 12 {
+		t.Errorf("standings count %d matches played, want 12", played)
+	}
+
+	// every match was a battle job of its own
+	if n := broker.Len("pokemon_battles"); n != 6 {
+		t.Fatalf("%d battle reports, want 6", n)
+	}
+	battle := waitForMessage(t, broker, "pokemon_battles")
+	if !strings.HasPrefix(battle.MessageId, "job-1/round-1/match-") {
+		t.Errorf("match has message id %q", battle.MessageId)
+	}
+}
+
+func TestWorkerDeadLettersTournamentsWithFailedMatches(t *testing.T) {
+	broker, dl := startTournamentWorker(t)
+	ctx := context.Background()
+
+	// a bird is not a type, so its first match fails for good
+	body := fmt.Sprintf(`{"type":"tournament","name":"cup","tournament":{"format":"bracket","entrants":%s}}`,
+		entrants("fire", "water", "bird"))
+	if err := broker.PublishContext(ctx, "", "jobs", true, amqp.Publishing{MessageId: "job-1", Body: []byte(body)}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	match := waitForMessage(t, broker, dl.Queue)
+	tour := waitForMessage(t, broker, dl.Queue)
+	if match.MessageId != "job-1/round-1/match-1" || tour.MessageId != "job-1" {
+		t.Fatalf("dead-lettered %q then %q", match.MessageId, tour.MessageId)
+	}
+	if libs.Attempts(tour) != 1 || broker.Len("pokemon_tournaments") != 0 {
+		t.Fatalf("tournament dead-lettered after %d attempt(s)", libs.Attempts(tour))
+	}
+}
+
+func TestWorkerPostponesTournamentsWhenBusy(t *testing.T) {
+	ctx := context.Background()
+	broker := libs.NewMemoryBroker(2)
+	t.Cleanup(broker.Close)
+
+	dl := libs.DeadLetterFor("jobs")
+	for _, q := range []string{"jobs", dl.Queue, "matches", "pokemon_battles", "pokemon_tournaments"} {
+		if _, err := broker.QueueDeclareContext(ctx, q); err != nil {
+			t.Fatalf("declare %s: %v", q, err)
+		}
+	}
+	if err := broker.QueueBindContext(ctx, dl.Queue, dl.RoutingKey, dl.Exchange); err != nil {
+		t.Fatalf("bind dead letter: %v", err)
+	}
+	replies, err := libs.NewReplies(ctx, broker, "matches")
+	if err != nil {
+		t.Fatalf("consume replies: %v", err)
+	}
+
+	// a single attempt would dead-letter the tournament if being busy
+	// counted as one; without delay queues it is postponed over and over
+	worker := NewWorker(WorkerConfig{
+		MaxWorkers:       2,
+		Mode:             ModeBounded,
+		Queue:            "jobs",
+		DeadLetter:       dl,
+		Replies:          replies,
+		MaxPostponements: math.MaxInt32,
+	}, usecase.NewPokemonUsecase(nil, nil, dna.Naive), broker)
+	worker.tournaments <- struct{}{}
+	handle, err := worker.Start(ctx, broker)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { handle.Stop(context.Background()) })
+
+	body := fmt.Sprintf(`{"type":"tournament","name":"cup","seed":1,"tournament":{"entrants":%s}}`, entrants("fire", "water"))
+	if err := broker.PublishContext(ctx, "", "jobs", true, amqp.Publishing{MessageId: "job-1", Body: []byte(body)}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := broker.Len(dl.Queue); n != 0 {
+		t.Fatalf("%d job(s) dead-lettered while the worker was busy", n)
+	}
+
+	<-worker.tournaments
+	d := waitForMessage(t, broker, "pokemon_tournaments")
+	if d.MessageId != "job-1" {
+		t.Fatalf("published tournament %q", d.MessageId)
+	}
+}
+
+func TestWorkerDeadLettersTournamentsPostponedTooOften(t *testing.T) {
+	ctx := context.Background()
+	broker := libs.NewMemoryBroker(1)
+	t.Cleanup(broker.Close)
+
+	dl := libs.DeadLetterFor("jobs")
+	for _, q := range []string{"jobs", dl.Queue, "matches"} {
+		if _, err := broker.QueueDeclareContext(ctx, q); err != nil {
+			t.Fatalf("declare %s: %v", q, err)
+		}
+	}
+	if err := broker.QueueBindContext(ctx, dl.Queue, dl.RoutingKey, dl.Exchange); err != nil {
+		t.Fatalf("bind dead letter: %v", err)
+	}
+	replies, err := libs.NewReplies(ctx, broker, "matches")
+	if err != nil {
+		t.Fatalf("consume replies: %v", err)
+	}
+
+	// a single goroutine still has room for a tournament
+	worker := NewWorker(WorkerConfig{
+		MaxWorkers:       1,
+		Mode:             ModeBounded,
+		Queue:            "jobs",
+		DeadLetter:       dl,
+		Replies:          replies,
+		MaxPostponements: 3,
+	}, usecase.NewPokemonUsecase(nil, nil, dna.Naive), broker)
+	if n := cap(worker.tournaments); n != 1 {
+		t.Fatalf("room for %d tournament(s), want 1", n)
+	}
+	worker.tournaments <- struct{}{}
+	handle, err := worker.Start(ctx, broker)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { handle.Stop(context.Background()) })
+
+	body := fmt.Sprintf(`{"type":"tournament","name":"cup","seed":1,"tournament":{"entrants":%s}}`, entrants("fire", "water"))
+	if err := broker.PublishContext(ctx, "", "jobs", true, amqp.Publishing{MessageId: "job-1", Body: []byte(body)}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	d := waitForMessage(t, broker, dl.Queue)
+	if n := postponements(d); n != 3 {
+		t.Fatalf("dead-lettered after %d postponement(s), want 3", n)
+	}
+	if n := libs.Attempts(d); n != 1 {
+		t.Fatalf("dead-lettered after %d attempt(s), want 1", n)
+	}
+}
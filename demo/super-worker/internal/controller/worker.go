@@ -1,65 +1,530 @@
 package controller
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"maps"
+	"slices"
+	"time"
 
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/entity"
 	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/usecase"
 	"github.com/streadway/amqp"
 )
 
+// Mode selects how deliveries are handed to the worker goroutines.
+type Mode string
+
+const (
+	// ModeBounded processes each delivery on the worker goroutine that
+	// received it, so MaxWorkers is the real concurrency limit.
+	ModeBounded Mode = "bounded"
+	// ModeNaive spawns a goroutine per delivery. Concurrency is then only
+	// bounded by the prefetch count; kept on purpose for the profiling demo.
+	ModeNaive Mode = "naive"
+)
+
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case "", ModeBounded:
+		return ModeBounded, nil
+	case ModeNaive:
+		return ModeNaive, nil
+	default:
+		return "", fmt.Errorf("unknown worker mode %q", s)
+	}
+}
+
+type WorkerConfig struct {
+	MaxWorkers int
+	Mode       Mode
+	// Queue is the queue jobs are consumed from.
+	Queue string
+	// ConsumerTag names the worker's consumer on Queue, "worker" by
+	// default. Stopping the worker cancels the consumer by this tag.
+	ConsumerTag string
+	DeadLetter  libs.DeadLetter
+	RetryQueues libs.RetryQueues
+	// RetryPolicies maps a job type to its retry policy. Types without an
+	// entry use DefaultRetryPolicy.
+	RetryPolicies      map[string]RetryPolicy
+	DefaultRetryPolicy RetryPolicy
+	// StatusExchange receives a libs.JobEvent whenever a job starts,
+	// finishes, is retried or dead-lettered. Empty disables the events.
+	StatusExchange string
+	// Replies receives the reports of the matches tournament jobs fan out
+	// to Queue. Nil disables tournament jobs.
+	Replies *libs.Replies
+	// MaxTournaments bounds the tournaments played at once, MaxWorkers-1
+	// but at least 1 by default so a goroutine is left to fight their
+	// matches. Tournaments beyond it are postponed.
+	MaxTournaments int
+	// MaxPostponements bounds how often a tournament is postponed, 100 by
+	// default. Beyond it a busy worker uses up an attempt like any other
+	// error, so the tournament is dead-lettered once its retry policy runs
+	// out.
+	MaxPostponements int
+	// TournamentTimeout bounds how long a tournament waits for its
+	// matches, 10m by default.
+	TournamentTimeout time.Duration
+}
+
 type WorkerController struct {
-	maxWorker      int
+	config         WorkerConfig
 	pokemonUsecase *usecase.PokemonUsecase
-	output         *amqp.Channel
+	output         libs.Publisher
+	tournaments    chan struct{}
 }
 
-func NewWorker(maxWorker int, pokemonUsecase *usecase.PokemonUsecase, output *amqp.Channel) *WorkerController {
+func NewWorker(config WorkerConfig, pokemonUsecase *usecase.PokemonUsecase, output libs.Publisher) *WorkerController {
+	if config.ConsumerTag == "" {
+		config.ConsumerTag = "worker"
+	}
+	if config.DefaultRetryPolicy.MaxAttempts <= 0 {
+		config.DefaultRetryPolicy.MaxAttempts = 1
+	}
+	if config.MaxTournaments <= 0 {
+		config.MaxTournaments = max(config.MaxWorkers-1, 1)
+	}
+	if config.MaxPostponements <= 0 {
+		config.MaxPostponements = 100
+	}
+	if config.TournamentTimeout <= 0 {
+		config.TournamentTimeout = 10 * time.Minute
+	}
+
 	return &WorkerController{
-		maxWorker:      maxWorker,
+		config:         config,
 		pokemonUsecase: pokemonUsecase,
 		output:         output,
+		tournaments:    make(chan struct{}, config.MaxTournaments),
 	}
 }
 
-func (c *WorkerController) Start(messages <-chan amqp.Delivery) {
-	for id := range c.maxWorker {
+// Start consumes the job queue and processes deliveries on MaxWorkers
+// goroutines. The returned handle stops and drains them.
+func (c *WorkerController) Start(ctx context.Context, consumer libs.Consumer) (*WorkerHandle, error) {
+	messages, err := consumer.ConsumeContext(ctx, c.config.Queue, c.config.ConsumerTag, libs.ConsumeOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("consume %s: %w", c.config.Queue, err)
+	}
+
+	h := &WorkerHandle{
+		consumer:    consumer,
+		consumerTag: c.config.ConsumerTag,
+		stop:        make(chan struct{}),
+	}
+
+	for id := range c.config.MaxWorkers {
+		h.loops.Add(1)
 		go func(workerID int) {
-			for m := range messages {
+			defer h.loops.Done()
+			for {
+				var m amqp.Delivery
+				var ok bool
+				select {
+				case m, ok = <-messages:
+				case <-h.stop:
+					return
+				}
+				if !ok {
+					return
+				}
+
 				log.Println("worker ", workerID, " processing message ...")
-				go c.processMessage(m)
+				h.inFlight.Add(1)
+				if c.config.Mode == ModeNaive {
+					go func() {
+						defer h.inFlight.Done()
+						c.handleMessage(m)
+					}()
+					continue
+				}
+				c.handleMessage(m)
+				h.inFlight.Done()
 			}
 		}(id)
 	}
+
+	return h, nil
 }
 
-func (c *WorkerController) processMessage(message amqp.Delivery) {
+// handleMessage settles the delivery once processing is over. Successful jobs
+// are acked. Failed jobs are sent to a retry delay queue with an incremented
+// attempt counter, or to the dead-letter queue when the failure is permanent,
+// the job type's retry policy ran out of attempts or the job's deadline
+// passed or would pass before the next attempt. Tournaments a worker has no
+// room for are postponed to the first delay without counting an attempt, up
+// to MaxPostponements times.
+// The original is only acked once the copy was published; otherwise it is
+// requeued so nothing is lost.
+func (c *WorkerController) handleMessage(message amqp.Delivery) {
+	jobsInFlight.Inc()
+	defer jobsInFlight.Dec()
+
+	ctx := context.Background()
+
 	var job Job
 	err := json.Unmarshal(message.Body, &job)
-	if err != nil {
-		log.Printf("error unmarshalling message: %v", err)
+	job = job.withDelivery(message)
+	attempts := libs.Attempts(message) + 1
+
+	started := time.Now()
+	c.emit(ctx, job, libs.JobEvent{Status: libs.JobRunning, Attempt: attempts, At: started})
+
+	switch {
+	case err != nil:
+		err = permanent(fmt.Errorf("unmarshal job: %w", err))
+	case job.Expired(time.Now()):
+		// not worth fetching abilities for a result nobody waits for
+		err = errDeadlineExceeded
+	default:
+		err = c.processJob(ctx, job)
+	}
+
+	if err == nil {
+		c.settle(message.Ack(false))
+		c.emit(ctx, job, libs.JobEvent{
+			Status:   libs.JobDone,
+			Attempt:  attempts,
+			Duration: libs.Duration(time.Since(started)),
+			At:       time.Now(),
+		})
 		return
 	}
 
-	pokemon := c.pokemonUsecase.GeneratePokemon(job.Name)
+	if seed, ok := seedOf(err); ok {
+		job.Seed = &seed
+	}
+	jobType := job.JobType()
+	policy := c.retryPolicy(jobType)
+	delay := policy.delay(attempts)
+	event := libs.JobEvent{
+		Attempt:  attempts,
+		Error:    err.Error(),
+		Duration: libs.Duration(time.Since(started)),
+	}
+
+	switch {
+	case errors.Is(err, errDeadlineExceeded):
+		log.Printf("dead-lettering job %s: %v", job.ID, err)
+		jobDeadLetteredTotal.WithLabelValues(jobType, "deadline").Inc()
+		c.settle(c.deadLetter(ctx, message, job, attempts, err, event))
+	case errors.Is(err, errTournamentBusy) && postponements(message) < c.config.MaxPostponements &&
+		!job.Expired(time.Now().Add(policy.delay(1))):
+		// the job did nothing wrong, so it waits without using up an attempt
+		log.Printf("postponing job %s: %v", job.ID, err)
+		c.settle(c.postpone(ctx, message, job, attempts-1, policy.delay(1), event))
+	case isPermanent(err):
+		log.Printf("dead-lettering message: %v", err)
+		jobDeadLetteredTotal.WithLabelValues(jobType, "permanent").Inc()
+		c.settle(c.deadLetter(ctx, message, job, attempts, err, event))
+	case attempts >= policy.MaxAttempts:
+		log.Printf("dead-lettering message after %d attempt(s): %v", attempts, err)
+		jobDeadLetteredTotal.WithLabelValues(jobType, "max_attempts").Inc()
+		c.settle(c.deadLetter(ctx, message, job, attempts, err, event))
+	case job.Expired(time.Now().Add(delay)):
+		log.Printf("dead-lettering job %s, its deadline passes before the next attempt: %v", job.ID, err)
+		jobDeadLetteredTotal.WithLabelValues(jobType, "deadline").Inc()
+		c.settle(c.deadLetter(ctx, message, job, attempts, fmt.Errorf("%w: %w", errDeadlineExceeded, err), event))
+	default:
+		log.Printf("retrying message (attempt %d/%d): %v", attempts, policy.MaxAttempts, err)
+		c.settle(c.retry(ctx, message, job, attempts, delay, event))
+	}
+}
+
+func (c *WorkerController) retryPolicy(jobType string) RetryPolicy {
+	if p, ok := c.config.RetryPolicies[jobType]; ok {
+		return p
+	}
+	return c.config.DefaultRetryPolicy
+}
+
+// retry publishes the job to the delay queue closest to delay. Without delay
+// queues it goes straight back to the work queue. event is emitted as
+// JobRetrying once the job was republished.
+func (c *WorkerController) retry(ctx context.Context, message amqp.Delivery, job Job, attempts int, delay time.Duration, event libs.JobEvent) error {
+	routingKey, label := c.config.Queue, "0s"
+	if tier, ok := c.config.RetryQueues.TierFor(delay); ok {
+		routingKey, label = tier.Queue, tier.Delay.String()
+	}
+
+	headers := amqp.Table{libs.HeaderAttempts: int32(attempts)}
+	if job.Seed != nil {
+		headers[HeaderSeed] = *job.Seed
+	}
+	msg := libs.Republish(message, headers)
+	// the original TTL counted from the first publish
+	msg.Expiration = job.Expiration(time.Now())
+
+	err := c.output.PublishContext(ctx, "", routingKey, true, msg)
+	if err != nil {
+		log.Printf("error republishing message: %v", err)
+		return message.Nack(false, true)
+	}
+
+	jobRetriesTotal.WithLabelValues(job.JobType(), label).Inc()
+	event.Status, event.At = libs.JobRetrying, time.Now()
+	c.emit(ctx, job, event)
+
+	return message.Ack(false)
+}
+
+// postpone retries the job like retry and counts the postponement in
+// HeaderPostponements.
+func (c *WorkerController) postpone(ctx context.Context, message amqp.Delivery, job Job, attempts int, delay time.Duration, event libs.JobEvent) error {
+	// retry republishes the headers of the delivery, so count on a copy
+	headers := amqp.Table{}
+	maps.Copy(headers, message.Headers)
+	headers[HeaderPostponements] = int32(postponements(message) + 1)
+	message.Headers = headers
+
+	return c.retry(ctx, message, job, attempts, delay, event)
+}
 
-	data, err := json.Marshal(pokemon)
+// deadLetter publishes the job to the dead-letter queue. event is emitted as
+// JobFailed once the job was dead-lettered.
+func (c *WorkerController) deadLetter(ctx context.Context, message amqp.Delivery, job Job, attempts int, reason error, event libs.JobEvent) error {
+	dl := c.config.DeadLetter
+	headers := libs.DeadLetterHeaders(c.config.Queue, attempts, reason)
+
+	msg := libs.Republish(message, headers)
+	// keep dead letters until someone looks at them
+	msg.Expiration = ""
+
+	err := c.output.PublishContext(ctx, dl.Exchange, dl.RoutingKey, true, msg)
 	if err != nil {
-		log.Printf("error marshalling pokemon: %v", err)
+		log.Printf("error dead-lettering message: %v", err)
+		return message.Nack(false, true)
+	}
+
+	// tell a waiting requester not to wait any longer
+	c.reply(ctx, job, amqp.Publishing{
+		Type:    libs.ReplyTypeError,
+		Headers: amqp.Table{libs.HeaderFailureReason: reason.Error()},
+	})
+	event.Status, event.Error, event.At = libs.JobFailed, reason.Error(), time.Now()
+	c.emit(ctx, job, event)
+
+	return message.Ack(false)
+}
+
+// reply sends msg to the job's reply queue, if it has one. Replies are best
+// effort: the requester may have given up and its queue may be gone, so
+// they are not mandatory and failures are only logged.
+func (c *WorkerController) reply(ctx context.Context, job Job, msg amqp.Publishing) {
+	if job.ReplyTo == "" {
 		return
 	}
 
-	err = c.output.Publish(
-		"",                  // exchange
-		"pokemon_generated", // routing key
-		false,               // mandatory
-		false,               // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        data,
-		})
+	msg.MessageId = job.ID
+	msg.CorrelationId = job.CorrelationID
+	if err := c.output.PublishContext(ctx, "", job.ReplyTo, false, msg); err != nil {
+		log.Printf("error replying to job %s: %v", job.ID, err)
+	}
+}
+
+// emit publishes a lifecycle event of job to the status exchange. Like
+// replies, events are best effort and not mandatory: nobody may be listening.
+func (c *WorkerController) emit(ctx context.Context, job Job, event libs.JobEvent) {
+	if c.config.StatusExchange == "" || job.ID == "" {
+		return
+	}
+
+	event.JobID = job.ID
+	event.CorrelationID = job.CorrelationID
+	msg, err := event.Publishing()
 	if err != nil {
-		log.Printf("error publishing message: %v", err)
+		log.Printf("error marshalling %s event of job %s: %v", event.Status, job.ID, err)
 		return
 	}
+	if err := c.output.PublishContext(ctx, c.config.StatusExchange, string(event.Status), false, msg); err != nil {
+		log.Printf("error publishing %s event of job %s: %v", event.Status, job.ID, err)
+	}
+}
+
+func (c *WorkerController) settle(err error) {
+	if err != nil {
+		log.Printf("error settling message: %v", err)
+	}
+}
+
+func (c *WorkerController) processJob(ctx context.Context, job Job) error {
+	var pokemon entity.Pokemon
+	switch job.JobType() {
+	case JobTypeGenerate:
+		opts := job.Options
+		opts.Seed = job.Seed
+		var err error
+		pokemon, err = c.pokemonUsecase.GeneratePokemon(job.Name, opts)
+		if err != nil {
+			return fmt.Errorf("generate pokemon: %w", err)
+		}
+	case JobTypeBreed:
+		if len(job.Parents) != 2 {
+			return permanent(fmt.Errorf("breed needs 2 parents, got %d", len(job.Parents)))
+		}
+		opts := job.Breeding
+		opts.Seed = job.Seed
+		var err error
+		pokemon, err = c.pokemonUsecase.BreedPokemon(job.Name, job.Parents[0], job.Parents[1], opts)
+		if err != nil {
+			// breeding does no I/O, it only fails on invalid parents or options
+			return permanent(fmt.Errorf("breed pokemon: %w", err))
+		}
+	case JobTypeEvolve:
+		return c.evolve(ctx, job)
+	case JobTypeBattle:
+		return c.battle(ctx, job)
+	case JobTypeTournament:
+		return c.tournament(ctx, job)
+	default:
+		return permanent(fmt.Errorf("unknown job type %q", job.Type))
+	}
+
+	return c.publishPokemon(ctx, job, pokemon)
+}
+
+// evolve generates the pokemon of an evolve job and evolves it stage by
+// stage, publishing every stage to pokemon_generated and replying with the
+// last one. All stages use the seed of the generated pokemon, so a retry
+// publishes the same stages again under the same message ids; a job without
+// a seed is retried with the one its first attempt drew.
+func (c *WorkerController) evolve(ctx context.Context, job Job) (err error) {
+	evolution := job.Evolution
+	if n := len(evolution.Names); n == 0 || n > usecase.MaxStage {
+		return permanent(fmt.Errorf("evolve needs 1 to %d names, got %d", usecase.MaxStage, n))
+	}
+	if slices.Contains(evolution.Names, "") {
+		return permanent(errors.New("evolve needs a name for every stage"))
+	}
+
+	opts := job.Options
+	opts.Seed = job.Seed
+	pokemon, err := c.pokemonUsecase.GeneratePokemon(job.Name, opts)
+	if err != nil {
+		return fmt.Errorf("generate pokemon: %w", err)
+	}
+	if job.Seed == nil {
+		seed := pokemon.Seed
+		defer func() {
+			if err != nil {
+				err = withSeed(err, seed)
+			}
+		}()
+	}
+	if _, err := c.publishStage(ctx, job, pokemon); err != nil {
+		return err
+	}
+
+	var data []byte
+	for _, name := range evolution.Names {
+		stage := evolution.EvolveOptions
+		stage.Seed = &pokemon.Seed
+		pokemon, err = c.pokemonUsecase.EvolvePokemon(name, pokemon, stage)
+		if err != nil {
+			return fmt.Errorf("evolve %s: %w", name, err)
+		}
+		if data, err = c.publishStage(ctx, job, pokemon); err != nil {
+			return err
+		}
+	}
+
+	c.reply(ctx, job, amqp.Publishing{
+		ContentType: "application/json",
+		Type:        libs.ReplyTypeResult,
+		Body:        data,
+	})
+	return nil
+}
+
+// battle fights the battles of a battle job, publishes the report to
+// pokemon_battles and replies with it.
+func (c *WorkerController) battle(ctx context.Context, job Job) error {
+	if len(job.Fighters) != 2 {
+		return permanent(fmt.Errorf("battle needs 2 fighters, got %d", len(job.Fighters)))
+	}
+	opts := job.Battle
+	opts.Seed = job.Seed
+	report, err := c.pokemonUsecase.Battle(job.Fighters[0], job.Fighters[1], opts)
+	if err != nil {
+		// battles do no I/O, they only fail on invalid fighters or options
+		return permanent(fmt.Errorf("battle: %w", err))
+	}
+
+	data, err := c.publishResult(ctx, "pokemon_battles", report, amqp.Publishing{
+		MessageId:     job.ID,
+		CorrelationId: job.CorrelationID,
+	})
+	if err != nil {
+		return fmt.Errorf("publish battle: %w", err)
+	}
+
+	c.reply(ctx, job, amqp.Publishing{
+		ContentType: "application/json",
+		Type:        libs.ReplyTypeResult,
+		Body:        data,
+	})
+	return nil
+}
+
+// publishPokemon publishes the result of job to pokemon_generated and replies
+// with it.
+func (c *WorkerController) publishPokemon(ctx context.Context, job Job, pokemon entity.Pokemon) error {
+	data, err := c.publishStage(ctx, job, pokemon)
+	if err != nil {
+		return err
+	}
+
+	c.reply(ctx, job, amqp.Publishing{
+		ContentType: "application/json",
+		Type:        libs.ReplyTypeResult,
+		Body:        data,
+	})
+
+	return nil
+}
+
+// publishStage publishes pokemon to pokemon_generated and returns its JSON.
+// The stages of an evolve job carry their lineage in headers.
+func (c *WorkerController) publishStage(ctx context.Context, job Job, pokemon entity.Pokemon) ([]byte, error) {
+	var headers amqp.Table
+	if job.JobType() == JobTypeEvolve {
+		headers = amqp.Table{
+			HeaderLineage:        job.ID,
+			HeaderEvolutionStage: int32(pokemon.Stage),
+		}
+	}
+
+	data, err := c.publishResult(ctx, "pokemon_generated", pokemon, amqp.Publishing{
+		MessageId:     stageID(job.ID, pokemon.Stage),
+		CorrelationId: job.CorrelationID,
+		Headers:       headers,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("publish pokemon: %w", err)
+	}
+
+	return data, nil
+}
+
+// publishResult publishes result as the persistent JSON body of msg to
+// queue and returns the JSON.
+func (c *WorkerController) publishResult(ctx context.Context, queue string, result any, msg amqp.Publishing) ([]byte, error) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("marshal result: %w", err))
+	}
+
+	msg.ContentType = "application/json"
+	msg.DeliveryMode = amqp.Persistent
+	msg.Body = data
+	if err := c.output.PublishContext(ctx, "", queue, true, msg); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
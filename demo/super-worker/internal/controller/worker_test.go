@@ -0,0 +1,723 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/libs"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/dna"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/battle"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/entity"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/repo"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/usecase"
+	"github.com/streadway/amqp"
+)
+
+// startMemoryWorker wires a worker without a usecase to an in-memory broker
+// with the jobs queue and its dead-letter queue declared. The dead-letter
+// binding is left to the test.
+func startMemoryWorker(t *testing.T) (*libs.MemoryBroker, libs.DeadLetter) {
+	t.Helper()
+	return startMemoryWorkerWith(t, nil)
+}
+
+func startMemoryWorkerWith(t *testing.T, pokemonUsecase *usecase.PokemonUsecase) (*libs.MemoryBroker, libs.DeadLetter) {
+	t.Helper()
+
+	ctx := context.Background()
+	broker := libs.NewMemoryBroker(1)
+	t.Cleanup(broker.Close)
+
+	dl := libs.DeadLetterFor("jobs")
+	for _, q := range []string{"jobs", dl.Queue} {
+		if _, err := broker.QueueDeclareContext(ctx, q); err != nil {
+			t.Fatalf("declare %s: %v", q, err)
+		}
+	}
+
+	startWorker(t, broker, WorkerConfig{
+		MaxWorkers:         1,
+		Mode:               ModeBounded,
+		Queue:              "jobs",
+		DeadLetter:         dl,
+		DefaultRetryPolicy: RetryPolicy{MaxAttempts: 3},
+		StatusExchange:     "jobs.status",
+	}, pokemonUsecase)
+
+	return broker, dl
+}
+
+// startWorker starts a worker on broker that runs until the test ends.
+func startWorker(t *testing.T, broker *libs.MemoryBroker, config WorkerConfig, pokemonUsecase *usecase.PokemonUsecase) *WorkerController {
+	t.Helper()
+
+	worker := NewWorker(config, pokemonUsecase, broker)
+	handle, err := worker.Start(context.Background(), broker)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { handle.Stop(context.Background()) })
+
+	return worker
+}
+
+// settlementConsumer hands out the deliveries of a consumer with an
+// acknowledger that records how each one was settled before settling it.
+type settlementConsumer struct {
+	libs.Consumer
+	settled chan string
+}
+
+func (r *settlementConsumer) ConsumeContext(ctx context.Context, queue, consumer string, opts libs.ConsumeOptions) (<-chan amqp.Delivery, error) {
+	in, err := r.Consumer.ConsumeContext(ctx, queue, consumer, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan amqp.Delivery)
+	go func() {
+		defer close(out)
+		for d := range in {
+			d.Acknowledger = &settlementRecorder{Acknowledger: d.Acknowledger, settled: r.settled}
+			out <- d
+		}
+	}()
+	return out, nil
+}
+
+type settlementRecorder struct {
+	amqp.Acknowledger
+	settled chan string
+}
+
+func (a *settlementRecorder) record(how string) {
+	// a job requeued over and over must not block the worker
+	select {
+	case a.settled <- how:
+	default:
+	}
+}
+
+func (a *settlementRecorder) Ack(tag uint64, multiple bool) error {
+	a.record("ack")
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+func (a *settlementRecorder) Nack(tag uint64, multiple, requeue bool) error {
+	a.record(fmt.Sprintf("nack requeue=%t", requeue))
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a *settlementRecorder) Reject(tag uint64, requeue bool) error {
+	a.record(fmt.Sprintf("reject requeue=%t", requeue))
+	return a.Acknowledger.Reject(tag, requeue)
+}
+
+// startRecordedWorker starts a worker on broker like startWorker and
+// returns how it settles its deliveries, in order.
+func startRecordedWorker(t *testing.T, broker *libs.MemoryBroker, config WorkerConfig, pokemonUsecase *usecase.PokemonUsecase) <-chan string {
+	t.Helper()
+
+	consumer := &settlementConsumer{Consumer: broker, settled: make(chan string, 10)}
+	worker := NewWorker(config, pokemonUsecase, broker)
+	handle, err := worker.Start(context.Background(), consumer)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { handle.Stop(context.Background()) })
+
+	return consumer.settled
+}
+
+func waitForSettlement(t *testing.T, settled <-chan string) string {
+	t.Helper()
+
+	select {
+	case how := <-settled:
+		return how
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a delivery to be settled")
+		return ""
+	}
+}
+
+func waitForMessage(t *testing.T, broker *libs.MemoryBroker, queue string) amqp.Delivery {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if d, ok := broker.Get(queue); ok {
+			return d
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for a message in %s", queue)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWorkerAcksJobsOncePublished(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ember":1}`))
+	}))
+	t.Cleanup(server.Close)
+
+	ctx := context.Background()
+	broker := libs.NewMemoryBroker(1)
+	t.Cleanup(broker.Close)
+	for _, q := range []string{"jobs", "pokemon_generated"} {
+		if _, err := broker.QueueDeclareContext(ctx, q); err != nil {
+			t.Fatalf("declare %s: %v", q, err)
+		}
+	}
+	settled := startRecordedWorker(t, broker, WorkerConfig{
+		MaxWorkers:         1,
+		Mode:               ModeBounded,
+		Queue:              "jobs",
+		DefaultRetryPolicy: RetryPolicy{MaxAttempts: 3},
+	}, usecase.NewPokemonUsecase(repo.NewPokemon(server.URL, 0), nil, dna.Naive))
+
+	if err := broker.PublishContext(ctx, "", "jobs", true, amqp.Publishing{MessageId: "job-1", Body: []byte(`{"name":"pikachu","seed":1}`)}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	if how := waitForSettlement(t, settled); how != "ack" {
+		t.Fatalf("settled the job with %s, want ack", how)
+	}
+	if d := waitForMessage(t, broker, "pokemon_generated"); d.MessageId != "job-1" {
+		t.Fatalf("published %q", d.MessageId)
+	}
+	if n := broker.Len("jobs") + broker.Unacked("jobs"); n != 0 {
+		t.Fatalf("%d job(s) left in the queue", n)
+	}
+}
+
+func TestWorkerRequeuesFailedJobsItCannotRetry(t *testing.T) {
+	// the ability server is down, so the job fails for now
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(server.Close)
+
+	ctx := context.Background()
+	broker := libs.NewMemoryBroker(1)
+	t.Cleanup(broker.Close)
+	if _, err := broker.QueueDeclareContext(ctx, "jobs"); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+
+	// the delay queue is not declared yet, so the retry is unroutable
+	retryQueues := libs.RetryQueues{Queue: "jobs", Tiers: []libs.RetryTier{{Delay: time.Second, Queue: "jobs.retry.1s"}}}
+	settled := startRecordedWorker(t, broker, WorkerConfig{
+		MaxWorkers:         1,
+		Mode:               ModeBounded,
+		Queue:              "jobs",
+		RetryQueues:        retryQueues,
+		DefaultRetryPolicy: RetryPolicy{MaxAttempts: 3, Delays: []time.Duration{time.Second}},
+	}, usecase.NewPokemonUsecase(repo.NewPokemon(server.URL, 0), nil, dna.Naive))
+
+	if err := broker.PublishContext(ctx, "", "jobs", true, amqp.Publishing{MessageId: "job-1", Body: []byte(`{"name":"pikachu","seed":1}`)}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if how := waitForSettlement(t, settled); how != "nack requeue=true" {
+		t.Fatalf("settled the job with %s, want a requeue", how)
+	}
+
+	// the requeued job did not use up an attempt
+	if _, err := broker.QueueDeclareContext(ctx, "jobs.retry.1s"); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+	d := waitForMessage(t, broker, "jobs.retry.1s")
+	if d.MessageId != "job-1" || libs.Attempts(d) != 1 {
+		t.Fatalf("retried %q after %d attempt(s), want job-1 after 1", d.MessageId, libs.Attempts(d))
+	}
+}
+
+func TestWorkerDeadLettersJobsItCannotDecode(t *testing.T) {
+	ctx := context.Background()
+	broker := libs.NewMemoryBroker(1)
+	t.Cleanup(broker.Close)
+
+	dl := libs.DeadLetterFor("jobs")
+	for _, q := range []string{"jobs", dl.Queue} {
+		if _, err := broker.QueueDeclareContext(ctx, q); err != nil {
+			t.Fatalf("declare %s: %v", q, err)
+		}
+	}
+	if err := broker.QueueBindContext(ctx, dl.Queue, dl.RoutingKey, dl.Exchange); err != nil {
+		t.Fatalf("bind dead letter: %v", err)
+	}
+	settled := startRecordedWorker(t, broker, WorkerConfig{
+		MaxWorkers:         1,
+		Mode:               ModeBounded,
+		Queue:              "jobs",
+		DeadLetter:         dl,
+		DefaultRetryPolicy: RetryPolicy{MaxAttempts: 3},
+	}, nil)
+
+	if err := broker.PublishContext(ctx, "", "jobs", true, amqp.Publishing{Body: []byte("not json")}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	// the copy in the dead-letter queue replaces the job
+	if how := waitForSettlement(t, settled); how != "ack" {
+		t.Fatalf("settled the job with %s, want ack", how)
+	}
+	d := waitForMessage(t, broker, dl.Queue)
+	if string(d.Body) != "not json" || libs.Attempts(d) != 1 {
+		t.Fatalf("dead-lettered %q after %d attempt(s)", d.Body, libs.Attempts(d))
+	}
+	if n := broker.Len("jobs") + broker.Unacked("jobs"); n != 0 {
+		t.Fatalf("%d job(s) left in the queue", n)
+	}
+}
+
+func TestBoundedWorkerRunsAtMostMaxWorkersJobs(t *testing.T) {
+	// ability lookups block until released and count the jobs running
+	var mu sync.Mutex
+	running, most := 0, 0
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		<-release
+		w.Write([]byte(`{"ember":1}`))
+	}))
+	t.Cleanup(server.Close)
+
+	ctx := context.Background()
+	const maxWorkers = 3
+	broker := libs.NewMemoryBroker(maxWorkers)
+	t.Cleanup(broker.Close)
+	for _, q := range []string{"jobs", "pokemon_generated"} {
+		if _, err := broker.QueueDeclareContext(ctx, q); err != nil {
+			t.Fatalf("declare %s: %v", q, err)
+		}
+	}
+	startWorker(t, broker, WorkerConfig{
+		MaxWorkers:         maxWorkers,
+		Mode:               ModeBounded,
+		Queue:              "jobs",
+		DefaultRetryPolicy: RetryPolicy{MaxAttempts: 3},
+	}, usecase.NewPokemonUsecase(repo.NewPokemon(server.URL, 0), nil, dna.Naive))
+	// let the worker drain when the test ends early
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	t.Cleanup(unblock)
+
+	const jobs = 10
+	for i := range jobs {
+		body := fmt.Sprintf(`{"name":"pikachu","seed":%d}`, i+1)
+		if err := broker.PublishContext(ctx, "", "jobs", true, amqp.Publishing{Body: []byte(body)}); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	// the worker fills up and stays full while the jobs block
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := running
+		mu.Unlock()
+		if n == maxWorkers {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d job(s) running, want %d", n, maxWorkers)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := broker.Unacked("jobs"); n != maxWorkers {
+		t.Fatalf("%d job(s) delivered and not settled, want %d", n, maxWorkers)
+	}
+
+	unblock()
+	for range jobs {
+		waitForMessage(t, broker, "pokemon_generated")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if most != maxWorkers {
+		t.Fatalf("at most %d job(s) ran at once, want %d", most, maxWorkers)
+	}
+}
+
+func TestWorkerDeadLettersUnknownJobTypes(t *testing.T) {
+	broker, dl := startMemoryWorker(t)
+	ctx := context.Background()
+
+	if err := broker.QueueBindContext(ctx, dl.Queue, dl.RoutingKey, dl.Exchange); err != nil {
+		t.Fatalf("bind dead letter: %v", err)
+	}
+	if err := broker.PublishContext(ctx, "", "jobs", true, amqp.Publishing{Body: []byte(`{"type":"teleport","name":"pika"}`)}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	d := waitForMessage(t, broker, dl.Queue)
+	if got := d.Headers[libs.HeaderOriginalQueue]; got != "jobs" {
+		t.Errorf("%s = %v, want %q", libs.HeaderOriginalQueue, got, "jobs")
+	}
+	if got := libs.Attempts(d); got != 1 {
+		t.Errorf("attempts = %d, want 1", got)
+	}
+	if n := broker.Len("jobs") + broker.Unacked("jobs"); n != 0 {
+		t.Errorf("original job was not acked, %d message(s) left", n)
+	}
+}
+
+func TestWorkerDeadLettersBreedJobsWithoutTwoParents(t *testing.T) {
+	broker, dl := startMemoryWorker(t)
+	ctx := context.Background()
+
+	if err := broker.QueueBindContext(ctx, dl.Queue, dl.RoutingKey, dl.Exchange); err != nil {
+		t.Fatalf("bind dead letter: %v", err)
+	}
+	body := []byte(`{"type":"breed","name":"pichu","parents":[{"name":"pikachu","dna":"ATCG"}]}`)
+	if err := broker.PublishContext(ctx, "", "jobs", true, amqp.Publishing{Body: body}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	d := waitForMessage(t, broker, dl.Queue)
+	if got := libs.Attempts(d); got != 1 {
+		t.Errorf("attempts = %d, want 1 for a permanent failure", got)
+	}
+}
+
+func TestWorkerPublishesEveryEvolutionStage(t *testing.T) {
+	// every ability lookup returns the same ability
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ember":1}`))
+	}))
+	t.Cleanup(server.Close)
+
+	broker, _ := startMemoryWorkerWith(t, usecase.NewPokemonUsecase(repo.NewPokemon(server.URL, 0), nil, dna.Naive))
+	ctx := context.Background()
+
+	for _, q := range []string{"pokemon_generated", "replies"} {
+		if _, err := broker.QueueDeclareContext(ctx, q); err != nil {
+			t.Fatalf("declare %s: %v", q, err)
+		}
+	}
+	body := []byte(`{"type":"evolve","name":"charmander","seed":1,"options":{"dna_length":300},"evolution":{"names":["charmeleon","charizard"]}}`)
+	msg := amqp.Publishing{MessageId: "job-1", ReplyTo: "replies", Body: body}
+	if err := broker.PublishContext(ctx, "", "jobs", true, msg); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	var last entity.Pokemon
+	for stage, name := range []string{"charmander", "charmeleon", "charizard"} {
+		d := waitForMessage(t, broker, "pokemon_generated")
+		if err := json.Unmarshal(d.Body, &last); err != nil {
+			t.Fatalf("decode stage %d: %v", stage, err)
+		}
+		if last.Name != name || last.Stage != stage || len(last.Lineage) != stage {
+			t.Errorf("stage %d is %s at stage %d with lineage %v", stage, last.Name, last.Stage, last.Lineage)
+		}
+		if d.Headers[HeaderLineage] != "job-1" || d.Headers[HeaderEvolutionStage] != int32(stage) {
+			t.Errorf("stage %d has headers %v", stage, d.Headers)
+		}
+		if want := stageID("job-1", stage); d.MessageId != want {
+			t.Errorf("stage %d has message id %q, want %q", stage, d.MessageId, want)
+		}
+	}
+
+	reply := waitForMessage(t, broker, "replies")
+	var replied entity.Pokemon
+	if err := json.Unmarshal(reply.Body, &replied); err != nil || replied.Name != "charizard" {
+		t.Fatalf("replied with %s: %v", reply.Body, err)
+	}
+	if broker.Len("replies") != 0 {
+		t.Fatal("replied more than once")
+	}
+}
+
+func TestWorkerRetriesEvolveJobsWithTheSeedTheyDrew(t *testing.T) {
+	// lookups of evolved forms, the only ones with a limit, fail for now
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("limit") {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"ember":1}`))
+	}))
+	t.Cleanup(server.Close)
+
+	pokemonUsecase := usecase.NewPokemonUsecase(repo.NewPokemon(server.URL, 0), rand.NewSource(1), dna.Naive)
+	broker, dl := startMemoryWorkerWith(t, pokemonUsecase)
+	ctx := context.Background()
+
+	if _, err := broker.QueueDeclareContext(ctx, "pokemon_generated"); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+	if err := broker.QueueBindContext(ctx, dl.Queue, dl.RoutingKey, dl.Exchange); err != nil {
+		t.Fatalf("bind dead letter: %v", err)
+	}
+	body := []byte(`{"type":"evolve","name":"charmander","evolution":{"names":["charmeleon"],"levels":40,"ability_limit":2}}`)
+	if err := broker.PublishContext(ctx, "", "jobs", true, amqp.Publishing{MessageId: "job-1", Body: body}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	d := waitForMessage(t, broker, dl.Queue)
+	seed, ok := d.Headers[HeaderSeed].(int64)
+	if !ok || libs.Attempts(d) != 3 {
+		t.Fatalf("dead-lettered after %d attempt(s) with headers %v", libs.Attempts(d), d.Headers)
+	}
+
+	// every attempt published the same first stage
+	first := waitForMessage(t, broker, "pokemon_generated")
+	for attempt := 2; attempt <= 3; attempt++ {
+		if d := waitForMessage(t, broker, "pokemon_generated"); string(d.Body) != string(first.Body) {
+			t.Fatalf("attempt %d published %s, the first one %s", attempt, d.Body, first.Body)
+		}
+	}
+	var pokemon entity.Pokemon
+	if err := json.Unmarshal(first.Body, &pokemon); err != nil || pokemon.Seed != seed {
+		t.Fatalf("published %s for seed %d: %v", first.Body, seed, err)
+	}
+}
+
+func TestWorkerPublishesBattleReports(t *testing.T) {
+	// battles need no ability server
+	broker, dl := startMemoryWorkerWith(t, usecase.NewPokemonUsecase(nil, nil, dna.Naive))
+	ctx := context.Background()
+
+	if _, err := broker.QueueDeclareContext(ctx, "pokemon_battles"); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+	if err := broker.QueueBindContext(ctx, dl.Queue, dl.RoutingKey, dl.Exchange); err != nil {
+		t.Fatalf("bind dead letter: %v", err)
+	}
+
+	fighter := `{"name":"%s","types":["%s"],"level":50,"stats":{"base_lv":50,"hp":100,"attack":100,"defense":100,"special_attack":100,"special_defense":100,"speed":%d}}`
+	body := fmt.Sprintf(`{"type":"battle","name":"match","seed":3,"battle":{"rounds":5},"fighters":[%s,%s]}`,
+		fmt.Sprintf(fighter, "squirtle", "water", 90), fmt.Sprintf(fighter, "charmander", "fire", 110))
+	if err := broker.PublishContext(ctx, "", "jobs", true, amqp.Publishing{MessageId: "job-1", Body: []byte(body)}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	d := waitForMessage(t, broker, "pokemon_battles")
+	var report battle.Report
+	if err := json.Unmarshal(d.Body, &report); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	if d.MessageId != "job-1" || report.Seed != 3 || report.Rounds != 5 || report.Fighters != [2]string{"squirtle", "charmander"} {
+		t.Fatalf("message %q has report %+v", d.MessageId, report)
+	}
+
+	// one fighter is not a battle
+	body = fmt.Sprintf(`{"type":"battle","name":"match","fighters":[%s]}`, fmt.Sprintf(fighter, "squirtle", "water", 90))
+	if err := broker.PublishContext(ctx, "", "jobs", true, amqp.Publishing{Body: []byte(body)}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if d := waitForMessage(t, broker, dl.Queue); libs.Attempts(d) != 1 {
+		t.Errorf("attempts = %d, want 1 for a permanent failure", libs.Attempts(d))
+	}
+}
+
+func TestWorkerRetriesThroughTheDelayQueueOfThePolicy(t *testing.T) {
+	// the ability server is down, so every generate job fails for now
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(server.Close)
+
+	ctx := context.Background()
+	broker := libs.NewMemoryBroker(1)
+	t.Cleanup(broker.Close)
+
+	retryQueues := libs.RetryQueues{Queue: "jobs"}
+	for _, delay := range []time.Duration{time.Second, 5 * time.Second, time.Minute} {
+		tier := libs.RetryTier{Delay: delay, Queue: libs.RetryQueueName("jobs", delay)}
+		retryQueues.Tiers = append(retryQueues.Tiers, tier)
+	}
+	for _, q := range []string{"jobs", "jobs.retry.1s", "jobs.retry.5s", "jobs.retry.60s"} {
+		if _, err := broker.QueueDeclareContext(ctx, q); err != nil {
+			t.Fatalf("declare %s: %v", q, err)
+		}
+	}
+
+	startWorker(t, broker, WorkerConfig{
+		MaxWorkers:         1,
+		Mode:               ModeBounded,
+		Queue:              "jobs",
+		DeadLetter:         libs.DeadLetterFor("jobs"),
+		RetryQueues:        retryQueues,
+		DefaultRetryPolicy: RetryPolicy{MaxAttempts: 5, Delays: []time.Duration{time.Second}},
+		RetryPolicies: map[string]RetryPolicy{
+			JobTypeGenerate: {MaxAttempts: 5, Delays: []time.Duration{time.Second, 5 * time.Second}},
+		},
+	}, usecase.NewPokemonUsecase(repo.NewPokemon(server.URL, 0), nil, dna.Naive))
+
+	// the second attempt waits for the second delay of the generate policy
+	msg := amqp.Publishing{
+		MessageId: "job-1",
+		Headers:   amqp.Table{libs.HeaderAttempts: int32(1)},
+		Body:      []byte(`{"type":"generate","name":"pikachu","seed":1}`),
+	}
+	if err := broker.PublishContext(ctx, "", "jobs", true, msg); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	d := waitForMessage(t, broker, "jobs.retry.5s")
+	if d.MessageId != "job-1" || libs.Attempts(d) != 2 {
+		t.Fatalf("retried %q after %d attempt(s), want job-1 after 2", d.MessageId, libs.Attempts(d))
+	}
+	if n := broker.Len("jobs.retry.1s") + broker.Len("jobs.retry.60s"); n != 0 {
+		t.Fatalf("%d job(s) in the other delay queues", n)
+	}
+}
+
+func TestWorkerRequeuesJobWhenDeadLetterIsUnroutable(t *testing.T) {
+	broker, dl := startMemoryWorker(t)
+	ctx := context.Background()
+
+	// without a binding the dead-letter publish is returned, so the worker
+	// must hand the job back instead of acking it
+	if err := broker.PublishContext(ctx, "", "jobs", true, amqp.Publishing{Body: []byte("not json")}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := broker.Len(dl.Queue); n != 0 {
+		t.Fatalf("%d message(s) reached the unbound dead-letter queue", n)
+	}
+
+	if err := broker.QueueBindContext(ctx, dl.Queue, dl.RoutingKey, dl.Exchange); err != nil {
+		t.Fatalf("bind dead letter: %v", err)
+	}
+
+	d := waitForMessage(t, broker, dl.Queue)
+	if string(d.Body) != "not json" {
+		t.Fatalf("dead-lettered %q, want the original body", d.Body)
+	}
+}
+
+func TestWorkerDeadLettersJobsPastTheirDeadline(t *testing.T) {
+	broker, dl := startMemoryWorker(t)
+	ctx := context.Background()
+
+	if err := broker.QueueBindContext(ctx, dl.Queue, dl.RoutingKey, dl.Exchange); err != nil {
+		t.Fatalf("bind dead letter: %v", err)
+	}
+
+	// the worker has no usecase, so processing the job would panic
+	body := []byte(`{"name":"pika","deadline":"2001-01-01T00:00:00Z"}`)
+	msg := amqp.Publishing{MessageId: "job-1", CorrelationId: "req-1", Expiration: "60000", Body: body}
+	if err := broker.PublishContext(ctx, "", "jobs", true, msg); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	d := waitForMessage(t, broker, dl.Queue)
+	if reason, _ := d.Headers[libs.HeaderFailureReason].(string); reason != errDeadlineExceeded.Error() {
+		t.Errorf("%s = %q, want %q", libs.HeaderFailureReason, reason, errDeadlineExceeded)
+	}
+	if d.MessageId != "job-1" || d.CorrelationId != "req-1" {
+		t.Errorf("dead letter lost the job ids: message id %q, correlation id %q", d.MessageId, d.CorrelationId)
+	}
+	if d.Expiration != "" {
+		t.Errorf("dead letter would expire after %sms", d.Expiration)
+	}
+}
+
+func TestWorkerRepliesWhenJobIsDeadLettered(t *testing.T) {
+	broker, dl := startMemoryWorker(t)
+	ctx := context.Background()
+
+	if _, err := broker.QueueDeclareContext(ctx, "replies"); err != nil {
+		t.Fatalf("declare replies: %v", err)
+	}
+	if err := broker.QueueBindContext(ctx, dl.Queue, dl.RoutingKey, dl.Exchange); err != nil {
+		t.Fatalf("bind dead letter: %v", err)
+	}
+
+	body := []byte(`{"name":"pika","deadline":"2001-01-01T00:00:00Z"}`)
+	msg := amqp.Publishing{MessageId: "job-1", CorrelationId: "req-1", ReplyTo: "replies", Body: body}
+	if err := broker.PublishContext(ctx, "", "jobs", true, msg); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	d := waitForMessage(t, broker, "replies")
+	if d.Type != libs.ReplyTypeError || d.CorrelationId != "req-1" {
+		t.Fatalf("reply type %q, correlation id %q, want an error reply to req-1", d.Type, d.CorrelationId)
+	}
+	if reason, _ := d.Headers[libs.HeaderFailureReason].(string); reason != errDeadlineExceeded.Error() {
+		t.Errorf("%s = %q, want %q", libs.HeaderFailureReason, reason, errDeadlineExceeded)
+	}
+}
+
+func TestWorkerEmitsJobEvents(t *testing.T) {
+	broker, dl := startMemoryWorker(t)
+	ctx := context.Background()
+
+	if err := broker.QueueBindContext(ctx, dl.Queue, dl.RoutingKey, dl.Exchange); err != nil {
+		t.Fatalf("bind dead letter: %v", err)
+	}
+	if _, err := broker.QueueDeclareContext(ctx, "events"); err != nil {
+		t.Fatalf("declare events: %v", err)
+	}
+	for _, status := range libs.JobStatuses {
+		if err := broker.QueueBindContext(ctx, "events", string(status), "jobs.status"); err != nil {
+			t.Fatalf("bind events: %v", err)
+		}
+	}
+
+	msg := amqp.Publishing{MessageId: "job-1", CorrelationId: "req-1", Body: []byte(`{"type":"teleport","name":"pika"}`)}
+	if err := broker.PublishContext(ctx, "", "jobs", true, msg); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	var events []libs.JobEvent
+	for range 2 {
+		e, err := libs.ParseJobEvent(waitForMessage(t, broker, "events"))
+		if err != nil {
+			t.Fatalf("parse event: %v", err)
+		}
+		events = append(events, e)
+	}
+	if events[0].Status != libs.JobRunning || events[1].Status != libs.JobFailed {
+		t.Fatalf("events = %+v, want running then failed", events)
+	}
+	if e := events[1]; e.JobID != "job-1" || e.CorrelationID != "req-1" || e.Attempt != 1 || e.Error == "" {
+		t.Errorf("failed event = %+v", e)
+	}
+}
+
+func TestJobDeadline(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	job := Job{Name: "pika"}
+	if job.Expired(now) || job.Expiration(now) != "" {
+		t.Fatal("job without deadline expired")
+	}
+
+	job.Deadline = now.Add(1500 * time.Millisecond)
+	if job.Expired(now) {
+		t.Fatal("job expired before its deadline")
+	}
+	if got := job.Expiration(now); got != "1500" {
+		t.Fatalf("expiration = %q, want %q", got, "1500")
+	}
+	if !job.Expired(job.Deadline) || job.Expiration(now.Add(time.Hour)) != "0" {
+		t.Fatal("job not expired at its deadline")
+	}
+
+	job = Job{Name: "pika"}.withDelivery(amqp.Delivery{MessageId: "job-1", CorrelationId: "req-1", ReplyTo: "replies", Priority: 7})
+	if job.ID != "job-1" || job.CorrelationID != "req-1" || job.ReplyTo != "replies" || job.Priority != 7 {
+		t.Fatalf("ids and priority not taken from the delivery: %+v", job)
+	}
+}
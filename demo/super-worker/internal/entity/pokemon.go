@@ -1,8 +1,18 @@
 package entity
 
+// Pokemon is a generated pokemon. Generating Name with Seed again gives the
+// same pokemon. Evolved pokemon have a Stage above 0 and list the names of
+// their previous forms, oldest first, in Lineage. Types holds the primary
+// element and, if it has one, the secondary element. Ability lists the
+// names of Abilities in order.
 type Pokemon struct {
 	Name      string         `json:"name"`
+	Seed      int64          `json:"seed"`
 	DNA       string         `json:"dna"`
+	Types     []string       `json:"types"`
+	Level     int            `json:"level"`
+	Stage     int            `json:"stage,omitempty"`
+	Lineage   []string       `json:"lineage,omitempty"`
 	Ability   []string       `json:"ability"`
 	Stats     Stats          `json:"stats"`
 	Abilities map[string]int `json:"abilities"`
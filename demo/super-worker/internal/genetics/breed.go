@@ -0,0 +1,102 @@
+package genetics
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// Crossover selects how a parent's two chromosomes are recombined into the
+// one it passes on.
+type Crossover string
+
+const (
+	// CrossoverSinglePoint takes the codons before a random point from one
+	// chromosome and the rest from the other.
+	CrossoverSinglePoint Crossover = "single_point"
+	// CrossoverUniform takes every codon from either chromosome with equal
+	// chance.
+	CrossoverUniform Crossover = "uniform"
+)
+
+func ParseCrossover(s string) (Crossover, error) {
+	switch Crossover(s) {
+	case "", CrossoverSinglePoint:
+		return CrossoverSinglePoint, nil
+	case CrossoverUniform:
+		return CrossoverUniform, nil
+	default:
+		return "", fmt.Errorf("unknown crossover %q", s)
+	}
+}
+
+// Breed returns the DNA of an offspring of the parents a and b. Each parent
+// passes on one chromosome, recombined from its own two by crossover, which
+// become the first and second chromosome of the offspring. Then every base
+// mutates into another with probability mutationRate. Parents of different
+// lengths pass on chromosomes as long as the shorter one's, which keeps
+// their coding genes.
+func Breed(a, b string, crossover Crossover, mutationRate float64, rng *rand.Rand) (string, error) {
+	crossover, err := ParseCrossover(string(crossover))
+	if err != nil {
+		return "", err
+	}
+	if mutationRate < 0 || mutationRate > 1 {
+		return "", fmt.Errorf("mutation rate %v is not between 0 and 1", mutationRate)
+	}
+	for i, parent := range []string{a, b} {
+		if _, err := Decode(parent); err != nil {
+			return "", fmt.Errorf("parent %d: %w", i+1, err)
+		}
+	}
+
+	length := min(len(a), len(b)) / 2
+	if length == 0 {
+		return "", errors.New("parents have no chromosomes")
+	}
+
+	child := make([]byte, 0, 2*length)
+	child = gamete(child, a, length, crossover, rng)
+	child = gamete(child, b, length, crossover, rng)
+	Mutate(child, mutationRate, rng)
+	return string(child), nil
+}
+
+// gamete appends the first length bases of the chromosome dna passes on.
+func gamete(dst []byte, dna string, length int, crossover Crossover, rng *rand.Rand) []byte {
+	half := len(dna) / 2
+	chromosomes := [2]string{dna[:half][:length], dna[half : 2*half][:length]}
+	codons := (length + CodonLength - 1) / CodonLength
+
+	// which chromosome starts, so either can end up in front of the point
+	from := rng.Intn(2)
+	point := rng.Intn(codons + 1)
+	for i := range codons {
+		switch crossover {
+		case CrossoverSinglePoint:
+			if i == point {
+				from = 1 - from
+			}
+		case CrossoverUniform:
+			from = rng.Intn(2)
+		}
+		end := min((i+1)*CodonLength, length)
+		dst = append(dst, chromosomes[from][i*CodonLength:end]...)
+	}
+	return dst
+}
+
+// Mutate replaces every base of dna with one of the other three with
+// probability rate.
+func Mutate(dna []byte, rate float64, rng *rand.Rand) {
+	if rate <= 0 {
+		return
+	}
+	for i, b := range dna {
+		if rng.Float64() >= rate {
+			continue
+		}
+		d, _ := base(b)
+		dna[i] = "ATCG"[(int(d)+1+rng.Intn(3))%4]
+	}
+}
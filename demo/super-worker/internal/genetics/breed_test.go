@@ -0,0 +1,112 @@
+package genetics
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestBreedPassesOnOneChromosomeOfEachParent(t *testing.T) {
+	for _, crossover := range []Crossover{CrossoverSinglePoint, CrossoverUniform} {
+		f := func(a, b dna, seed int64) bool {
+			child, err := Breed(string(a), string(b), crossover, 0, rand.New(rand.NewSource(seed)))
+			length := min(len(a), len(b)) / 2
+			if length == 0 {
+				return err != nil
+			}
+			if err != nil || len(child) != 2*length {
+				return false
+			}
+
+			for p, parent := range []dna{a, b} {
+				half := len(parent) / 2
+				got := child[p*length : (p+1)*length]
+				from, switches := -1, 0
+				for i := 0; i < length; i += CodonLength {
+					end := min(i+CodonLength, length)
+					codon := got[i:end]
+					inFirst := codon == string(parent[i:end])
+					inSecond := codon == string(parent[half+i:half+end])
+					if !inFirst && !inSecond {
+						t.Logf("%s: codon %d of parent %d is from neither chromosome", crossover, i/CodonLength, p+1)
+						return false
+					}
+					// count the switches that cannot be explained otherwise
+					if !(inFirst && inSecond) {
+						now := 0
+						if inSecond {
+							now = 1
+						}
+						if from != -1 && now != from {
+							switches++
+						}
+						from = now
+					}
+				}
+				if crossover == CrossoverSinglePoint && switches > 1 {
+					t.Logf("single point crossover switched %d times", switches)
+					return false
+				}
+			}
+			return true
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Fatalf("%s: %v", crossover, err)
+		}
+	}
+}
+
+func TestBreedIsReproducible(t *testing.T) {
+	a := strings.Repeat("GATTACA", 100)
+	b := strings.Repeat("CATG", 150)
+
+	first, err := Breed(a, b, CrossoverUniform, 0.05, rand.New(rand.NewSource(7)))
+	if err != nil {
+		t.Fatalf("breed: %v", err)
+	}
+	second, _ := Breed(a, b, CrossoverUniform, 0.05, rand.New(rand.NewSource(7)))
+	if first != second {
+		t.Fatal("the same seed bred different offspring")
+	}
+	if _, err := Decode(first); err != nil {
+		t.Fatalf("offspring DNA is invalid: %v", err)
+	}
+}
+
+func TestBreedRejectsInvalidInput(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	valid := strings.Repeat("ATCG", 30)
+
+	for name, breed := range map[string]func() error{
+		"crossover":      func() error { _, err := Breed(valid, valid, "two_point", 0, rng); return err },
+		"mutation rate":  func() error { _, err := Breed(valid, valid, "", 1.5, rng); return err },
+		"invalid parent": func() error { _, err := Breed(valid, "ATCX", "", 0, rng); return err },
+		"empty parent":   func() error { _, err := Breed(valid, "A", "", 0, rng); return err },
+	} {
+		if breed() == nil {
+			t.Errorf("%s: bred anyway", name)
+		}
+	}
+}
+
+func TestMutate(t *testing.T) {
+	f := func(d dna, seed int64) bool {
+		rng := rand.New(rand.NewSource(seed))
+
+		same := []byte(d)
+		Mutate(same, 0, rng)
+		all := []byte(d)
+		Mutate(all, 1, rng)
+
+		for i := range all {
+			if same[i] != d[i] || all[i] == d[i] || !strings.ContainsRune("ATCG", rune(all[i])) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
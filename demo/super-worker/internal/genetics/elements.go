@@ -0,0 +1,92 @@
+package genetics
+
+import "fmt"
+
+// Element is an elemental type of a pokemon.
+type Element string
+
+const (
+	Normal   Element = "normal"
+	Fire     Element = "fire"
+	Water    Element = "water"
+	Grass    Element = "grass"
+	Electric Element = "electric"
+	Ice      Element = "ice"
+	Ground   Element = "ground"
+	Flying   Element = "flying"
+	Psychic  Element = "psychic"
+	Rock     Element = "rock"
+	Ghost    Element = "ghost"
+	Dragon   Element = "dragon"
+)
+
+// Elements lists every element in the order element genes index them.
+var Elements = []Element{Normal, Fire, Water, Grass, Electric, Ice, Ground, Flying, Psychic, Rock, Ghost, Dragon}
+
+// ElementGenes is the number of genes after the coding genes that decide
+// the elements.
+const ElementGenes = 8
+
+func ParseElement(s string) (Element, error) {
+	for _, e := range Elements {
+		if string(e) == s {
+			return e, nil
+		}
+	}
+	return "", fmt.Errorf("unknown element %q", s)
+}
+
+// Element is the element the gene votes for, picked by its expressed allele:
+// the dominant one, or the stronger one when both or neither are.
+func (g Gene) Element() Element {
+	return Elements[g.element()]
+}
+
+func (g Gene) element() int {
+	a, b := g.Alleles[0], g.Alleles[1]
+	if b.Dominant() && !a.Dominant() || a.Dominant() == b.Dominant() && b.Strength() > a.Strength() {
+		a = b
+	}
+	return int(a) % len(Elements)
+}
+
+// Types returns the primary element of the genome and its secondary element,
+// or "" if it has none. Every element gene votes for its Element with its
+// expression plus one. The element with the most votes is the primary, the
+// runner-up is the secondary if it got at least half as many. Ties go to the
+// element listed first. A genome without element genes is Normal.
+func (g Genome) Types() (primary, secondary Element) {
+	votes := make([]int, len(Elements))
+	for i := CodingGenes; i < CodingGenes+ElementGenes && i < len(g.Genes); i++ {
+		votes[g.Genes[i].element()] += g.Genes[i].Expression() + 1
+	}
+
+	first, second := -1, -1
+	for i, v := range votes {
+		switch {
+		case v == 0:
+		case first < 0 || v > votes[first]:
+			first, second = i, first
+		case second < 0 || v > votes[second]:
+			second = i
+		}
+	}
+
+	if first < 0 {
+		return Normal, ""
+	}
+	if second < 0 || 2*votes[second] < votes[first] {
+		return Elements[first], ""
+	}
+	return Elements[first], Elements[second]
+}
+
+// Types decodes dna and returns its elements, see Genome.Types.
+func Types(dna string) (primary, secondary Element, err error) {
+	g, err := Decode(dna)
+	if err != nil {
+		return "", "", err
+	}
+	primary, secondary = g.Types()
+	return primary, secondary, nil
+}
@@ -0,0 +1,194 @@
+// Package genetics decodes a pokemon's DNA into genes and derives its stats
+// and elements from them, so both are a pure function of the DNA.
+//
+// Encoding:
+//
+//   - DNA is a string over the bases A, T, C and G, read as the digits 0 to 3.
+//   - It is split into two chromosomes of equal length, the first and the
+//     second half of the string. With an odd length the last base is not
+//     part of either.
+//   - Each chromosome is read in codons of three bases, a codon of bases
+//     b0 b1 b2 being the number 16*b0 + 4*b1 + b2.
+//   - The codons at the same index of both chromosomes are the two alleles
+//     of one gene. The first GenesPerStat*NumStats genes are coding: gene i
+//     codes stat i mod NumStats, in the order of the Stat constants. The
+//     next ElementGenes genes decide the elements, see Genome.Types. Later
+//     codons are non-coding.
+//   - An allele whose codon starts with C or G is dominant, one starting
+//     with A or T is recessive. Its strength is the codon mod 16, 0 to 15.
+//   - A gene expresses the strength of its dominant allele when exactly one
+//     of its alleles is dominant, and the mean strength of both, rounded
+//     down, otherwise.
+//   - A stat adds up the expression of its genes and scales the sum from 0
+//     to GenesPerStat*MaxStrength onto 1 to the stat's cap. Genes missing
+//     from a short DNA express 0.
+package genetics
+
+import (
+	"fmt"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/entity"
+)
+
+// Stat identifies one of the entity.Stats.
+type Stat int
+
+const (
+	BaseLv Stat = iota
+	HP
+	Attack
+	Defense
+	SpecialAttack
+	SpecialDefense
+	Speed
+	// NumStats is the number of stats.
+	NumStats int = iota
+)
+
+var statNames = [NumStats]string{"base_lv", "hp", "attack", "defense", "special_attack", "special_defense", "speed"}
+
+func (s Stat) String() string {
+	if s < 0 || int(s) >= NumStats {
+		return fmt.Sprintf("Stat(%d)", int(s))
+	}
+	return statNames[s]
+}
+
+// Caps are the highest value of every stat.
+var Caps = [NumStats]int{
+	BaseLv:         100,
+	HP:             255,
+	Attack:         255,
+	Defense:        255,
+	SpecialAttack:  255,
+	SpecialDefense: 255,
+	Speed:          255,
+}
+
+const (
+	// GenesPerStat is the number of genes coding each stat.
+	GenesPerStat = 8
+	// CodingGenes is the number of genes that affect the stats.
+	CodingGenes = GenesPerStat * NumStats
+	// MaxStrength is the strength of the strongest allele.
+	MaxStrength = 15
+	// CodonLength is the number of bases in a codon.
+	CodonLength = 3
+)
+
+// Allele is one codon of a gene.
+type Allele uint8
+
+func (a Allele) Dominant() bool {
+	// bases C and G are 2 and 3
+	return a>>4 >= 2
+}
+
+func (a Allele) Strength() int {
+	return int(a & MaxStrength)
+}
+
+// Gene is a pair of alleles at the same index of both chromosomes.
+type Gene struct {
+	Alleles [2]Allele
+}
+
+// Expression is the strength the gene contributes to its stat.
+func (g Gene) Expression() int {
+	a, b := g.Alleles[0], g.Alleles[1]
+	switch {
+	case a.Dominant() && !b.Dominant():
+		return a.Strength()
+	case b.Dominant() && !a.Dominant():
+		return b.Strength()
+	default:
+		return (a.Strength() + b.Strength()) / 2
+	}
+}
+
+// Genome is a decoded DNA.
+type Genome struct {
+	Genes []Gene
+}
+
+// Coding returns the genes coding stat.
+func (g Genome) Coding(stat Stat) []Gene {
+	var genes []Gene
+	for i := int(stat); i < CodingGenes && i < len(g.Genes); i += NumStats {
+		genes = append(genes, g.Genes[i])
+	}
+	return genes
+}
+
+// Stat derives the value of stat, between 1 and its cap.
+func (g Genome) Stat(stat Stat) int {
+	sum := 0
+	for _, gene := range g.Coding(stat) {
+		sum += gene.Expression()
+	}
+	return 1 + sum*(Caps[stat]-1)/(GenesPerStat*MaxStrength)
+}
+
+func (g Genome) Stats() entity.Stats {
+	return entity.Stats{
+		BaseLv:         g.Stat(BaseLv),
+		HP:             g.Stat(HP),
+		Attack:         g.Stat(Attack),
+		Defense:        g.Stat(Defense),
+		SpecialAttack:  g.Stat(SpecialAttack),
+		SpecialDefense: g.Stat(SpecialDefense),
+		Speed:          g.Stat(Speed),
+	}
+}
+
+// Decode splits dna into genes. It fails on anything but A, T, C and G.
+func Decode(dna string) (Genome, error) {
+	for i := range len(dna) {
+		if _, err := base(dna[i]); err != nil {
+			return Genome{}, fmt.Errorf("base %d: %w", i, err)
+		}
+	}
+
+	half := len(dna) / 2
+	first, second := dna[:half], dna[half:]
+
+	genes := make([]Gene, half/CodonLength)
+	for i := range genes {
+		genes[i] = Gene{Alleles: [2]Allele{codon(first, i), codon(second, i)}}
+	}
+	return Genome{Genes: genes}, nil
+}
+
+// Stats decodes dna and derives its stats.
+func Stats(dna string) (entity.Stats, error) {
+	g, err := Decode(dna)
+	if err != nil {
+		return entity.Stats{}, err
+	}
+	return g.Stats(), nil
+}
+
+// codon reads the i-th codon of a validated chromosome.
+func codon(chromosome string, i int) Allele {
+	var v Allele
+	for _, b := range []byte(chromosome[i*CodonLength : (i+1)*CodonLength]) {
+		d, _ := base(b)
+		v = v<<2 | Allele(d)
+	}
+	return v
+}
+
+func base(b byte) (byte, error) {
+	switch b {
+	case 'A':
+		return 0, nil
+	case 'T':
+		return 1, nil
+	case 'C':
+		return 2, nil
+	case 'G':
+		return 3, nil
+	default:
+		return 0, fmt.Errorf("invalid base %q", b)
+	}
+}
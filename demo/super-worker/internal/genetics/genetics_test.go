@@ -0,0 +1,204 @@
+package genetics
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// dna is a valid DNA of random length, from empty to a few times the coding
+// region, for testing/quick.
+type dna string
+
+func (dna) Generate(r *rand.Rand, size int) reflect.Value {
+	b := make([]byte, r.Intn(3*2*CodingGenes*CodonLength))
+	for i := range b {
+		b[i] = "ATCG"[r.Intn(4)]
+	}
+	return reflect.ValueOf(dna(b))
+}
+
+func TestStatsAreWithinCaps(t *testing.T) {
+	f := func(d dna) bool {
+		g, err := Decode(string(d))
+		if err != nil {
+			return false
+		}
+		for stat := range Stat(NumStats) {
+			if v := g.Stat(stat); v < 1 || v > Caps[stat] {
+				t.Logf("%s = %d, cap %d", stat, v, Caps[stat])
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatsArePure(t *testing.T) {
+	f := func(d dna) bool {
+		a, errA := Stats(string(d))
+		b, errB := Stats(strings.Clone(string(d)))
+		return errA == nil && errB == nil && a == b
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNonCodingBasesDoNotAffectStats(t *testing.T) {
+	f := func(d dna, pos uint, b uint8) bool {
+		half := len(d) / 2
+		coding := CodingGenes * CodonLength
+		if half <= coding {
+			return true
+		}
+		// a base past the coding genes of either chromosome
+		i := coding + int(pos%uint(half-coding))
+		if pos%2 == 1 {
+			i += half
+		}
+
+		mutated := []byte(d)
+		mutated[i] = "ATCG"[b%4]
+
+		before, _ := Stats(string(d))
+		after, err := Stats(string(mutated))
+		return err == nil && before == after
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStrongestAlleleNeverLowersAStat(t *testing.T) {
+	f := func(d dna, gene uint, second bool) bool {
+		half := len(d) / 2
+		genes := min(half/CodonLength, CodingGenes)
+		if genes == 0 {
+			return true
+		}
+		i := int(gene % uint(genes))
+		start := i * CodonLength
+		if second {
+			start += half
+		}
+
+		mutated := []byte(d)
+		copy(mutated[start:], "GGG")
+
+		before, _ := Decode(string(d))
+		after, _ := Decode(string(mutated))
+		stat := Stat(i % NumStats)
+		return after.Stat(stat) >= before.Stat(stat)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeneExpression(t *testing.T) {
+	f := func(a, b uint8) bool {
+		x, y := Allele(a%64), Allele(b%64)
+		g := Gene{Alleles: [2]Allele{x, y}}
+
+		want := (x.Strength() + y.Strength()) / 2
+		switch {
+		case x.Dominant() && !y.Dominant():
+			want = x.Strength()
+		case y.Dominant() && !x.Dominant():
+			want = y.Strength()
+		}
+		swapped := Gene{Alleles: [2]Allele{y, x}}
+		return g.Expression() == want && swapped.Expression() == want
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// GAT is dominant with strength 4*0 + 1, TCC recessive with 4*2 + 2
+	gat, tcc := Allele(3<<4|0<<2|1), Allele(1<<4|2<<2|2)
+	if gat.Strength() != 1 || !gat.Dominant() || tcc.Strength() != 10 || tcc.Dominant() {
+		t.Fatalf("GAT = %d (dominant %v), TCC = %d (dominant %v)", gat.Strength(), gat.Dominant(), tcc.Strength(), tcc.Dominant())
+	}
+	if got := (Gene{Alleles: [2]Allele{tcc, gat}}).Expression(); got != 1 {
+		t.Fatalf("dominant GAT over recessive TCC expresses %d, want 1", got)
+	}
+}
+
+func TestStatsRange(t *testing.T) {
+	full := strings.Repeat("GGG", 2*CodingGenes)
+	stats, err := Stats(full)
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	if stats.BaseLv != Caps[BaseLv] || stats.HP != Caps[HP] || stats.Speed != Caps[Speed] {
+		t.Fatalf("all strongest alleles give %+v, want the caps", stats)
+	}
+
+	for _, d := range []string{"", "AC", strings.Repeat("AAA", 2*CodingGenes)} {
+		stats, err := Stats(d)
+		if err != nil {
+			t.Fatalf("stats of %q: %v", d, err)
+		}
+		if stats.BaseLv != 1 || stats.Attack != 1 || stats.Speed != 1 {
+			t.Fatalf("weakest DNA %q gives %+v, want 1 everywhere", d, stats)
+		}
+	}
+}
+
+func TestDecodeRejectsInvalidBases(t *testing.T) {
+	f := func(d dna, pos uint) bool {
+		if len(d) == 0 {
+			return true
+		}
+		invalid := []byte(d)
+		invalid[pos%uint(len(d))] = 'X'
+		_, err := Decode(string(invalid))
+		return err != nil
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTypesArePureAndDistinct(t *testing.T) {
+	f := func(d dna) bool {
+		primary, secondary, err := Types(string(d))
+		if err != nil || primary == "" || primary == secondary {
+			return false
+		}
+		again, _, _ := Types(strings.Clone(string(d)))
+		return again == primary
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestElementGenesDecideTypes(t *testing.T) {
+	// CAA is the dominant codon 32, which indexes Psychic
+	chromosome := strings.Repeat("AAA", CodingGenes) + strings.Repeat("CAA", ElementGenes)
+	primary, secondary, err := Types(chromosome + chromosome)
+	if err != nil {
+		t.Fatalf("types: %v", err)
+	}
+	if primary != Psychic || secondary != "" {
+		t.Fatalf("types = %q, %q, want psychic only", primary, secondary)
+	}
+
+	// CAT is codon 33, which indexes Rock and votes twice as strong
+	mixed := strings.Repeat("AAA", CodingGenes) + strings.Repeat("CAA", ElementGenes/2) + strings.Repeat("CAT", ElementGenes/2)
+	primary, secondary, _ = Types(mixed + mixed)
+	if primary != Rock || secondary != Psychic {
+		t.Fatalf("types = %q, %q, want rock and psychic", primary, secondary)
+	}
+
+	if primary, secondary, _ := Types("ATCG"); primary != Normal || secondary != "" {
+		t.Fatalf("DNA without element genes has types %q, %q", primary, secondary)
+	}
+}
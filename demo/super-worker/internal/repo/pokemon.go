@@ -4,41 +4,59 @@ import (
 	"encoding/json"
 	"math/rand"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
 type PokemonRepo struct {
 	url string
+	// maxLatency bounds the simulated network latency after each lookup.
+	maxLatency time.Duration
 }
 
-func NewPokemon(url string) *PokemonRepo {
+func NewPokemon(url string, maxLatency time.Duration) *PokemonRepo {
 	return &PokemonRepo{
-		url: url,
+		url:        url,
+		maxLatency: maxLatency,
 	}
 }
 
-func (r *PokemonRepo) FetchAbility() map[string]int {
+// FetchAbility sums the abilities of a random number of lookups. limit is
+// how many abilities each lookup returns, the server's default if 0. Every
+// lookup passes a seed drawn from rng, so the result only depends on rng,
+// not on the latency.
+func (r *PokemonRepo) FetchAbility(rng *rand.Rand, limit int) (map[string]int, error) {
 	ability := map[string]int{}
 
-	for range rand.Intn(100) {
-		response, err := http.Get(r.url)
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	for range rng.Intn(100) {
+		query.Set("seed", strconv.FormatInt(rng.Int63(), 10))
+		response, err := http.Get(r.url + "?" + query.Encode())
 		if err != nil {
-			return nil
+			return nil, err
 		}
 		defer response.Body.Close()
 
 		var abilities map[string]int
 		err = json.NewDecoder(response.Body).Decode(&abilities)
 		if err != nil {
-			return nil
+			return nil, err
 		}
 		for k, v := range abilities {
 			ability[k] += v
 		}
 
-		// simulate network latency
-		time.Sleep(time.Duration(rand.Intn(100)) * time.Millisecond)
+		// simulate network latency, drawn from the global source so the
+		// pokemon does not depend on it
+		if r.maxLatency > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(r.maxLatency))))
+		}
 	}
 
-	return ability
+	return ability, nil
 }
@@ -0,0 +1,349 @@
+// Package tournament schedules the matches of a tournament between pokemon
+// and ranks the entrants by their results. It only keeps the score: matches
+// are fought elsewhere, as battle series, and recorded in any order as their
+// reports come back.
+//
+// A match is won by the entrant that won more battles of its series and
+// earns WinPoints, a drawn match earns both entrants DrawPoints. In a round
+// robin entrants are ranked by points, then by battles won minus battles
+// lost. In a bracket they are ranked by the round they were knocked out in,
+// the champion first; a drawn bracket match is won by the entrant listed
+// first, the higher seed.
+package tournament
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/battle"
+)
+
+type Format string
+
+const (
+	// RoundRobin matches every entrant against every other one, all in
+	// a single round.
+	RoundRobin Format = "round_robin"
+	// Bracket is a single elimination bracket. Entrants are seeded in the
+	// order they are listed and the top seeds get a bye when their number
+	// is not a power of two.
+	Bracket Format = "bracket"
+)
+
+// MaxEntrants bounds the entrants of a tournament. A round robin of 64
+// entrants plays 2016 matches.
+const MaxEntrants = 64
+
+// Points of a match.
+const (
+	WinPoints  = 3
+	DrawPoints = 1
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case "", RoundRobin:
+		return RoundRobin, nil
+	case Bracket:
+		return Bracket, nil
+	default:
+		return "", fmt.Errorf("unknown tournament format %q", s)
+	}
+}
+
+// Match pairs two entrants. Its battles are seeded with Seed.
+type Match struct {
+	// ID is unique within the tournament.
+	ID    string `json:"id"`
+	Round int    `json:"round"`
+	// Entrants are the indexes of the two entrants.
+	Entrants [2]int `json:"entrants"`
+	Seed     int64  `json:"seed"`
+
+	// slot is where the winner of a bracket match plays the next round.
+	slot int
+}
+
+// Result is the outcome of a recorded match.
+type Result struct {
+	Match
+	Fighters [2]string `json:"fighters"`
+	// Winner is the name of the winner, empty on a draw.
+	Winner string `json:"winner,omitempty"`
+	Wins   [2]int `json:"wins"`
+	Draws  int    `json:"draws"`
+}
+
+type Standing struct {
+	// Rank starts at 1. Entrants that tie share a rank.
+	Rank   int    `json:"rank"`
+	Name   string `json:"name"`
+	Played int    `json:"played"`
+	Won    int    `json:"won"`
+	Drawn  int    `json:"drawn"`
+	Lost   int    `json:"lost"`
+	Points int    `json:"points"`
+	// BattlesWon and BattlesLost count the battles of all its matches.
+	BattlesWon  int `json:"battles_won"`
+	BattlesLost int `json:"battles_lost"`
+	// KnockedOut is the bracket round the entrant lost, 0 while it is in.
+	KnockedOut int `json:"knocked_out,omitempty"`
+
+	entrant int
+}
+
+// Report is the state of a tournament, final once Next returned no more
+// matches.
+type Report struct {
+	Format    Format     `json:"format"`
+	Seed      int64      `json:"seed"`
+	Entrants  []string   `json:"entrants"`
+	Rounds    int        `json:"rounds"`
+	Matches   []Result   `json:"matches"`
+	Standings []Standing `json:"standings"`
+}
+
+// Tournament hands out the matches of one round at a time and records their
+// results. It is not safe for concurrent use.
+type Tournament struct {
+	format  Format
+	seed    int64
+	names   []string
+	rng     *rand.Rand
+	round   int
+	pending map[string]Match
+	results []Result
+
+	// slots are the entrants of the current bracket round in bracket
+	// order, -1 for a bye, and next those of the following round.
+	slots, next []int
+	knockedOut  []int
+}
+
+// New creates a tournament between the named entrants, drawing the seeds of
+// its matches from a random generator seeded with seed. The same entrants
+// and seed always schedule the same matches.
+func New(format Format, names []string, seed int64) (*Tournament, error) {
+	if n := len(names); n < 2 || n > MaxEntrants {
+		return nil, fmt.Errorf("a tournament needs 2 to %d entrants, got %d", MaxEntrants, n)
+	}
+	if _, err := ParseFormat(string(format)); err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = RoundRobin
+	}
+
+	t := &Tournament{
+		format:     format,
+		seed:       seed,
+		names:      slices.Clone(names),
+		rng:        rand.New(rand.NewSource(seed)),
+		pending:    map[string]Match{},
+		knockedOut: make([]int, len(names)),
+	}
+	if format == Bracket {
+		t.next = seeding(len(names))
+	}
+	return t, nil
+}
+
+// seeding places n entrants in a bracket so that the top seeds meet last
+// and get the byes, marked -1.
+func seeding(n int) []int {
+	order := []int{0}
+	for len(order) < n {
+		size := 2 * len(order)
+		next := make([]int, 0, size)
+		for _, s := range order {
+			next = append(next, s, size-1-s)
+		}
+		order = next
+	}
+	for i, s := range order {
+		if s >= n {
+			order[i] = -1
+		}
+	}
+	return order
+}
+
+// Next schedules the matches of the next round and returns them, or nil once
+// the tournament is over. It fails while matches of the current round are
+// not recorded yet.
+func (t *Tournament) Next() ([]Match, error) {
+	if len(t.pending) > 0 {
+		return nil, fmt.Errorf("round %d has %d match(es) left", t.round, len(t.pending))
+	}
+
+	var matches []Match
+	switch t.format {
+	case RoundRobin:
+		if t.round > 0 {
+			return nil, nil
+		}
+		t.round++
+		for i := range t.names {
+			for j := i + 1; j < len(t.names); j++ {
+				matches = append(matches, t.match(len(matches), i, j))
+			}
+		}
+	case Bracket:
+		if len(t.next) == 1 {
+			return nil, nil
+		}
+		t.round++
+		t.slots, t.next = t.next, make([]int, len(t.next)/2)
+		for i := 0; i < len(t.slots); i += 2 {
+			a, b := t.slots[i], t.slots[i+1]
+			switch {
+			case b < 0:
+				t.next[i/2] = a
+			case a < 0:
+				t.next[i/2] = b
+			default:
+				m := t.match(len(matches), a, b)
+				m.slot = i / 2
+				matches = append(matches, m)
+			}
+		}
+	}
+
+	for _, m := range matches {
+		t.pending[m.ID] = m
+	}
+	return matches, nil
+}
+
+func (t *Tournament) match(n, a, b int) Match {
+	return Match{
+		ID:       fmt.Sprintf("round-%d/match-%d", t.round, n+1),
+		Round:    t.round,
+		Entrants: [2]int{a, b},
+		Seed:     t.rng.Int63(),
+	}
+}
+
+// Record records the report of the battles of the match with the given id.
+func (t *Tournament) Record(id string, report battle.Report) error {
+	m, ok := t.pending[id]
+	if !ok {
+		return fmt.Errorf("match %q is not pending", id)
+	}
+	if report.Rounds < 1 {
+		return errors.New("the report has no battles")
+	}
+	delete(t.pending, id)
+
+	r := Result{
+		Match:    m,
+		Fighters: [2]string{t.names[m.Entrants[0]], t.names[m.Entrants[1]]},
+		Wins:     report.Wins,
+		Draws:    report.Draws,
+	}
+	winner := battle.Draw
+	switch {
+	case report.Wins[0] > report.Wins[1]:
+		winner = 0
+	case report.Wins[1] > report.Wins[0]:
+		winner = 1
+	}
+	if winner != battle.Draw {
+		r.Winner = r.Fighters[winner]
+	}
+	t.results = append(t.results, r)
+
+	if t.format == Bracket {
+		// the higher seed goes through a draw
+		through := max(winner, 0)
+		t.next[m.slot] = m.Entrants[through]
+		t.knockedOut[m.Entrants[1-through]] = m.Round
+	}
+	return nil
+}
+
+// Report returns the results recorded so far, in the order they were
+// recorded, and the standings they make.
+func (t *Tournament) Report() Report {
+	return Report{
+		Format:    t.format,
+		Seed:      t.seed,
+		Entrants:  slices.Clone(t.names),
+		Rounds:    t.round,
+		Matches:   slices.Clone(t.results),
+		Standings: t.standings(),
+	}
+}
+
+func (t *Tournament) standings() []Standing {
+	standings := make([]Standing, len(t.names))
+	for i, name := range t.names {
+		standings[i] = Standing{Name: name, KnockedOut: t.knockedOut[i], entrant: i}
+	}
+	for _, r := range t.results {
+		for side, e := range r.Entrants {
+			s := &standings[e]
+			s.Played++
+			s.BattlesWon += r.Wins[side]
+			s.BattlesLost += r.Wins[1-side]
+			switch r.Winner {
+			case "":
+				s.Drawn++
+				s.Points += DrawPoints
+			case r.Fighters[side]:
+				s.Won++
+				s.Points += WinPoints
+			default:
+				s.Lost++
+			}
+		}
+	}
+
+	// rank compares what decides the rank, order breaks its ties for a
+	// stable listing
+	rank := func(a, b Standing) int {
+		if t.format == Bracket {
+			return compareKnockedOut(a.KnockedOut, b.KnockedOut)
+		}
+		if c := b.Points - a.Points; c != 0 {
+			return c
+		}
+		return (b.BattlesWon - b.BattlesLost) - (a.BattlesWon - a.BattlesLost)
+	}
+	slices.SortFunc(standings, func(a, b Standing) int {
+		if c := rank(a, b); c != 0 {
+			return c
+		}
+		if c := b.Points - a.Points; c != 0 {
+			return c
+		}
+		if c := (b.BattlesWon - b.BattlesLost) - (a.BattlesWon - a.BattlesLost); c != 0 {
+			return c
+		}
+		return a.entrant - b.entrant
+	})
+	for i := range standings {
+		standings[i].Rank = i + 1
+		if i > 0 && rank(standings[i-1], standings[i]) == 0 {
+			standings[i].Rank = standings[i-1].Rank
+		}
+	}
+	return standings
+}
+
+// compareKnockedOut orders entrants still in first, then the ones knocked
+// out later.
+func compareKnockedOut(a, b int) int {
+	switch {
+	case a == b:
+		return 0
+	case a == 0:
+		return -1
+	case b == 0:
+		return 1
+	default:
+		return b - a
+	}
+}
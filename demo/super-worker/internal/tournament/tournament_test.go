@@ -0,0 +1,157 @@
+package tournament
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/battle"
+)
+
+// play records every match of a round as won by the entrant with the lower
+// index, in reverse order to show results may come back in any order.
+func play(t *testing.T, tour *Tournament, matches []Match) {
+	t.Helper()
+	for i := len(matches) - 1; i >= 0; i-- {
+		m := matches[i]
+		wins := [2]int{3, 1}
+		if m.Entrants[1] < m.Entrants[0] {
+			wins = [2]int{1, 3}
+		}
+		if err := tour.Record(m.ID, battle.Report{Rounds: 4, Wins: wins}); err != nil {
+			t.Fatalf("record %s: %v", m.ID, err)
+		}
+	}
+}
+
+func TestRoundRobinPlaysEveryPairOnce(t *testing.T) {
+	names := []string{"bulbasaur", "charmander", "squirtle", "pikachu"}
+	tour, err := New(RoundRobin, names, 1)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+
+	matches, err := tour.Next()
+	if err != nil || len(matches) != 6 {
+		t.Fatalf("scheduled %d matches: %v", len(matches), err)
+	}
+	pairs := map[[2]int]bool{}
+	for _, m := range matches {
+		pairs[m.Entrants] = true
+		pairs[[2]int{m.Entrants[1], m.Entrants[0]}] = true
+	}
+	if len(pairs) != 12 {
+		t.Fatalf("matches %v repeat a pair", matches)
+	}
+	if _, err := tour.Next(); err == nil {
+		t.Fatal("scheduled a round before the matches were recorded")
+	}
+
+	play(t, tour, matches)
+	if more, err := tour.Next(); more != nil || err != nil {
+		t.Fatalf("next = %v, %v after the only round", more, err)
+	}
+
+	report := tour.Report()
+	for i, s := range report.Standings {
+		if s.Name != names[i] || s.Rank != i+1 || s.Played != 3 || s.Points != (3-i)*WinPoints {
+			t.Errorf("standing %d = %+v", i, s)
+		}
+	}
+	if err := tour.Record(matches[0].ID, battle.Report{Rounds: 1}); err == nil {
+		t.Fatal("recorded a match twice")
+	}
+
+	again, _ := New(RoundRobin, names, 1)
+	if rematches, _ := again.Next(); !reflect.DeepEqual(rematches, matches) {
+		t.Fatal("the same seed scheduled different matches")
+	}
+}
+
+func TestRoundRobinTiesShareARank(t *testing.T) {
+	tour, _ := New(RoundRobin, []string{"a", "b", "c"}, 1)
+	matches, _ := tour.Next()
+	for _, m := range matches {
+		if err := tour.Record(m.ID, battle.Report{Rounds: 2, Wins: [2]int{1, 1}}); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+
+	for _, s := range tour.Report().Standings {
+		if s.Rank != 1 || s.Drawn != 2 || s.Points != 2*DrawPoints {
+			t.Errorf("standing = %+v", s)
+		}
+	}
+}
+
+func TestBracketGivesTopSeedsByes(t *testing.T) {
+	names := []string{"mewtwo", "dragonite", "gyarados", "onix", "magikarp"}
+	tour, err := New(Bracket, names, 1)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+
+	var rounds [][]Match
+	for {
+		matches, err := tour.Next()
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if matches == nil {
+			break
+		}
+		rounds = append(rounds, matches)
+		play(t, tour, matches)
+	}
+
+	// 5 entrants fill a bracket of 8: only onix and magikarp play the
+	// first round
+	if len(rounds) != 3 || len(rounds[0]) != 1 || rounds[0][0].Entrants != [2]int{3, 4} {
+		t.Fatalf("rounds = %v", rounds)
+	}
+	if len(rounds[1]) != 2 || len(rounds[2]) != 1 || rounds[2][0].Entrants != [2]int{0, 1} {
+		t.Fatalf("rounds = %v", rounds)
+	}
+
+	// the semifinal losers share third place, onix first as it won a match
+	report := tour.Report()
+	want := []struct {
+		name string
+		rank int
+	}{{"mewtwo", 1}, {"dragonite", 2}, {"onix", 3}, {"gyarados", 3}, {"magikarp", 5}}
+	for i, s := range report.Standings {
+		if s.Name != want[i].name || s.Rank != want[i].rank {
+			t.Errorf("standing %d = %+v, want %s ranked %d", i, s, want[i].name, want[i].rank)
+		}
+	}
+	if champion := report.Standings[0]; champion.KnockedOut != 0 || champion.Won != 2 {
+		t.Errorf("champion = %+v", champion)
+	}
+	if report.Rounds != 3 || len(report.Matches) != 4 {
+		t.Errorf("report has %d rounds and %d matches", report.Rounds, len(report.Matches))
+	}
+}
+
+func TestBracketDrawSendsTheHigherSeedThrough(t *testing.T) {
+	tour, _ := New(Bracket, []string{"a", "b"}, 1)
+	matches, _ := tour.Next()
+	if err := tour.Record(matches[0].ID, battle.Report{Rounds: 1, Draws: 1}); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+
+	standings := tour.Report().Standings
+	if standings[0].Name != "a" || standings[0].Drawn != 1 || standings[1].KnockedOut != 1 {
+		t.Fatalf("standings = %+v", standings)
+	}
+}
+
+func TestNewRejectsInvalidTournaments(t *testing.T) {
+	if _, err := New(RoundRobin, []string{"solo"}, 1); err == nil {
+		t.Error("created a tournament of 1 entrant")
+	}
+	if _, err := New(RoundRobin, make([]string, MaxEntrants+1), 1); err == nil {
+		t.Error("created a tournament of too many entrants")
+	}
+	if _, err := New("league", []string{"a", "b"}, 1); err == nil {
+		t.Error("created a tournament of an unknown format")
+	}
+}
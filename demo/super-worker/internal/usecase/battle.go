@@ -0,0 +1,36 @@
+package usecase
+
+import (
+	"fmt"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/battle"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/entity"
+)
+
+// MaxBattleRounds bounds the battles of one Battle call.
+const MaxBattleRounds = 10000
+
+// BattleOptions tune Battle. Zero values keep the defaults.
+type BattleOptions struct {
+	// Seed makes the battles reproducible, see GenerateOptions.
+	Seed *int64 `json:"-"`
+	// Rounds is the number of battles fought, 1 by default.
+	Rounds int `json:"rounds,omitempty"`
+	// MaxTurns defaults to battle.DefaultMaxTurns.
+	MaxTurns int `json:"max_turns,omitempty"`
+}
+
+// Battle fights a series of battles between a and b, see battle.Series. It
+// does no I/O, so it is bound by the CPU: the cost grows with the rounds.
+func (u *PokemonUsecase) Battle(a, b entity.Pokemon, opts BattleOptions) (battle.Report, error) {
+	rounds := opts.Rounds
+	if rounds == 0 {
+		rounds = 1
+	}
+	if rounds < 0 || rounds > MaxBattleRounds {
+		return battle.Report{}, fmt.Errorf("rounds must be between 1 and %d", MaxBattleRounds)
+	}
+
+	seed := u.seed(opts.Seed)
+	return battle.Series(a, b, seed, rounds, battle.Options{MaxTurns: opts.MaxTurns})
+}
@@ -0,0 +1,130 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/entity"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/genetics"
+)
+
+// Evolution rules.
+const (
+	// MaxLevel is the highest level a pokemon evolves to.
+	MaxLevel = 100
+	// MaxStage is the number of times a pokemon can evolve.
+	MaxStage = 3
+	// DefaultEvolutionLevels is how many levels an evolution gains.
+	DefaultEvolutionLevels = 16
+	// DefaultEvolutionMutationRate is the chance of every base to mutate
+	// when evolving.
+	DefaultEvolutionMutationRate = 0.002
+	// GrowthLevels is how many levels above its base level it takes a stat
+	// to grow by its base value.
+	GrowthLevels = 50
+	// AbilityUnlockLevels is how many levels apart abilities are unlocked.
+	AbilityUnlockLevels = 20
+)
+
+// ErrFullyEvolved is returned when evolving a pokemon at MaxStage.
+var ErrFullyEvolved = errors.New("pokemon is fully evolved")
+
+// EvolveOptions tune EvolvePokemon. Zero values keep the defaults.
+type EvolveOptions struct {
+	// Seed makes the evolved form reproducible, see GenerateOptions.
+	Seed *int64 `json:"-"`
+	// Levels defaults to DefaultEvolutionLevels.
+	Levels int `json:"levels,omitempty"`
+	// MutationRate defaults to DefaultEvolutionMutationRate.
+	MutationRate float64 `json:"mutation_rate,omitempty"`
+	// AbilityLimit is how many abilities each ability lookup returns.
+	AbilityLimit int `json:"ability_limit,omitempty"`
+}
+
+// EvolvePokemon evolves p into its next stage, called name:
+//
+//   - it gains opts.Levels levels, up to MaxLevel;
+//   - its DNA mutates with opts.MutationRate and its base stats are derived
+//     from the new DNA;
+//   - every stat but the base level grows by its base value for every
+//     GrowthLevels levels above the base level, up to its cap;
+//   - its types are derived from the new DNA, it forgets the abilities
+//     they cannot learn;
+//   - it learns the abilities of one more lookup for every multiple of
+//     AbilityUnlockLevels it reaches, see learn.
+//
+// The evolved form remembers the names of its previous forms in Lineage.
+// Like GeneratePokemon the result only depends on the seed, the name and p.
+func (u *PokemonUsecase) EvolvePokemon(name string, p entity.Pokemon, opts EvolveOptions) (entity.Pokemon, error) {
+	if p.Stage >= MaxStage {
+		return entity.Pokemon{}, ErrFullyEvolved
+	}
+	levels := opts.Levels
+	if levels == 0 {
+		levels = DefaultEvolutionLevels
+	}
+	rate := opts.MutationRate
+	if rate == 0 {
+		rate = DefaultEvolutionMutationRate
+	}
+	if levels < 0 || rate < 0 || rate > 1 {
+		return entity.Pokemon{}, fmt.Errorf("invalid evolution: %d levels, mutation rate %v", levels, rate)
+	}
+
+	seed := u.seed(opts.Seed)
+	rng := newRand(seed, name)
+
+	dna := []byte(p.DNA)
+	genetics.Mutate(dna, rate, rng)
+	genome, err := genetics.Decode(string(dna))
+	if err != nil {
+		return entity.Pokemon{}, fmt.Errorf("derive stats: %w", err)
+	}
+	stats := genome.Stats()
+	primary, secondary := genome.Types()
+
+	from := max(p.Level, p.Stats.BaseLv)
+	level := max(min(from+levels, MaxLevel), stats.BaseLv)
+
+	abilities := map[string]int{}
+	maps.Copy(abilities, p.Abilities)
+	u.forget(abilities, primary, secondary)
+	for range level/AbilityUnlockLevels - from/AbilityUnlockLevels {
+		if err := u.learn(abilities, rng, opts.AbilityLimit, primary, secondary); err != nil {
+			return entity.Pokemon{}, fmt.Errorf("unlock ability: %w", err)
+		}
+	}
+
+	return entity.Pokemon{
+		Name:      name,
+		Seed:      seed,
+		DNA:       string(dna),
+		Types:     typeNames(primary, secondary),
+		Level:     level,
+		Stage:     p.Stage + 1,
+		Lineage:   append(slices.Clip(p.Lineage), p.Name),
+		Ability:   slices.Sorted(maps.Keys(abilities)),
+		Abilities: abilities,
+		Stats:     grow(stats, level),
+	}, nil
+}
+
+// grow applies the growth curve to base stats at level.
+func grow(stats entity.Stats, level int) entity.Stats {
+	above := max(level-stats.BaseLv, 0)
+	curve := func(stat genetics.Stat, base int) int {
+		return min(base+base*above/GrowthLevels, genetics.Caps[stat])
+	}
+
+	return entity.Stats{
+		BaseLv:         stats.BaseLv,
+		HP:             curve(genetics.HP, stats.HP),
+		Attack:         curve(genetics.Attack, stats.Attack),
+		Defense:        curve(genetics.Defense, stats.Defense),
+		SpecialAttack:  curve(genetics.SpecialAttack, stats.SpecialAttack),
+		SpecialDefense: curve(genetics.SpecialDefense, stats.SpecialDefense),
+		Speed:          curve(genetics.Speed, stats.Speed),
+	}
+}
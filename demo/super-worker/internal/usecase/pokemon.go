@@ -1,67 +1,222 @@
 package usecase
 
 import (
+	"fmt"
+	"hash/fnv"
+	"maps"
 	"math/rand"
+	"slices"
+	"sync"
+	"time"
 
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/dna"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/catalog"
 	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/entity"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/genetics"
 	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/repo"
 )
 
+// DefaultDNALength is the number of bases in a generated DNA.
+const DefaultDNALength = 10000
+
+// GenerateOptions tune GeneratePokemon. Zero values keep the defaults.
+type GenerateOptions struct {
+	// Seed makes the pokemon reproducible: the same seed and name always
+	// generate the same pokemon. Without one a seed is drawn.
+	Seed      *int64 `json:"-"`
+	DNALength int    `json:"dna_length,omitempty"`
+	// AbilityLimit is how many abilities each ability lookup returns.
+	AbilityLimit int `json:"ability_limit,omitempty"`
+}
+
 type PokemonUsecase struct {
-	repo *repo.PokemonRepo
+	repo    *repo.PokemonRepo
+	catalog *catalog.Catalog
+	dna     dna.Generator
+
+	mu    sync.Mutex
+	seeds *rand.Rand
 }
 
-func NewPokemonUsecase(repo *repo.PokemonRepo) *PokemonUsecase {
+// NewPokemonUsecase creates a usecase drawing the seeds of pokemon generated
+// without one from source, or from a source seeded with the clock if nil,
+// and their DNA with generator, dna.Naive if empty.
+func NewPokemonUsecase(repo *repo.PokemonRepo, source rand.Source, generator dna.Generator) *PokemonUsecase {
+	if source == nil {
+		source = rand.NewSource(time.Now().UnixNano())
+	}
+	if generator == "" {
+		generator = dna.Naive
+	}
+
 	return &PokemonUsecase{
-		repo: repo,
+		repo:    repo,
+		catalog: catalog.Default(),
+		dna:     generator,
+		seeds:   rand.New(source),
 	}
 }
 
-func (u *PokemonUsecase) GeneratePokemon(name string) entity.Pokemon {
-	abilities := u.repo.FetchAbility()
-	dna := u.GenerateDNA()
-	stats := u.GenerateStats(dna)
+// GeneratePokemon generates a pokemon from a random generator seeded with the
+// seed and the name, so everything about it, down to the abilities looked
+// up, only depends on those two. The seed is kept on the pokemon. Its stats
+// and types are derived from its DNA, see package genetics, and it learns
+// the abilities of the catalog its types allow, see learn.
+func (u *PokemonUsecase) GeneratePokemon(name string, opts GenerateOptions) (entity.Pokemon, error) {
+	seed := u.seed(opts.Seed)
+	rng := newRand(seed, name)
+
+	length := opts.DNALength
+	if length <= 0 {
+		length = DefaultDNALength
+	}
+	dna := u.dna.Generate(rng, length)
+	genome, err := genetics.Decode(dna)
+	if err != nil {
+		return entity.Pokemon{}, fmt.Errorf("derive stats: %w", err)
+	}
+	stats := genome.Stats()
+	primary, secondary := genome.Types()
+
+	abilities := map[string]int{}
+	if err := u.learn(abilities, rng, opts.AbilityLimit, primary, secondary); err != nil {
+		return entity.Pokemon{}, fmt.Errorf("fetch ability: %w", err)
+	}
+
 	return entity.Pokemon{
 		Name:      name,
+		Seed:      seed,
 		DNA:       dna,
+		Types:     typeNames(primary, secondary),
+		Level:     stats.BaseLv,
+		Ability:   slices.Sorted(maps.Keys(abilities)),
 		Abilities: abilities,
 		Stats:     stats,
+	}, nil
+}
+
+// learn looks abilities up for a pokemon of the given types and adds those
+// of the catalog it can learn to abilities, keeping the stronger of the ones
+// it already knows. The strength of an ability is its power plus the
+// training the lookups returned for it. Abilities the catalog does not know
+// are dropped.
+func (u *PokemonUsecase) learn(abilities map[string]int, rng *rand.Rand, limit int, types ...genetics.Element) error {
+	trained, err := u.repo.FetchAbility(rng, limit)
+	if err != nil {
+		return err
+	}
+
+	for name, training := range trained {
+		a, ok := u.catalog.Lookup(name)
+		if !ok || !a.Learnable(types...) {
+			continue
+		}
+		abilities[name] = max(abilities[name], a.Power+training)
 	}
+	return nil
 }
 
-func (u *PokemonUsecase) GenerateDNA() string {
-	dna := ""
-	base := "ATCG"
+// forget drops the abilities a pokemon of the given types cannot learn and
+// those the catalog does not know.
+func (u *PokemonUsecase) forget(abilities map[string]int, types ...genetics.Element) {
+	maps.DeleteFunc(abilities, func(name string, _ int) bool {
+		a, ok := u.catalog.Lookup(name)
+		return !ok || !a.Learnable(types...)
+	})
+}
 
-	for range 10000 {
-		dna += string(base[rand.Intn(len(base))])
+func typeNames(primary, secondary genetics.Element) []string {
+	if secondary == "" {
+		return []string{string(primary)}
 	}
+	return []string{string(primary), string(secondary)}
+}
 
-	return dna
+// BreedOptions tune BreedPokemon. Zero values keep the defaults.
+type BreedOptions struct {
+	// Seed makes the offspring reproducible, see GenerateOptions.
+	Seed *int64 `json:"-"`
+	// Crossover defaults to genetics.CrossoverSinglePoint.
+	Crossover    genetics.Crossover `json:"crossover,omitempty"`
+	MutationRate float64            `json:"mutation_rate,omitempty"`
 }
 
-func (u *PokemonUsecase) GenerateStats(dna string) entity.Stats {
-	base := len(dna)
+// BreedPokemon breeds the offspring name of two parents: its DNA comes from
+// genetics.Breed and its stats and types from that DNA. An ability both
+// parents have is inherited with their mean strength, an ability of one
+// parent with even chance, as long as the offspring's types can learn it.
+// Like GeneratePokemon the result only depends on the seed, the name and the
+// parents.
+func (u *PokemonUsecase) BreedPokemon(name string, a, b entity.Pokemon, opts BreedOptions) (entity.Pokemon, error) {
+	seed := u.seed(opts.Seed)
+	rng := newRand(seed, name)
 
-	if base > 2 {
-		base = base / 2
+	dna, err := genetics.Breed(a.DNA, b.DNA, opts.Crossover, opts.MutationRate, rng)
+	if err != nil {
+		return entity.Pokemon{}, fmt.Errorf("breed: %w", err)
+	}
+	genome, err := genetics.Decode(dna)
+	if err != nil {
+		return entity.Pokemon{}, fmt.Errorf("derive stats: %w", err)
 	}
+	stats := genome.Stats()
+	primary, secondary := genome.Types()
+	abilities := inheritAbilities(a.Abilities, b.Abilities, rng)
+	// the offspring keeps only what its own types can learn
+	u.forget(abilities, primary, secondary)
+
+	return entity.Pokemon{
+		Name:      name,
+		Seed:      seed,
+		DNA:       dna,
+		Types:     typeNames(primary, secondary),
+		Level:     stats.BaseLv,
+		Ability:   slices.Sorted(maps.Keys(abilities)),
+		Abilities: abilities,
+		Stats:     stats,
+	}, nil
+}
 
-	baseLv := rand.Intn(base) + 1
-	hp := rand.Intn(base) + 1
-	attack := rand.Intn(base) + 1
-	defense := rand.Intn(base) + 1
-	specialAttack := rand.Intn(base) + 1
-	specialDefense := rand.Intn(base) + 1
-	speed := rand.Intn(base) + 1
-
-	return entity.Stats{
-		BaseLv:         baseLv,
-		HP:             hp,
-		Attack:         attack,
-		Defense:        defense,
-		SpecialAttack:  specialAttack,
-		SpecialDefense: specialDefense,
-		Speed:          speed,
+func inheritAbilities(a, b map[string]int, rng *rand.Rand) map[string]int {
+	// map order is random, draw in a fixed order to stay reproducible
+	names := slices.Sorted(maps.Keys(a))
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
 	}
+	slices.Sort(names)
+
+	abilities := map[string]int{}
+	for _, name := range names {
+		va, inA := a[name]
+		vb, inB := b[name]
+		switch {
+		case inA && inB:
+			abilities[name] = (va + vb) / 2
+		case rng.Intn(2) == 0:
+			// only one parent has it, the other value is 0
+			abilities[name] = va + vb
+		}
+	}
+	return abilities
+}
+
+func (u *PokemonUsecase) seed(seed *int64) int64 {
+	if seed != nil {
+		return *seed
+	}
+
+	// a rand.Rand is not safe for concurrent use
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.seeds.Int63()
+}
+
+// newRand mixes the name into the seed, so jobs sharing a seed still
+// generate different pokemon.
+func newRand(seed int64, name string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
 }
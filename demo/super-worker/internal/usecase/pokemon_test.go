@@ -0,0 +1,344 @@
+package usecase
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/dna"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/catalog"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/entity"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/genetics"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/repo"
+)
+
+// newTestUsecase serves abilities of the catalog that only depend on the
+// seed of the lookup, like the simulated pokemon server.
+func newTestUsecase(t *testing.T, source rand.Source) *PokemonUsecase {
+	t.Helper()
+	return NewPokemonUsecase(repo.NewPokemon(newTestServer(t), 0), source, dna.Naive)
+}
+
+func newTestServer(t *testing.T) string {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seed, err := strconv.ParseInt(r.URL.Query().Get("seed"), 10, 64)
+		if err != nil {
+			http.Error(w, "missing seed", http.StatusBadRequest)
+			return
+		}
+		rng := rand.New(rand.NewSource(seed))
+		abilities := catalog.Default().Abilities()
+		json.NewEncoder(w).Encode(map[string]int{abilities[rng.Intn(len(abilities))].Name: rng.Intn(100)})
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+func TestGeneratePokemonIsDeterministic(t *testing.T) {
+	u := newTestUsecase(t, nil)
+	seed := int64(42)
+	opts := GenerateOptions{Seed: &seed, DNALength: 200}
+
+	first, err := u.GeneratePokemon("pikachu", opts)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	// a second usecase shares no state with the first
+	second, err := newTestUsecase(t, nil).GeneratePokemon("pikachu", opts)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("same seed and name generated different pokemon:\n%+v\n%+v", first, second)
+	}
+	if first.Seed != seed || len(first.DNA) != 200 {
+		t.Fatalf("seed %d and DNA length %d, want %d and 200", first.Seed, len(first.DNA), seed)
+	}
+
+	other, err := u.GeneratePokemon("eevee", opts)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if other.DNA == first.DNA {
+		t.Fatal("different names with the same seed generated the same DNA")
+	}
+}
+
+func TestGeneratePokemonDoesNotDependOnLatency(t *testing.T) {
+	url := newTestServer(t)
+	seed := int64(7)
+	opts := GenerateOptions{Seed: &seed, DNALength: 200}
+
+	var generated []entity.Pokemon
+	for _, latency := range []time.Duration{0, time.Microsecond} {
+		u := NewPokemonUsecase(repo.NewPokemon(url, latency), nil, dna.Naive)
+		p, err := u.GeneratePokemon("pikachu", opts)
+		if err != nil {
+			t.Fatalf("generate: %v", err)
+		}
+		generated = append(generated, p)
+	}
+	if !reflect.DeepEqual(generated[0], generated[1]) {
+		t.Fatalf("the latency changed the pokemon:\n%+v\n%+v", generated[0], generated[1])
+	}
+}
+
+func TestGeneratePokemonWithFastDNA(t *testing.T) {
+	naive := newTestUsecase(t, nil)
+	fast := newTestUsecase(t, nil)
+	fast.dna = dna.Fast
+
+	seed := int64(3)
+	opts := GenerateOptions{Seed: &seed, DNALength: 500}
+	a, err := naive.GeneratePokemon("pikachu", opts)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	b, err := fast.GeneratePokemon("pikachu", opts)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if len(b.DNA) != 500 || b.DNA == a.DNA || len(b.Types) == 0 {
+		t.Fatalf("fast generator gave %+v", b)
+	}
+}
+
+func TestGeneratePokemonLearnsAbilitiesOfItsTypes(t *testing.T) {
+	u := newTestUsecase(t, nil)
+
+	learned := 0
+	for seed := range int64(5) {
+		p, err := u.GeneratePokemon("pikachu", GenerateOptions{Seed: &seed, DNALength: 600})
+		if err != nil {
+			t.Fatalf("generate: %v", err)
+		}
+
+		primary, secondary, _ := genetics.Types(p.DNA)
+		if want := typeNames(primary, secondary); !reflect.DeepEqual(p.Types, want) {
+			t.Errorf("types %v, want %v from the DNA", p.Types, want)
+		}
+		if !slices.Equal(p.Ability, slices.Sorted(maps.Keys(p.Abilities))) {
+			t.Errorf("ability %v does not list abilities %v", p.Ability, p.Abilities)
+		}
+		for name, strength := range p.Abilities {
+			a, ok := catalog.Default().Lookup(name)
+			if !ok || !a.Learnable(primary, secondary) || strength < a.Power {
+				t.Errorf("%s pokemon learned %s (%d) = %+v", p.Types, name, strength, a)
+			}
+		}
+		learned += len(p.Abilities)
+	}
+	if learned == 0 {
+		t.Fatal("no pokemon learned an ability")
+	}
+}
+
+func TestGeneratePokemonWithoutSeedCanBeReproduced(t *testing.T) {
+	u := newTestUsecase(t, rand.NewSource(1))
+
+	first, err := u.GeneratePokemon("pikachu", GenerateOptions{DNALength: 100})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	second, err := u.GeneratePokemon("pikachu", GenerateOptions{DNALength: 100})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if first.Seed == second.Seed || first.DNA == second.DNA {
+		t.Fatal("pokemon generated without a seed are identical")
+	}
+
+	again, err := u.GeneratePokemon("pikachu", GenerateOptions{Seed: &first.Seed, DNALength: 100})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if !reflect.DeepEqual(first, again) {
+		t.Fatalf("the recorded seed did not reproduce the pokemon:\n%+v\n%+v", first, again)
+	}
+}
+
+func TestBreedPokemon(t *testing.T) {
+	u := newTestUsecase(t, nil)
+	seed := int64(3)
+
+	a, err := u.GeneratePokemon("pikachu", GenerateOptions{Seed: &seed, DNALength: 400})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	b, err := u.GeneratePokemon("eevee", GenerateOptions{Seed: &seed, DNALength: 400})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	// both parents know an ability of every element, the offspring only
+	// keeps the ones of its own types
+	a.Abilities = map[string]int{"tackle": 10, "quick_attack": 40}
+	b.Abilities = map[string]int{"tackle": 20, "body_slam": 30}
+	elemental := []string{"ember", "water_gun", "vine_whip", "thunder_shock", "powder_snow", "mud_slap", "gust", "confusion", "rock_throw", "lick", "dragon_breath"}
+	for _, name := range elemental {
+		a.Abilities[name] = 50
+		b.Abilities[name] = 50
+	}
+
+	opts := BreedOptions{Seed: &seed, Crossover: genetics.CrossoverUniform, MutationRate: 0.01}
+	child, err := u.BreedPokemon("pichu", a, b, opts)
+	if err != nil {
+		t.Fatalf("breed: %v", err)
+	}
+	again, _ := u.BreedPokemon("pichu", a, b, opts)
+	if !reflect.DeepEqual(child, again) {
+		t.Fatal("the same seed bred different offspring")
+	}
+
+	if len(child.DNA) != 400 || child.Seed != seed {
+		t.Fatalf("offspring has DNA length %d and seed %d", len(child.DNA), child.Seed)
+	}
+	if stats, _ := genetics.Stats(child.DNA); stats != child.Stats {
+		t.Fatalf("stats %+v do not match the DNA, want %+v", child.Stats, stats)
+	}
+	if child.Abilities["tackle"] != 15 {
+		t.Errorf("shared ability = %d, want the parents' mean 15", child.Abilities["tackle"])
+	}
+	var types []genetics.Element
+	for _, typ := range child.Types {
+		types = append(types, genetics.Element(typ))
+	}
+	for _, name := range elemental {
+		ability, _ := u.catalog.Lookup(name)
+		if _, ok := child.Abilities[name]; ok != ability.Learnable(types...) {
+			t.Errorf("offspring of types %v has %s: %t", child.Types, name, ok)
+		}
+	}
+	for name, v := range child.Abilities {
+		if name != "tackle" && !slices.Contains(elemental, name) && v != a.Abilities[name]+b.Abilities[name] {
+			t.Errorf("ability %s = %d was not inherited from a parent", name, v)
+		}
+	}
+
+	if _, err := u.BreedPokemon("pichu", a, entity.Pokemon{DNA: "AXC"}, opts); err == nil {
+		t.Fatal("bred a parent with invalid DNA")
+	}
+}
+
+func TestBattle(t *testing.T) {
+	u := newTestUsecase(t, nil)
+	seed := int64(9)
+
+	a, _ := u.GeneratePokemon("pikachu", GenerateOptions{Seed: &seed, DNALength: 400})
+	b, _ := u.GeneratePokemon("eevee", GenerateOptions{Seed: &seed, DNALength: 400})
+
+	report, err := u.Battle(a, b, BattleOptions{Seed: &seed, Rounds: 20})
+	if err != nil {
+		t.Fatalf("battle: %v", err)
+	}
+	if report.Seed != seed || report.Wins[0]+report.Wins[1]+report.Draws != 20 || len(report.First.Log) == 0 {
+		t.Fatalf("report = %+v", report)
+	}
+	again, _ := u.Battle(a, b, BattleOptions{Seed: &seed, Rounds: 20})
+	if !reflect.DeepEqual(report, again) {
+		t.Fatal("the same seed fought different battles")
+	}
+
+	if _, err := u.Battle(a, b, BattleOptions{Rounds: MaxBattleRounds + 1}); err == nil {
+		t.Fatal("fought more than the most rounds")
+	}
+}
+
+func TestEvolvePokemon(t *testing.T) {
+	u := newTestUsecase(t, nil)
+	seed := int64(5)
+
+	p, err := u.GeneratePokemon("charmander", GenerateOptions{Seed: &seed, DNALength: 400})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if p.Level != p.Stats.BaseLv || p.Stage != 0 {
+		t.Fatalf("generated pokemon at level %d, stage %d", p.Level, p.Stage)
+	}
+
+	opts := EvolveOptions{Seed: &seed, Levels: 40, MutationRate: 0.05}
+	evolved, err := u.EvolvePokemon("charmeleon", p, opts)
+	if err != nil {
+		t.Fatalf("evolve: %v", err)
+	}
+	again, _ := u.EvolvePokemon("charmeleon", p, opts)
+	if !reflect.DeepEqual(evolved, again) {
+		t.Fatal("the same seed evolved different forms")
+	}
+
+	if evolved.Stage != 1 || !reflect.DeepEqual(evolved.Lineage, []string{"charmander"}) {
+		t.Fatalf("stage %d, lineage %v", evolved.Stage, evolved.Lineage)
+	}
+	if want := min(p.Level+40, MaxLevel); evolved.Level != max(want, evolved.Stats.BaseLv) {
+		t.Fatalf("level %d, want %d", evolved.Level, want)
+	}
+	if evolved.DNA == p.DNA || len(evolved.DNA) != len(p.DNA) {
+		t.Fatal("DNA did not mutate")
+	}
+	base, _ := genetics.Stats(evolved.DNA)
+	grown := min(base.HP+base.HP*(evolved.Level-base.BaseLv)/GrowthLevels, genetics.Caps[genetics.HP])
+	if evolved.Stats.BaseLv != base.BaseLv || evolved.Stats.HP != grown {
+		t.Fatalf("stats %+v, want HP %d grown from %+v", evolved.Stats, grown, base)
+	}
+	for name, v := range p.Abilities {
+		if evolved.Abilities[name] < v {
+			t.Errorf("ability %s weakened from %d to %d", name, v, evolved.Abilities[name])
+		}
+	}
+
+	for range MaxStage - 1 {
+		if evolved, err = u.EvolvePokemon("charizard", evolved, opts); err != nil {
+			t.Fatalf("evolve: %v", err)
+		}
+	}
+	if evolved.Level != MaxLevel || len(evolved.Lineage) != MaxStage {
+		t.Fatalf("level %d, lineage %v after %d stages", evolved.Level, evolved.Lineage, MaxStage)
+	}
+	if _, err := u.EvolvePokemon("mega", evolved, opts); !errors.Is(err, ErrFullyEvolved) {
+		t.Fatalf("evolving past the last stage: %v", err)
+	}
+}
+
+func TestEvolvePokemonForgetsAbilitiesOfLostTypes(t *testing.T) {
+	u := newTestUsecase(t, nil)
+	// the mutation turns the psychic and rock pokemon of this seed into a
+	// ghost
+	seed := int64(4)
+
+	p, err := u.GeneratePokemon("squirtle", GenerateOptions{Seed: &seed, DNALength: 400})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	p.Abilities = map[string]int{"tackle": 10}
+	elemental := []string{"ember", "water_gun", "vine_whip", "thunder_shock", "powder_snow", "mud_slap", "gust", "confusion", "rock_throw", "lick", "dragon_breath"}
+	for _, name := range elemental {
+		p.Abilities[name] = 50
+	}
+
+	evolved, err := u.EvolvePokemon("wartortle", p, EvolveOptions{Seed: &seed, MutationRate: 0.3})
+	if err != nil {
+		t.Fatalf("evolve: %v", err)
+	}
+	if !reflect.DeepEqual(p.Types, []string{"psychic", "rock"}) || !reflect.DeepEqual(evolved.Types, []string{"ghost"}) {
+		t.Fatalf("evolved from %v to %v, want a type-changing mutation", p.Types, evolved.Types)
+	}
+	for _, name := range elemental {
+		ability, _ := u.catalog.Lookup(name)
+		if _, ok := evolved.Abilities[name]; ok != ability.Learnable(genetics.Ghost) {
+			t.Errorf("evolved form of types %v has %s: %t", evolved.Types, name, ok)
+		}
+	}
+	if evolved.Abilities["tackle"] < 10 {
+		t.Errorf("normal ability tackle = %d, want kept", evolved.Abilities["tackle"])
+	}
+}
@@ -0,0 +1,32 @@
+package usecase
+
+import (
+	"fmt"
+
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/entity"
+	"github.com/PongponZ/demo-profiling-and-optimization-go/super-worker/internal/tournament"
+)
+
+// TournamentOptions tune NewTournament. Zero values keep the defaults.
+type TournamentOptions struct {
+	// Seed makes the matches reproducible, see GenerateOptions.
+	Seed *int64 `json:"-"`
+	// Format defaults to tournament.RoundRobin.
+	Format tournament.Format `json:"format,omitempty"`
+}
+
+// NewTournament schedules a tournament between the entrants, listed by seed
+// for a bracket. The battles of its matches are left to the caller, see
+// Battle.
+func (u *PokemonUsecase) NewTournament(entrants []entity.Pokemon, opts TournamentOptions) (*tournament.Tournament, error) {
+	names := make([]string, len(entrants))
+	for i, p := range entrants {
+		if p.Name == "" {
+			return nil, fmt.Errorf("entrant %d has no name", i+1)
+		}
+		names[i] = p.Name
+	}
+
+	seed := u.seed(opts.Seed)
+	return tournament.New(opts.Format, names, seed)
+}